@@ -1,9 +1,16 @@
 package main
 
 import (
+	"os"
 	"runtime"
 
 	"github.com/spf13/cobra"
+	"github.com/sxllwx/vulcanus/pkg/command/fanout"
+	"github.com/sxllwx/vulcanus/pkg/scaffold/ca"
+	_ "github.com/sxllwx/vulcanus/pkg/scaffold/ca/init"
+	_ "github.com/sxllwx/vulcanus/pkg/scaffold/ca/sign"
+	"github.com/sxllwx/vulcanus/pkg/scaffold/config"
+	"github.com/sxllwx/vulcanus/pkg/scaffold/plugin"
 	"github.com/sxllwx/vulcanus/pkg/scaffold/rest/container"
 	"github.com/sxllwx/vulcanus/pkg/scaffold/rest/ws"
 )
@@ -12,6 +19,8 @@ func main() {
 
 	runtime.GOMAXPROCS(runtime.NumCPU())
 
+	var configFile string
+
 	rootCommand := &cobra.Command{
 		Use:   "vulcanus",
 		Short: "vulcanus is a very awesome golang code generator",
@@ -20,8 +29,22 @@ func main() {
 			cmd.Help()
 			return
 		},
+		// fill the flags not spec in command line by env and config file
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			cfg, err := config.Load(configFile)
+			if err != nil {
+				return err
+			}
+			return cfg.Apply(cmd)
+		},
 	}
+	rootCommand.PersistentFlags().StringVar(&configFile, "config", "", "config file (default is the "+config.FileName+" found from current dir to root)")
+
+	// the built-in commands, other teams can register their own by plugin.RegisterCommand
+	plugin.RegisterCommand(ws.Command(), container.Command(), plugin.GenerateCommand(), ca.RootCommand, fanout.Command())
+	rootCommand.AddCommand(plugin.Commands()...)
 
-	rootCommand.AddCommand(ws.Command(), container.Command())
+	// the vulcanus-<name> executables on PATH, like kubectl plugins
+	rootCommand.AddCommand(plugin.ExternalCommands(os.Getenv("PATH"), rootCommand.Commands()...)...)
 	rootCommand.Execute()
 }
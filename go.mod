@@ -8,13 +8,16 @@ require (
 	github.com/go-openapi/spec v0.19.2
 	github.com/juju/errors v0.0.0-20190930114154-d42613fe1ab9
 	github.com/patrickmn/go-cache v2.1.0+incompatible // indirect
-	github.com/pkg/errors v0.8.1
+	github.com/pkg/errors v0.9.1
+	github.com/pkg/sftp v1.13.0
 	github.com/spf13/cobra v0.0.5
-	github.com/stretchr/testify v1.4.0
+	github.com/spf13/pflag v1.0.5
+	github.com/stretchr/testify v1.6.1
 	go.etcd.io/etcd v3.3.17+incompatible // indirect
 	go.uber.org/zap v1.14.1
-	golang.org/x/crypto v0.0.0-20190611184440-5c40567a22f8
+	golang.org/x/crypto v0.0.0-20201221181555-eec23a3978ad
 	golang.org/x/tools v0.0.0-20191029190741-b9c20aec41a5
 	google.golang.org/grpc v1.24.0 // indirect
+	gopkg.in/yaml.v2 v2.2.8
 	k8s.io/apimachinery v0.18.0 // indirect
 )
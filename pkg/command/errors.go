@@ -0,0 +1,37 @@
+package command
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+)
+
+// ExitError
+// the cmd exit with non-zero code or killed by signal
+type ExitError struct {
+	Code int
+	// the name of signal which killed the cmd, eg: INT, KILL
+	Signal string
+}
+
+func (e *ExitError) Error() string {
+
+	if len(e.Signal) != 0 {
+		return fmt.Sprintf("killed by signal %s", e.Signal)
+	}
+	return fmt.Sprintf("exit status %d", e.Code)
+}
+
+// ExitCode
+// the exit code of the err, 0 for nil, -1 for the err is not *ExitError
+func ExitCode(err error) int {
+
+	if err == nil {
+		return 0
+	}
+
+	if e, ok := errors.Cause(err).(*ExitError); ok {
+		return e.Code
+	}
+	return -1
+}
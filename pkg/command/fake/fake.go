@@ -0,0 +1,399 @@
+package fake
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sxllwx/vulcanus/pkg/command"
+)
+
+// ErrNoResponse
+// the cmd not match any scripted response
+var ErrNoResponse = errors.New("no scripted response")
+
+// ErrClosed
+// the host already closed
+var ErrClosed = errors.New("fake host already closed")
+
+// Call
+// the recorded invocation
+type Call struct {
+	Cmd   string
+	Args  []string
+	Stdin []byte
+	// the Env, Dir and User of the ExecOptions
+	Env  []string
+	Dir  string
+	User string
+	// the time the cmd started
+	Time time.Time
+}
+
+// String
+// the command line of the call
+func (c Call) String() string {
+	return command.Join(c.Cmd, c.Args)
+}
+
+// Matcher
+// match a argument of the cmd
+type Matcher interface {
+	Match(arg string) bool
+}
+
+type exact string
+
+func (e exact) Match(arg string) bool { return string(e) == arg }
+
+// Exact
+// the argument equal to s
+func Exact(s string) Matcher {
+	return exact(s)
+}
+
+type pattern struct {
+	*regexp.Regexp
+}
+
+func (p pattern) Match(arg string) bool { return p.MatchString(arg) }
+
+// Regexp
+// the whole argument match the regular expression, panic if the expr is invalid
+func Regexp(expr string) Matcher {
+	return pattern{regexp.MustCompile("^(?:" + expr + ")$")}
+}
+
+type anyArg struct{}
+
+func (anyArg) Match(string) bool { return true }
+
+// Any
+// match any argument
+func Any() Matcher {
+	return anyArg{}
+}
+
+type restArgs struct{}
+
+func (restArgs) Match(string) bool { return true }
+
+// Rest
+// match the remaining arguments, even none, must be the last matcher
+func Rest() Matcher {
+	return restArgs{}
+}
+
+// Response
+// the scripted response of the matched cmd
+type Response struct {
+	cmd  string
+	args []Matcher
+
+	stdout   []byte
+	stderr   []byte
+	exitCode int
+	err      error
+	delay    time.Duration
+
+	// 0 means unlimited
+	times int
+	used  int
+}
+
+// Stdout
+// the output of the cmd
+func (r *Response) Stdout(s string) *Response {
+	r.stdout = []byte(s)
+	return r
+}
+
+// Stderr
+// the error output of the cmd
+func (r *Response) Stderr(s string) *Response {
+	r.stderr = []byte(s)
+	return r
+}
+
+// Exit
+// the cmd exit with the code, reported by *command.ExitError if not zero
+func (r *Response) Exit(code int) *Response {
+	r.exitCode = code
+	return r
+}
+
+// Error
+// the cmd can not be started, eg: not found
+func (r *Response) Error(err error) *Response {
+	r.err = err
+	return r
+}
+
+// Delay
+// the cmd run for the duration, the ctx done before it is treated as timeout
+func (r *Response) Delay(d time.Duration) *Response {
+	r.delay = d
+	return r
+}
+
+// Times
+// the response only used n times, then the next matched response used
+func (r *Response) Times(n int) *Response {
+	r.times = n
+	return r
+}
+
+// Once
+// same as Times(1)
+func (r *Response) Once() *Response {
+	return r.Times(1)
+}
+
+func (r *Response) match(cmd string, args []string) bool {
+
+	if r.cmd != cmd || (r.times > 0 && r.used >= r.times) {
+		return false
+	}
+
+	for i, m := range r.args {
+		if _, ok := m.(restArgs); ok {
+			return true
+		}
+		if i >= len(args) || !m.Match(args[i]) {
+			return false
+		}
+	}
+	return len(args) == len(r.args)
+}
+
+// Host
+// the fake command.Interface, record every invocation, and reply the scripted response,
+// the responses are matched in the order they added
+type Host struct {
+	mu        sync.Mutex
+	responses []*Response
+	calls     []Call
+	closed    bool
+
+	// reply the cmd not matched, nil means ErrNoResponse
+	fallback *Response
+}
+
+var _ command.Interface = &Host{}
+var _ command.Streamer = &Host{}
+var _ command.Runner = &Host{}
+
+func NewHost() *Host {
+	return &Host{}
+}
+
+// On
+// script the response of the cmd with the exact args
+func (h *Host) On(cmd string, args ...string) *Response {
+
+	matchers := make([]Matcher, 0, len(args))
+	for _, a := range args {
+		matchers = append(matchers, Exact(a))
+	}
+	return h.OnMatch(cmd, matchers...)
+}
+
+// OnMatch
+// script the response of the cmd with the args matched by the matchers
+func (h *Host) OnMatch(cmd string, args ...Matcher) *Response {
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	r := &Response{cmd: cmd, args: args}
+	h.responses = append(h.responses, r)
+	return r
+}
+
+// Fallback
+// the response of the cmd not matched, instead of ErrNoResponse
+func (h *Host) Fallback() *Response {
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.fallback = &Response{}
+	return h.fallback
+}
+
+// Calls
+// the recorded invocations in order
+func (h *Host) Calls() []Call {
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return append([]Call(nil), h.calls...)
+}
+
+// CommandLines
+// the command line of the recorded invocations, useful for compare
+func (h *Host) CommandLines() []string {
+
+	var out []string
+	for _, c := range h.Calls() {
+		out = append(out, c.String())
+	}
+	return out
+}
+
+// Reset
+// clear the recorded invocations, the responses are kept
+func (h *Host) Reset() {
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.calls = nil
+}
+
+// Unused
+// the responses limited by Times but not used up, useful for verify all the expected cmd run
+func (h *Host) Unused() []string {
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var out []string
+	for _, r := range h.responses {
+		if r.times > 0 && r.used < r.times {
+			out = append(out, fmt.Sprintf("%s (%d of %d used)", r.cmd, r.used, r.times))
+		}
+	}
+	return out
+}
+
+// record
+// record the call, and find the response
+func (h *Host) record(cmd string, args []string, opts *command.ExecOptions) (*Response, error) {
+
+	var stdin []byte
+	if opts.In != nil {
+		stdin, _ = ioutil.ReadAll(opts.In)
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.closed {
+		return nil, ErrClosed
+	}
+
+	h.calls = append(h.calls, Call{
+		Cmd:   cmd,
+		Args:  append([]string(nil), args...),
+		Stdin: stdin,
+		Env:   append([]string(nil), opts.Env...),
+		Dir:   opts.Dir,
+		User:  opts.User,
+		Time:  time.Now(),
+	})
+
+	for _, r := range h.responses {
+		if r.match(cmd, args) {
+			r.used++
+			return r, nil
+		}
+	}
+
+	if h.fallback != nil {
+		return h.fallback, nil
+	}
+	return nil, errors.WithMessagef(ErrNoResponse, "%s", command.Join(cmd, args))
+}
+
+func (h *Host) Exec(cmd string, args []string, in io.Reader, out, err io.WriteCloser) error {
+
+	_, e := h.ExecStream(context.Background(), cmd, args, in, out, err)
+	return e
+}
+
+func (h *Host) ExecContext(ctx context.Context, cmd string, args []string, in io.Reader) (*command.Result, error) {
+	return h.ExecStream(ctx, cmd, args, in, nil, nil)
+}
+
+func (h *Host) ExecStream(ctx context.Context, cmd string, args []string, in io.Reader, out, errOut io.Writer) (*command.Result, error) {
+
+	return h.Run(ctx, cmd, args, &command.ExecOptions{
+		In:  in,
+		Out: out,
+		Err: errOut,
+	})
+}
+
+func (h *Host) Run(ctx context.Context, cmd string, args []string, opts *command.ExecOptions) (*command.Result, error) {
+
+	if opts == nil {
+		opts = &command.ExecOptions{}
+	}
+
+	var (
+		stdout = &bytes.Buffer{}
+		stderr = &bytes.Buffer{}
+		start  = time.Now()
+	)
+
+	result := func(err error) (*command.Result, error) {
+		return &command.Result{
+			ExitCode: command.ExitCode(err),
+			Duration: time.Since(start),
+			Stdout:   stdout.Bytes(),
+			Stderr:   stderr.Bytes(),
+		}, err
+	}
+
+	r, err := h.record(cmd, args, opts)
+	if err != nil {
+		return result(err)
+	}
+	if r.err != nil {
+		return result(errors.WithMessage(r.err, "start cmd"))
+	}
+
+	if r.delay > 0 {
+		t := time.NewTimer(r.delay)
+		defer t.Stop()
+
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return result(errors.WithMessage(ctx.Err(), "wait cmd"))
+		}
+	}
+
+	out, errOut := opts.Writers(stdout, stderr)
+	out.Write(r.stdout)
+	errOut.Write(r.stderr)
+
+	if r.exitCode != 0 {
+		return result(&command.ExitError{Code: r.exitCode})
+	}
+	return result(nil)
+}
+
+func (h *Host) Close() error {
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.closed = true
+	return nil
+}
+
+// String
+// the recorded command lines, one per line
+func (h *Host) String() string {
+	return strings.Join(h.CommandLines(), "\n")
+}
@@ -0,0 +1,97 @@
+package fake
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sxllwx/vulcanus/pkg/command"
+)
+
+func TestHost(t *testing.T) {
+
+	h := NewHost()
+	h.On("echo", "hello").Stdout("hello\n")
+	h.OnMatch("ls", Exact("-l"), Regexp("/tmp/.*")).Stdout("total 0\n")
+	h.OnMatch("cat", Rest()).Stderr("no such file\n").Exit(1)
+
+	r, err := h.ExecContext(context.Background(), "echo", []string{"hello"}, nil)
+	if err != nil || string(r.Stdout) != "hello\n" {
+		t.Fatalf("unexpected %q %v", r.Stdout, err)
+	}
+
+	out := &bytes.Buffer{}
+	r, err = h.ExecStream(context.Background(), "ls", []string{"-l", "/tmp/vulcanus"}, nil, out, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "total 0\n" {
+		t.Fatalf("unexpected %q", out.String())
+	}
+	// the streamed output is not captured
+	if len(r.Stdout) != 0 {
+		t.Fatalf("unexpected captured %q", r.Stdout)
+	}
+
+	r, err = h.ExecContext(context.Background(), "cat", []string{"a", "b"}, strings.NewReader("input"))
+	if command.ExitCode(err) != 1 || r.ExitCode != 1 || string(r.Stderr) != "no such file\n" {
+		t.Fatalf("unexpected %#v %v", r, err)
+	}
+
+	// the args not match
+	if _, err := h.ExecContext(context.Background(), "ls", []string{"-l", "/var"}, nil); errors.Cause(err) != ErrNoResponse {
+		t.Fatalf("expect ErrNoResponse, got %v", err)
+	}
+
+	expect := []string{"echo hello", "ls -l /tmp/vulcanus", "cat a b", "ls -l /var"}
+	if lines := h.CommandLines(); !reflect.DeepEqual(lines, expect) {
+		t.Fatalf("expect %q, got %q", expect, lines)
+	}
+	if stdin := string(h.Calls()[2].Stdin); stdin != "input" {
+		t.Fatalf("unexpected stdin %q", stdin)
+	}
+}
+
+func TestHostTimes(t *testing.T) {
+
+	h := NewHost()
+	h.On("iptables", "-C").Exit(1).Once()
+	h.On("iptables", "-C")
+	h.On("iptables", "-A").Times(2)
+	h.Fallback().Exit(127)
+
+	for i, e := range []int{1, 0, 0} {
+		if _, err := h.ExecContext(context.Background(), "iptables", []string{"-C"}, nil); command.ExitCode(err) != e {
+			t.Fatalf("call %d expect exit %d, got %v", i, e, err)
+		}
+	}
+
+	if _, err := h.ExecContext(context.Background(), "iptables", []string{"-D"}, nil); command.ExitCode(err) != 127 {
+		t.Fatalf("expect the fallback, got %v", err)
+	}
+
+	if unused := h.Unused(); len(unused) != 1 {
+		t.Fatalf("expect the -A unused, got %v", unused)
+	}
+}
+
+func TestHostDelay(t *testing.T) {
+
+	h := NewHost()
+	h.On("sleep").Delay(time.Second)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	if _, err := h.ExecContext(ctx, "sleep", nil, nil); errors.Cause(err) != context.DeadlineExceeded {
+		t.Fatalf("expect timeout, got %v", err)
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Fatalf("the ctx not respected, took %s", d)
+	}
+}
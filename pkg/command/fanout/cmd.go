@@ -0,0 +1,93 @@
+package fanout
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"github.com/sxllwx/vulcanus/pkg/command"
+	"github.com/sxllwx/vulcanus/pkg/command/remote"
+)
+
+type option struct {
+
+	// the inventory file
+	inventory string
+	// only run on these hosts
+	hosts []string
+
+	concurrency int
+	batchSize   int
+	failFast    bool
+	timeout     time.Duration
+}
+
+func (o *option) run(cmd *cobra.Command, args []string) error {
+
+	inv, err := LoadInventory(o.inventory)
+	if err != nil {
+		return err
+	}
+
+	pool := remote.NewPool(remote.PoolConfig{})
+	defer pool.Close()
+
+	hosts, err := inv.Connect(pool, o.hosts...)
+	if err != nil {
+		return err
+	}
+
+	opts := &Options{
+		Concurrency: o.concurrency,
+		BatchSize:   o.batchSize,
+		Timeout:     o.timeout,
+		Stdout:      os.Stdout,
+		Stderr:      os.Stderr,
+	}
+	if o.failFast {
+		opts.Policy = FailFast
+	}
+
+	results, err := Run(context.Background(), hosts, args[0], args[1:], opts)
+
+	// the summary
+	for _, r := range results {
+		switch {
+		case r.Err == nil:
+			fmt.Fprintf(os.Stderr, "%s\tok\t%s\n", r.Host, r.Result.Duration)
+		case r.Err == ErrSkipped:
+			fmt.Fprintf(os.Stderr, "%s\tskipped\n", r.Host)
+		default:
+			fmt.Fprintf(os.Stderr, "%s\tfailed (exit %d)\t%v\n", r.Host, command.ExitCode(r.Err), r.Err)
+		}
+	}
+	return err
+}
+
+func Command() *cobra.Command {
+
+	o := &option{}
+	cmd := &cobra.Command{
+		Use:   "exec -i inventory.yaml -- cmd [args...]",
+		Short: "run the cmd on many hosts in parallel",
+		Args: func(cmd *cobra.Command, args []string) error {
+			if len(args) == 0 {
+				return errors.New("please spec the cmd")
+			}
+			return nil
+		},
+		RunE: o.run,
+	}
+
+	cmd.Flags().StringVarP(&o.inventory, "inventory", "i", "", "the inventory file")
+	cmd.MarkFlagRequired("inventory")
+	cmd.Flags().StringSliceVarP(&o.hosts, "hosts", "H", nil, "only run on these hosts, default all the hosts in inventory")
+	cmd.Flags().IntVarP(&o.concurrency, "concurrency", "c", 10, "the max hosts run at the same time")
+	cmd.Flags().IntVarP(&o.batchSize, "batch", "b", 0, "rolling batch size, the next batch start after the previous finished")
+	cmd.Flags().BoolVar(&o.failFast, "fail-fast", false, "cancel the rest hosts once a host failed")
+	cmd.Flags().DurationVarP(&o.timeout, "timeout", "t", 0, "the timeout of every host")
+	return cmd
+}
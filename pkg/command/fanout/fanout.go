@@ -0,0 +1,188 @@
+package fanout
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sxllwx/vulcanus/pkg/command"
+)
+
+// Policy
+// how to handle the failed host
+type Policy int
+
+const (
+	// run the cmd on all the hosts whatever some of them failed
+	ContinueOnError Policy = iota
+	// cancel the running hosts and skip the rest once a host failed
+	FailFast
+)
+
+// ErrSkipped
+// the host not run, because of the fail-fast
+var ErrSkipped = errors.New("skipped")
+
+// Host
+// the host in the inventory
+type Host struct {
+	Name string
+	command.Interface
+}
+
+// Options
+// the fan-out execution config
+type Options struct {
+	// the max hosts run at the same time, default is 10
+	Concurrency int
+	// the hosts are split to batches, the next batch start after the previous finished,
+	// 0 means all the hosts in one batch
+	BatchSize int
+
+	Policy Policy
+
+	// the timeout of every host, 0 means no timeout
+	Timeout time.Duration
+
+	// the output of all the hosts, every line prefixed by the host name
+	Stdout io.Writer
+	Stderr io.Writer
+	// the input of every host
+	Stdin []byte
+}
+
+// Complete
+// set default value for Options
+func (o *Options) Complete() {
+
+	if o.Concurrency <= 0 {
+		o.Concurrency = 10
+	}
+}
+
+// HostResult
+// the result of a host
+type HostResult struct {
+	Host   string
+	Result *command.Result
+	Err    error
+}
+
+// Failed
+// the hosts not succeed
+func Failed(results []HostResult) []HostResult {
+
+	var out []HostResult
+	for _, r := range results {
+		if r.Err != nil {
+			out = append(out, r)
+		}
+	}
+	return out
+}
+
+// Run
+// run the cmd on the hosts, the results are in the order of hosts,
+// the err is not nil if any host failed
+func Run(ctx context.Context, hosts []Host, cmd string, args []string, opts *Options) ([]HostResult, error) {
+
+	if opts == nil {
+		opts = &Options{}
+	}
+	opts.Complete()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		results = make([]HostResult, len(hosts))
+		stdout  = newPrefixWriters(opts.Stdout)
+		stderr  = newPrefixWriters(opts.Stderr)
+	)
+
+	batchSize := opts.BatchSize
+	if batchSize <= 0 {
+		batchSize = len(hosts)
+	}
+
+	for start := 0; start < len(hosts); start += batchSize {
+
+		end := start + batchSize
+		if end > len(hosts) {
+			end = len(hosts)
+		}
+
+		var (
+			wg  sync.WaitGroup
+			sem = make(chan struct{}, opts.Concurrency)
+		)
+
+		for i := start; i < end; i++ {
+
+			results[i].Host = hosts[i].Name
+
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+			}
+			if ctx.Err() != nil {
+				results[i].Err = ErrSkipped
+				continue
+			}
+
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				defer func() { <-sem }()
+
+				out := stdout.writer(hosts[i].Name)
+				errOut := stderr.writer(hosts[i].Name)
+
+				r, err := runHost(ctx, hosts[i], cmd, args, opts, out, errOut)
+				out.Flush()
+				errOut.Flush()
+
+				results[i].Result = r
+				results[i].Err = err
+				if err != nil && opts.Policy == FailFast {
+					cancel()
+				}
+			}(i)
+		}
+		wg.Wait()
+	}
+
+	if failed := Failed(results); len(failed) != 0 {
+		return results, errors.Errorf("%d of %d hosts failed", len(failed), len(hosts))
+	}
+	return results, nil
+}
+
+func runHost(ctx context.Context, h Host, cmd string, args []string, opts *Options, out, errOut io.Writer) (*command.Result, error) {
+
+	if opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.Timeout)
+		defer cancel()
+	}
+
+	var in io.Reader
+	if opts.Stdin != nil {
+		in = bytes.NewReader(opts.Stdin)
+	}
+
+	if s, ok := h.Interface.(command.Streamer); ok {
+		return s.ExecStream(ctx, cmd, args, in, out, errOut)
+	}
+
+	// the output can't be streamed, write it after the cmd exit
+	r, err := h.ExecContext(ctx, cmd, args, in)
+	if r != nil {
+		out.Write(r.Stdout)
+		errOut.Write(r.Stderr)
+	}
+	return r, err
+}
@@ -0,0 +1,206 @@
+package fanout
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sxllwx/vulcanus/pkg/command/local"
+	"github.com/sxllwx/vulcanus/pkg/command/remote"
+)
+
+// syncBuffer
+// the buffer shared by the hosts
+type syncBuffer struct {
+	mu sync.Mutex
+	bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.Buffer.Write(p)
+}
+
+func localHosts(names ...string) []Host {
+
+	var out []Host
+	for _, n := range names {
+		out = append(out, Host{Name: n, Interface: local.NewTTY()})
+	}
+	return out
+}
+
+func TestRun(t *testing.T) {
+
+	out := &syncBuffer{}
+	results, err := Run(context.Background(), localHosts("a", "b", "c"), "sh", []string{"-c", "echo hello; printf world"}, &Options{
+		Stdout: out,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, name := range []string{"a", "b", "c"} {
+		if results[i].Host != name || results[i].Err != nil {
+			t.Fatalf("unexpected result %#v", results[i])
+		}
+		for _, line := range []string{"[" + name + "] hello\n", "[" + name + "] world\n"} {
+			if !strings.Contains(out.String(), line) {
+				t.Fatalf("expect %q in %q", line, out.String())
+			}
+		}
+	}
+}
+
+func TestRunConcurrency(t *testing.T) {
+
+	hosts := localHosts("a", "b", "c", "d")
+
+	for _, opts := range []*Options{
+		{Concurrency: 1},
+		{BatchSize: 1},
+	} {
+		start := time.Now()
+		if _, err := Run(context.Background(), hosts, "sleep", []string{"0.2"}, opts); err != nil {
+			t.Fatal(err)
+		}
+		if d := time.Since(start); d < 800*time.Millisecond {
+			t.Fatalf("expect the hosts run one by one, took %s", d)
+		}
+	}
+
+	start := time.Now()
+	if _, err := Run(context.Background(), hosts, "sleep", []string{"0.2"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d > 700*time.Millisecond {
+		t.Fatalf("expect the hosts run in parallel, took %s", d)
+	}
+}
+
+func TestRunContinueOnError(t *testing.T) {
+
+	results, err := Run(context.Background(), localHosts("a", "b", "c"), "sh", []string{"-c", "exit 3"}, &Options{
+		Concurrency: 1,
+	})
+	if err == nil {
+		t.Fatal("expect error")
+	}
+	if len(Failed(results)) != 3 {
+		t.Fatalf("expect all the hosts failed, got %#v", results)
+	}
+	for _, r := range results {
+		if r.Err == ErrSkipped {
+			t.Fatalf("expect %s run", r.Host)
+		}
+	}
+}
+
+func TestRunFailFast(t *testing.T) {
+
+	results, err := Run(context.Background(), localHosts("a", "b", "c"), "false", nil, &Options{
+		Concurrency: 1,
+		Policy:      FailFast,
+	})
+	if err == nil {
+		t.Fatal("expect error")
+	}
+	if results[0].Err == nil || results[0].Err == ErrSkipped {
+		t.Fatalf("expect the first host failed, got %v", results[0].Err)
+	}
+	for _, r := range results[1:] {
+		if r.Err != ErrSkipped {
+			t.Fatalf("expect %s skipped, got %v", r.Host, r.Err)
+		}
+	}
+}
+
+func TestInventory(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "vulcanus-fanout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "inventory.yaml")
+	body := `
+defaults:
+  user: root
+hosts:
+- name: node-1
+  remote: local
+- name: node-2
+  remote: local
+`
+	if err := ioutil.WriteFile(file, []byte(body), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	inv, err := LoadInventory(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool := remote.NewPool(remote.PoolConfig{})
+	defer pool.Close()
+
+	hosts, err := inv.Connect(pool, "node-2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hosts) != 1 || hosts[0].Name != "node-2" {
+		t.Fatalf("unexpected hosts %#v", hosts)
+	}
+
+	if _, err := inv.Connect(pool, "node-3"); err == nil {
+		t.Fatal("expect the unknown host rejected")
+	}
+}
+
+func TestInventoryDefaults(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "vulcanus-fanout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "inventory.yaml")
+	body := `
+defaults:
+  privateKeyFile: ~/.ssh/id_rsa
+  trustOnFirstUse: true
+hosts:
+- remote: 192.168.240.101:22
+- remote: 192.168.240.102:22
+  trustOnFirstUse: false
+`
+	if err := ioutil.WriteFile(file, []byte(body), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	inv, err := LoadInventory(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	home, _ := os.UserHomeDir()
+	if e, a := filepath.Join(home, ".ssh", "id_rsa"), inv.Defaults.PrivateKeyFile; e != a {
+		t.Fatalf("expect %s, got %s", e, a)
+	}
+
+	// the host turn off the option enabled by the defaults
+	first := inv.Hosts[0].merge(inv.Defaults).remoteConfig()
+	second := inv.Hosts[1].merge(inv.Defaults).remoteConfig()
+	if !first.TrustOnFirstUse || second.TrustOnFirstUse || second.PrivateKeyFile != first.PrivateKeyFile {
+		t.Fatalf("unexpected configs %+v %+v", first, second)
+	}
+}
@@ -0,0 +1,188 @@
+package fanout
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/sxllwx/vulcanus/pkg/command/local"
+	"github.com/sxllwx/vulcanus/pkg/command/remote"
+	"gopkg.in/yaml.v2"
+)
+
+// the Remote of the local host in the inventory
+const LocalRemote = "local"
+
+// Inventory
+// the hosts run the cmd
+//
+//	defaults:
+//	  user: root
+//	  privateKeyFile: ~/.ssh/id_rsa
+//	hosts:
+//	- name: node-1
+//	  remote: 192.168.240.101:22
+//	- name: node-2
+//	  remote: 192.168.240.102:22
+//	  user: admin
+type Inventory struct {
+	Defaults HostConfig   `yaml:"defaults"`
+	Hosts    []HostConfig `yaml:"hosts"`
+}
+
+// HostConfig
+// the ssh config of a host, the empty field use the value in Defaults
+type HostConfig struct {
+	Name string `yaml:"name"`
+	// the address of the host, or "local" for the local host
+	Remote         string `yaml:"remote"`
+	User           string `yaml:"user"`
+	PrivateKeyFile string `yaml:"privateKeyFile"`
+	Passphrase     string `yaml:"passphrase"`
+	Password       string `yaml:"password"`
+	KnownHostsFile string `yaml:"knownHostsFile"`
+
+	// the nil means the value in Defaults, so the host can turn off the option enabled by Defaults
+	UseAgent              *bool `yaml:"useAgent"`
+	TrustOnFirstUse       *bool `yaml:"trustOnFirstUse"`
+	InsecureIgnoreHostKey *bool `yaml:"insecureIgnoreHostKey"`
+}
+
+// LoadInventory
+// read the inventory file
+func LoadInventory(file string) (*Inventory, error) {
+
+	body, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, errors.WithMessagef(err, "read inventory %s", file)
+	}
+
+	out := &Inventory{}
+	if err := yaml.UnmarshalStrict(body, out); err != nil {
+		return nil, errors.WithMessagef(err, "unmarshal inventory %s", file)
+	}
+	out.expandEnv()
+	return out, nil
+}
+
+// merge
+// fill the empty fields by the defaults
+func (h HostConfig) merge(d HostConfig) HostConfig {
+
+	if len(h.Name) == 0 {
+		h.Name = h.Remote
+	}
+	if len(h.User) == 0 {
+		h.User = d.User
+	}
+	if len(h.PrivateKeyFile) == 0 {
+		h.PrivateKeyFile = d.PrivateKeyFile
+		h.Passphrase = d.Passphrase
+	}
+	if len(h.Password) == 0 {
+		h.Password = d.Password
+	}
+	if len(h.KnownHostsFile) == 0 {
+		h.KnownHostsFile = d.KnownHostsFile
+	}
+	if h.UseAgent == nil {
+		h.UseAgent = d.UseAgent
+	}
+	if h.TrustOnFirstUse == nil {
+		h.TrustOnFirstUse = d.TrustOnFirstUse
+	}
+	if h.InsecureIgnoreHostKey == nil {
+		h.InsecureIgnoreHostKey = d.InsecureIgnoreHostKey
+	}
+	return h
+}
+
+// isTrue
+// the option is set and enabled
+func isTrue(b *bool) bool {
+	return b != nil && *b
+}
+
+func (h HostConfig) remoteConfig() *remote.Config {
+
+	return &remote.Config{
+		Remote:                h.Remote,
+		User:                  h.User,
+		PrivateKeyFile:        h.PrivateKeyFile,
+		Passphrase:            h.Passphrase,
+		Password:              h.Password,
+		UseAgent:              isTrue(h.UseAgent),
+		KnownHostsFile:        h.KnownHostsFile,
+		TrustOnFirstUse:       isTrue(h.TrustOnFirstUse),
+		InsecureIgnoreHostKey: isTrue(h.InsecureIgnoreHostKey),
+	}
+}
+
+// Connect
+// the hosts of the inventory, the ssh hosts share the connections in the pool,
+// if names not empty, only the named hosts returned
+func (inv *Inventory) Connect(pool *remote.Pool, names ...string) ([]Host, error) {
+
+	wanted := make(map[string]bool, len(names))
+	for _, n := range names {
+		wanted[n] = true
+	}
+
+	var out []Host
+	for _, h := range inv.Hosts {
+
+		h = h.merge(inv.Defaults)
+		if len(wanted) != 0 && !wanted[h.Name] {
+			continue
+		}
+		delete(wanted, h.Name)
+
+		if h.Remote == LocalRemote {
+			out = append(out, Host{Name: h.Name, Interface: local.NewTTY()})
+			continue
+		}
+
+		c, err := pool.Client(h.remoteConfig())
+		if err != nil {
+			return nil, errors.WithMessagef(err, "connect %s", h.Name)
+		}
+		out = append(out, Host{Name: h.Name, Interface: c})
+	}
+
+	for n := range wanted {
+		return nil, errors.Errorf("host %s not in the inventory", n)
+	}
+	return out, nil
+}
+
+// expandEnv
+// the inventory may refer the env or the home, eg: ${HOME}/.ssh/id_rsa, ~/.ssh/id_rsa
+func (inv *Inventory) expandEnv() {
+
+	expand := func(h *HostConfig) {
+		h.PrivateKeyFile = expandPath(h.PrivateKeyFile)
+		h.KnownHostsFile = expandPath(h.KnownHostsFile)
+	}
+	expand(&inv.Defaults)
+	for i := range inv.Hosts {
+		expand(&inv.Hosts[i])
+	}
+}
+
+// expandPath
+// expand the env, and the leading ~/ to the home of the current user
+func expandPath(p string) string {
+
+	p = os.ExpandEnv(p)
+	if p != "~" && !strings.HasPrefix(p, "~/") {
+		return p
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return p
+	}
+	return filepath.Join(home, p[1:])
+}
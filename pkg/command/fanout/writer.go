@@ -0,0 +1,95 @@
+package fanout
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"sync"
+)
+
+// prefixWriters
+// the writers of the hosts share the underlay writer
+type prefixWriters struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func newPrefixWriters(w io.Writer) *prefixWriters {
+
+	if w == nil {
+		w = ioutil.Discard
+	}
+	return &prefixWriters{w: w}
+}
+
+func (p *prefixWriters) writer(host string) *prefixWriter {
+	return &prefixWriter{
+		prefix: []byte("[" + host + "] "),
+		parent: p,
+	}
+}
+
+// prefixWriter
+// write the complete lines with the host prefix,
+// so the lines of the hosts will not be interleaved
+type prefixWriter struct {
+	prefix []byte
+	parent *prefixWriters
+
+	mu  sync.Mutex
+	buf []byte
+}
+
+func (w *prefixWriter) Write(b []byte) (int, error) {
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.buf = append(w.buf, b...)
+
+	i := bytes.LastIndexByte(w.buf, '\n')
+	if i < 0 {
+		return len(b), nil
+	}
+
+	lines := w.buf[:i+1]
+	if err := w.writeLines(lines); err != nil {
+		return 0, err
+	}
+	w.buf = append(w.buf[:0], w.buf[i+1:]...)
+	return len(b), nil
+}
+
+// Flush
+// write the last line without the line break
+func (w *prefixWriter) Flush() error {
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if len(w.buf) == 0 {
+		return nil
+	}
+
+	err := w.writeLines(append(w.buf, '\n'))
+	w.buf = w.buf[:0]
+	return err
+}
+
+func (w *prefixWriter) writeLines(lines []byte) error {
+
+	out := &bytes.Buffer{}
+	for _, line := range bytes.SplitAfter(lines, []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		out.Write(w.prefix)
+		out.Write(line)
+	}
+
+	w.parent.mu.Lock()
+	defer w.parent.mu.Unlock()
+
+	_, err := w.parent.w.Write(out.Bytes())
+	return err
+}
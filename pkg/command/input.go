@@ -0,0 +1,59 @@
+package command
+
+import (
+	"io"
+	"time"
+)
+
+// deadliner
+// the reader can be interrupted by the read deadline, eg: *os.File of a pipe, net.Conn
+type deadliner interface {
+	SetReadDeadline(t time.Time) error
+}
+
+// CopyInput
+// copy the in to the w in background until the returned stop called, the input read after stop is dropped,
+// the stop interrupt the blocked read and wait the copy end if the in support the read deadline,
+// and the deadline is reset after, otherwise the copy end after the next read
+func CopyInput(w io.Writer, in io.Reader) func() {
+
+	done := make(chan struct{})
+	exited := make(chan struct{})
+
+	go func() {
+		defer close(exited)
+
+		buf := make([]byte, 32*1024)
+		for {
+			n, err := in.Read(buf)
+
+			select {
+			case <-done:
+				return
+			default:
+			}
+
+			if n > 0 {
+				if _, err := w.Write(buf[:n]); err != nil {
+					return
+				}
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+
+		d, ok := in.(deadliner)
+		if !ok {
+			return
+		}
+		d.SetReadDeadline(time.Now())
+		<-exited
+		// the in is still usable by the caller
+		d.SetReadDeadline(time.Time{})
+	}
+}
@@ -1,10 +1,100 @@
 package command
 
 import (
+	"context"
 	"io"
+	"os"
+	"time"
 )
 
 type Interface interface {
 	Exec(cmd string, args []string, in io.Reader, out, err io.WriteCloser) error
+	// ExecContext
+	// run the cmd until it exit or the ctx done, the output is captured in the Result
+	// the non-zero exit reported by *ExitError, the Result is always not nil
+	ExecContext(ctx context.Context, cmd string, args []string, in io.Reader) (*Result, error)
 	io.Closer
 }
+
+// Streamer
+// like ExecContext, but the output is streamed to the writers while running,
+// only the output of the nil writer is captured in the Result
+type Streamer interface {
+	ExecStream(ctx context.Context, cmd string, args []string, in io.Reader, out, err io.Writer) (*Result, error)
+}
+
+// Result
+// the result of the cmd run by ExecContext
+type Result struct {
+	ExitCode int
+	Duration time.Duration
+	Stdout   []byte
+	Stderr   []byte
+}
+
+// Terminal
+// the interactive executor, the command run in a pseudo terminal
+type Terminal interface {
+	// Interact
+	// run the cmd in a pty, the empty cmd means the login shell
+	// the exit status of the cmd reported by *ExitError
+	Interact(cmd string, args []string, opts *TerminalOptions) error
+}
+
+// WindowSize
+// the size of the pseudo terminal
+type WindowSize struct {
+	Rows uint16
+	Cols uint16
+}
+
+// TerminalOptions
+// the interactive session config
+type TerminalOptions struct {
+	// the user input, the caller should set its own terminal to raw mode,
+	// so the Ctrl-C can be passed to the pty
+	In io.Reader
+	// the output of pty, stdout and stderr are merged in a terminal
+	Out io.Writer
+
+	// the TERM env, default is xterm
+	Term string
+	// the initial size of the pty, default is 24x80
+	Size WindowSize
+
+	// propagate the window resize to the pty
+	Resize <-chan WindowSize
+	// forward the signals to the running cmd
+	Signals <-chan os.Signal
+}
+
+const (
+	DefaultTerm = "xterm"
+	DefaultRows = 24
+	DefaultCols = 80
+)
+
+// Complete
+// set default value for TerminalOptions
+func (o *TerminalOptions) Complete() {
+
+	if len(o.Term) == 0 {
+		o.Term = DefaultTerm
+	}
+	if o.Size.Rows == 0 {
+		o.Size.Rows = DefaultRows
+	}
+	if o.Size.Cols == 0 {
+		o.Size.Cols = DefaultCols
+	}
+}
+
+// Tee
+// capture the output in the buffer, and copy it to the w if not nil
+func Tee(buffer io.Writer, w io.Writer) io.Writer {
+
+	if w == nil {
+		return buffer
+	}
+	return io.MultiWriter(buffer, w)
+}
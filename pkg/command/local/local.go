@@ -1,10 +1,16 @@
 package local
 
 import (
+	"bytes"
+	"context"
 	"io"
 	"log"
+	"os"
 	"os/exec"
+	"syscall"
+	"time"
 
+	"github.com/pkg/errors"
 	"github.com/sxllwx/vulcanus/pkg/command"
 )
 
@@ -13,24 +19,161 @@ type TTY struct {
 	logger *log.Logger
 }
 
-type Config struct{}
+// Config
+// the default options of all the cmd run by the TTY, the ExecOptions of the call take precedence
+type Config struct {
+	// the extra env in KEY=VALUE form, the Env of the call appended after it
+	Env []string
+	// the working dir
+	Dir string
+	// run as the user and group, the name or the numeric id
+	User  string
+	Group string
+}
+
+var _ command.Terminal = &TTY{}
+var _ command.Runner = &TTY{}
 
 func NewTTY() command.Interface {
 
 	return &TTY{}
 }
 
+// NewTTYWithConfig
+// new a local host with the default options
+func NewTTYWithConfig(cfg *Config) command.Interface {
+
+	return &TTY{cfg: cfg}
+}
+
 func (l *TTY) Close() error {
 	return nil
 }
 
 func (l *TTY) Exec(cmd string, args []string, in io.Reader, out, err io.WriteCloser) error {
 
+	_, e := l.Run(context.Background(), cmd, args, &command.ExecOptions{
+		In:  in,
+		Out: out,
+		Err: err,
+	})
+	return e
+}
+
+// options
+// fill the options by the Config
+func (l *TTY) options(opts *command.ExecOptions) *command.ExecOptions {
+
+	out := command.ExecOptions{}
+	if opts != nil {
+		out = *opts
+	}
+	if l.cfg == nil {
+		return &out
+	}
+
+	out.Env = append(append([]string{}, l.cfg.Env...), out.Env...)
+	if len(out.Dir) == 0 {
+		out.Dir = l.cfg.Dir
+	}
+	if len(out.User) == 0 {
+		out.User = l.cfg.User
+		out.Group = l.cfg.Group
+	}
+	return &out
+}
+
+// exitError
+// convert the *exec.ExitError to *command.ExitError
+func exitError(err error) error {
+
+	e, ok := err.(*exec.ExitError)
+	if !ok {
+		return err
+	}
+
+	status, ok := e.Sys().(syscall.WaitStatus)
+	if ok && status.Signaled() {
+		return &command.ExitError{
+			Code:   128 + int(status.Signal()),
+			Signal: command.SignalName(status.Signal()),
+		}
+	}
+	return &command.ExitError{Code: e.ExitCode()}
+}
+
+func (l *TTY) ExecContext(ctx context.Context, cmd string, args []string, in io.Reader) (*command.Result, error) {
+	return l.ExecStream(ctx, cmd, args, in, nil, nil)
+}
+
+// ExecStream
+// the output is written to the out and err, the nil writer means the output is captured in the Result
+func (l *TTY) ExecStream(ctx context.Context, cmd string, args []string, in io.Reader, out, errOut io.Writer) (*command.Result, error) {
+
+	return l.Run(ctx, cmd, args, &command.ExecOptions{
+		In:  in,
+		Out: out,
+		Err: errOut,
+	})
+}
+
+// Run
+// run the cmd with the options, the User and Group need the privilege to setuid
+func (l *TTY) Run(ctx context.Context, cmd string, args []string, opts *command.ExecOptions) (*command.Result, error) {
+
+	opts = l.options(opts)
+
+	var (
+		stdout = &bytes.Buffer{}
+		stderr = &bytes.Buffer{}
+		start  = time.Now()
+	)
+
+	result := func(err error) (*command.Result, error) {
+		return &command.Result{
+			ExitCode: command.ExitCode(err),
+			Duration: time.Since(start),
+			Stdout:   stdout.Bytes(),
+			Stderr:   stderr.Bytes(),
+		}, err
+	}
+
+	if err := opts.Validate(); err != nil {
+		return result(err)
+	}
+
+	cmd, args = command.WrapRlimits(cmd, args, opts.Rlimits)
 	c := exec.Command(cmd, args...)
+	c.Stdin = opts.In
+	c.Stdout, c.Stderr = opts.Writers(stdout, stderr)
+	c.Dir = opts.Dir
+	if len(opts.Env) != 0 {
+		c.Env = append(os.Environ(), opts.Env...)
+	}
+	setProcessGroup(c)
+
+	if len(opts.User) != 0 {
+		if err := setCredential(c, opts.User, opts.Group); err != nil {
+			return result(errors.WithMessagef(err, "run as %s", opts.User))
+		}
+	}
+
+	if err := c.Start(); err != nil {
+		return result(errors.WithMessage(err, "start cmd"))
+	}
 
-	c.Stdin = in
-	c.Stderr = out
-	c.Stdout = err
+	waitC := make(chan error, 1)
+	go func() {
+		waitC <- c.Wait()
+	}()
 
-	return c.Run()
+	select {
+	case err := <-waitC:
+		return result(exitError(err))
+	case <-ctx.Done():
+		// kill the cmd and its children, then wait the io copy end
+		killProcessGroup(c)
+		<-waitC
+		return result(errors.WithMessage(ctx.Err(), "wait cmd"))
+	}
 }
@@ -1,8 +1,18 @@
 package local
 
 import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sxllwx/vulcanus/pkg/command"
 )
 
 func TestExecute(t *testing.T) {
@@ -14,3 +24,197 @@ func TestExecute(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestInteract(t *testing.T) {
+
+	localHost := &TTY{}
+	out := &bytes.Buffer{}
+
+	err := localHost.Interact("/bin/sh", []string{"-c", "stty size; exit 3"}, &command.TerminalOptions{
+		Out:  out,
+		Size: command.WindowSize{Rows: 30, Cols: 100},
+	})
+	if e, a := 3, command.ExitCode(err); e != a {
+		t.Fatalf("expect exit code %d, got %d (%v)", e, a, err)
+	}
+	if !strings.Contains(out.String(), "30 100") {
+		t.Fatalf("the window size not applied: %q", out.String())
+	}
+}
+
+func TestInteractInput(t *testing.T) {
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	defer w.Close()
+
+	resize := make(chan command.WindowSize)
+	close(resize)
+
+	localHost := &TTY{}
+	opts := &command.TerminalOptions{In: r, Resize: resize}
+	if err := localHost.Interact("/bin/sh", []string{"-c", "exit 0"}, opts); err != nil {
+		t.Fatal(err)
+	}
+
+	// the options of the caller are kept
+	if opts.Resize == nil || len(opts.Term) != 0 {
+		t.Fatalf("the options changed %+v", opts)
+	}
+
+	// the stdin copy stopped, the later input is read by the caller
+	go w.Write([]byte("after"))
+
+	b := make([]byte, 5)
+	r.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := io.ReadFull(r, b); err != nil || string(b) != "after" {
+		t.Fatalf("expect the input not consumed, got %q %v", b, err)
+	}
+}
+
+func TestInteractSignal(t *testing.T) {
+
+	localHost := &TTY{}
+	signals := make(chan os.Signal, 1)
+	signals <- os.Interrupt
+
+	err := localHost.Interact("/bin/sleep", []string{"10"}, &command.TerminalOptions{
+		Signals: signals,
+	})
+
+	e, ok := err.(*command.ExitError)
+	if !ok || e.Signal != "INT" {
+		t.Fatalf("expect killed by INT, got %v", err)
+	}
+}
+
+func TestInteractSignalForegroundGroup(t *testing.T) {
+
+	localHost := &TTY{}
+	signals := make(chan os.Signal, 1)
+
+	start := time.Now()
+	go func() {
+		// wait the sleep started by the shell
+		time.Sleep(200 * time.Millisecond)
+		signals <- os.Interrupt
+	}()
+
+	// the sleep hold the pty until killed with the shell
+	err := localHost.Interact("/bin/sh", []string{"-c", "sleep 10; true"}, &command.TerminalOptions{
+		Signals: signals,
+	})
+
+	e, ok := err.(*command.ExitError)
+	if !ok || e.Signal != "INT" {
+		t.Fatalf("expect killed by INT, got %v", err)
+	}
+	if cost := time.Since(start); cost > 5*time.Second {
+		t.Fatalf("the children of the shell not signaled, cost %s", cost)
+	}
+}
+
+func TestExecContext(t *testing.T) {
+
+	localHost := NewTTY()
+
+	r, err := localHost.ExecContext(context.Background(), "/bin/sh", []string{"-c", "echo out; echo err >&2; exit 2"}, nil)
+	if e, a := 2, command.ExitCode(err); e != a {
+		t.Fatalf("expect exit code %d, got %d (%v)", e, a, err)
+	}
+	if r.ExitCode != 2 || string(r.Stdout) != "out\n" || string(r.Stderr) != "err\n" {
+		t.Fatalf("unexpected result %+v", r)
+	}
+}
+
+func TestExecContextTimeout(t *testing.T) {
+
+	localHost := NewTTY()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	// the child of sh hold the stdout, it must be killed with the group
+	r, err := localHost.ExecContext(ctx, "/bin/sh", []string{"-c", "sleep 10 & sleep 10"}, nil)
+	if errors.Cause(err) != context.DeadlineExceeded {
+		t.Fatalf("expect deadline exceeded, got %v", err)
+	}
+	if r.Duration > 5*time.Second {
+		t.Fatalf("the cmd not killed in time, cost %s", r.Duration)
+	}
+}
+
+func TestExecOutput(t *testing.T) {
+
+	localHost := NewTTY()
+	out := nopWriteCloser{&bytes.Buffer{}}
+	errOut := nopWriteCloser{&bytes.Buffer{}}
+
+	if err := localHost.Exec("/bin/sh", []string{"-c", "echo out; echo err >&2"}, nil, out, errOut); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "out\n" || errOut.String() != "err\n" {
+		t.Fatalf("unexpected stdout %q stderr %q", out.String(), errOut.String())
+	}
+}
+
+func TestRunOptions(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "vulcanus-local")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	localHost := NewTTYWithConfig(&Config{Env: []string{"VULCANUS_A=a"}}).(command.Runner)
+
+	r, err := localHost.Run(context.Background(), "/bin/sh", []string{"-c", `echo $VULCANUS_A $VULCANUS_B; pwd; ulimit -n; ulimit -H -n; echo err >&2`}, &command.ExecOptions{
+		Env: []string{"VULCANUS_B=b"},
+		Dir: dir,
+		Rlimits: []command.Rlimit{
+			{Resource: command.RlimitNofile, Soft: 64, Hard: 128},
+		},
+		CombinedOutput: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the TempDir may be a symlink
+	realDir, _ := filepath.EvalSymlinks(dir)
+	if e, a := "a b\n"+realDir+"\n64\n128\nerr\n", string(r.Stdout); e != a {
+		t.Fatalf("expect %q, got %q", e, a)
+	}
+
+	if _, err := localHost.Run(context.Background(), "true", nil, &command.ExecOptions{Env: []string{"INVALID"}}); err == nil {
+		t.Fatal("expect the invalid env rejected")
+	}
+}
+
+func TestRunAsUser(t *testing.T) {
+
+	if os.Getuid() != 0 {
+		t.Skip("run as other user need root")
+	}
+
+	localHost := NewTTY().(command.Runner)
+
+	r, err := localHost.Run(context.Background(), "id", []string{"-u"}, &command.ExecOptions{
+		User: "65534",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.TrimSpace(string(r.Stdout)) != "65534" {
+		t.Fatalf("unexpected uid %q", r.Stdout)
+	}
+}
+
+type nopWriteCloser struct {
+	*bytes.Buffer
+}
+
+func (nopWriteCloser) Close() error { return nil }
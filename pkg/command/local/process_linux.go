@@ -0,0 +1,98 @@
+package local
+
+import (
+	"os/exec"
+	"os/user"
+	"strconv"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// setProcessGroup
+// the cmd run in its own process group, so all its children can be killed together
+func setProcessGroup(c *exec.Cmd) {
+	if c.SysProcAttr == nil {
+		c.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	c.SysProcAttr.Setpgid = true
+}
+
+// killProcessGroup
+// kill the whole process group of the cmd
+func killProcessGroup(c *exec.Cmd) error {
+	return syscall.Kill(-c.Process.Pid, syscall.SIGKILL)
+}
+
+// setCredential
+// run the cmd as the user and group, the supplementary groups of the user are kept
+func setCredential(c *exec.Cmd, userName string, groupName string) error {
+
+	u, err := lookupUser(userName)
+	if err != nil {
+		return err
+	}
+
+	uid, err := strconv.ParseUint(u.Uid, 10, 32)
+	if err != nil {
+		return errors.WithMessagef(err, "parse uid %s", u.Uid)
+	}
+
+	gidStr := u.Gid
+	if len(groupName) != 0 {
+		g, err := lookupGroup(groupName)
+		if err != nil {
+			return err
+		}
+		gidStr = g.Gid
+	}
+	gid, err := strconv.ParseUint(gidStr, 10, 32)
+	if err != nil {
+		return errors.WithMessagef(err, "parse gid %s", gidStr)
+	}
+
+	cred := &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)}
+	if ids, err := u.GroupIds(); err == nil {
+		for _, id := range ids {
+			if g, err := strconv.ParseUint(id, 10, 32); err == nil {
+				cred.Groups = append(cred.Groups, uint32(g))
+			}
+		}
+	}
+
+	if c.SysProcAttr == nil {
+		c.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	c.SysProcAttr.Credential = cred
+	return nil
+}
+
+// lookupUser
+// the user by name or numeric id
+func lookupUser(name string) (*user.User, error) {
+
+	if u, err := user.Lookup(name); err == nil {
+		return u, nil
+	}
+	if _, err := strconv.ParseUint(name, 10, 32); err != nil {
+		return nil, errors.Errorf("unknown user %s", name)
+	}
+	if u, err := user.LookupId(name); err == nil {
+		return u, nil
+	}
+	// the uid not in the passwd, use it directly
+	return &user.User{Uid: name, Gid: name}, nil
+}
+
+// lookupGroup
+// the group by name or numeric id
+func lookupGroup(name string) (*user.Group, error) {
+
+	if g, err := user.LookupGroup(name); err == nil {
+		return g, nil
+	}
+	if _, err := strconv.ParseUint(name, 10, 32); err != nil {
+		return nil, errors.Errorf("unknown group %s", name)
+	}
+	return &user.Group{Gid: name}, nil
+}
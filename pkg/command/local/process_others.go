@@ -0,0 +1,26 @@
+//go:build !linux
+// +build !linux
+
+package local
+
+import (
+	"os/exec"
+
+	"github.com/pkg/errors"
+)
+
+// setProcessGroup
+// the process group only supported on linux now
+func setProcessGroup(c *exec.Cmd) {}
+
+// killProcessGroup
+// only the cmd itself be killed
+func killProcessGroup(c *exec.Cmd) error {
+	return c.Process.Kill()
+}
+
+// setCredential
+// run as other user only supported on linux now
+func setCredential(c *exec.Cmd, userName string, groupName string) error {
+	return errors.New("run as other user not supported on this platform")
+}
@@ -0,0 +1,78 @@
+package local
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+
+	"github.com/pkg/errors"
+	"github.com/sxllwx/vulcanus/pkg/command"
+)
+
+// openPTY
+// open the master and slave of a new pseudo terminal
+func openPTY() (*os.File, *os.File, error) {
+
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, nil, errors.WithMessage(err, "open /dev/ptmx")
+	}
+
+	// unlock the slave
+	var unlock int32
+	if err := ioctl(master, syscall.TIOCSPTLCK, uintptr(unsafe.Pointer(&unlock))); err != nil {
+		master.Close()
+		return nil, nil, errors.WithMessage(err, "unlock pty")
+	}
+
+	var n uint32
+	if err := ioctl(master, syscall.TIOCGPTN, uintptr(unsafe.Pointer(&n))); err != nil {
+		master.Close()
+		return nil, nil, errors.WithMessage(err, "get pty number")
+	}
+
+	name := fmt.Sprintf("/dev/pts/%d", n)
+	slave, err := os.OpenFile(name, os.O_RDWR|syscall.O_NOCTTY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		master.Close()
+		return nil, nil, errors.WithMessagef(err, "open %s", name)
+	}
+	return master, slave, nil
+}
+
+// setWindowSize
+// resize the pty, the foreground process will receive SIGWINCH
+func setWindowSize(f *os.File, size command.WindowSize) error {
+
+	ws := struct {
+		Row    uint16
+		Col    uint16
+		Xpixel uint16
+		Ypixel uint16
+	}{
+		Row: size.Rows,
+		Col: size.Cols,
+	}
+	return ioctl(f, syscall.TIOCSWINSZ, uintptr(unsafe.Pointer(&ws)))
+}
+
+// foregroundGroup
+// the foreground process group of the pty, the signals typed in the terminal are sent to it
+func foregroundGroup(f *os.File) (int, error) {
+
+	var pgrp int32
+	if err := ioctl(f, syscall.TIOCGPGRP, uintptr(unsafe.Pointer(&pgrp))); err != nil {
+		return 0, err
+	}
+	return int(pgrp), nil
+}
+
+func ioctl(f *os.File, req uint, arg uintptr) error {
+
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), uintptr(req), arg)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+package local
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"syscall"
+
+	"github.com/pkg/errors"
+	"github.com/sxllwx/vulcanus/pkg/command"
+)
+
+// Interact
+// run the cmd in a new pseudo terminal
+func (l *TTY) Interact(cmd string, args []string, opts *command.TerminalOptions) error {
+
+	// the options of the caller are not changed
+	o := command.TerminalOptions{}
+	if opts != nil {
+		o = *opts
+	}
+	opts = &o
+	opts.Complete()
+
+	if len(cmd) == 0 {
+		cmd = os.Getenv("SHELL")
+		if len(cmd) == 0 {
+			cmd = "/bin/sh"
+		}
+	}
+
+	master, slave, err := openPTY()
+	if err != nil {
+		return errors.WithMessage(err, "open pty")
+	}
+	defer master.Close()
+
+	if err := setWindowSize(master, opts.Size); err != nil {
+		slave.Close()
+		return errors.WithMessage(err, "set window size")
+	}
+
+	c := exec.Command(cmd, args...)
+	c.Env = append(os.Environ(), "TERM="+opts.Term)
+	c.Stdin = slave
+	c.Stdout = slave
+	c.Stderr = slave
+	// the cmd is the session leader, and the pty is its controlling terminal
+	c.SysProcAttr = &syscall.SysProcAttr{
+		Setsid:  true,
+		Setctty: true,
+	}
+
+	err = c.Start()
+	// the child hold the slave now
+	slave.Close()
+	if err != nil {
+		return errors.WithMessage(err, "start cmd")
+	}
+
+	done := make(chan struct{})
+	exited := make(chan struct{})
+	// the master is used by the goroutine, it is closed after the goroutine exited
+	defer func() {
+		close(done)
+		<-exited
+	}()
+
+	go func() {
+		defer close(exited)
+
+		for {
+			select {
+			case <-done:
+				return
+			case size, ok := <-opts.Resize:
+				if !ok {
+					opts.Resize = nil
+					continue
+				}
+				setWindowSize(master, size)
+			case sig, ok := <-opts.Signals:
+				if !ok {
+					opts.Signals = nil
+					continue
+				}
+				// same as typed in the terminal, the children of the shell receive the signal too
+				if s, ok := sig.(syscall.Signal); ok {
+					if pgrp, err := foregroundGroup(master); err == nil && pgrp > 0 {
+						syscall.Kill(-pgrp, s)
+						continue
+					}
+				}
+				c.Process.Signal(sig)
+			}
+		}
+	}()
+
+	if opts.In != nil {
+		stop := command.CopyInput(master, opts.In)
+		defer stop()
+	}
+
+	out := opts.Out
+	if out == nil {
+		out = ioutil.Discard
+	}
+	outDone := make(chan struct{})
+	go func() {
+		// got EIO after all the slave closed
+		io.Copy(out, master)
+		close(outDone)
+	}()
+
+	err = c.Wait()
+	<-outDone
+	return exitError(err)
+}
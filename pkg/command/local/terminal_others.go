@@ -0,0 +1,15 @@
+//go:build !linux
+// +build !linux
+
+package local
+
+import (
+	"github.com/pkg/errors"
+	"github.com/sxllwx/vulcanus/pkg/command"
+)
+
+// Interact
+// the pty only supported on linux now
+func (l *TTY) Interact(cmd string, args []string, opts *command.TerminalOptions) error {
+	return errors.New("pty not supported on this platform")
+}
@@ -0,0 +1,19 @@
+package local
+
+import (
+	"github.com/sxllwx/vulcanus/pkg/command"
+)
+
+var _ command.FileTransfer = &TTY{}
+
+// Upload
+// the host is local, copy the file in the file system
+func (l *TTY) Upload(local string, remote string, opts *command.TransferOptions) error {
+	return command.Transfer(command.LocalFS{}, local, command.LocalFS{}, remote, opts)
+}
+
+// Download
+// the host is local, copy the file in the file system
+func (l *TTY) Download(remote string, local string, opts *command.TransferOptions) error {
+	return command.Transfer(command.LocalFS{}, remote, command.LocalFS{}, local, opts)
+}
@@ -0,0 +1,175 @@
+package command
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// Runner
+// run the cmd with the per-call options
+type Runner interface {
+	// Run
+	// like ExecContext, the output is written to the opts.Out and opts.Err,
+	// the nil writer means the output is captured in the Result
+	Run(ctx context.Context, cmd string, args []string, opts *ExecOptions) (*Result, error)
+}
+
+// ExecOptions
+// the per-call options of the cmd, shared by the local and remote host
+type ExecOptions struct {
+	In  io.Reader
+	Out io.Writer
+	Err io.Writer
+
+	// the extra env in KEY=VALUE form, appended to the inherited env
+	Env []string
+	// the working dir, default is the current dir of local or the home of remote user
+	Dir string
+
+	// run as the user and group, the name or the numeric id,
+	// the empty Group means the primary group of the User
+	User  string
+	Group string
+
+	// the resource limits of the cmd, set by the `ulimit` of /bin/sh
+	Rlimits []Rlimit
+
+	// the stderr is merged to stdout, like `2>&1`,
+	// the output are written to Out, or captured in Result.Stdout if Out is nil
+	CombinedOutput bool
+}
+
+// the resources of Rlimit, the flags of `ulimit`
+const (
+	RlimitCore   = "c"
+	RlimitData   = "d"
+	RlimitFsize  = "f"
+	RlimitNofile = "n"
+	RlimitStack  = "s"
+	RlimitCPU    = "t"
+	RlimitAS     = "v"
+	RlimitNproc  = "u"
+)
+
+// RlimitInfinity
+// no limit
+const RlimitInfinity = ^uint64(0)
+
+// Rlimit
+// the limit of a resource, the Soft must not exceed the Hard
+type Rlimit struct {
+	// one of the Rlimit* resource
+	Resource string
+	Soft     uint64
+	Hard     uint64
+}
+
+func rlimitValue(v uint64) string {
+
+	if v == RlimitInfinity {
+		return "unlimited"
+	}
+	return fmt.Sprint(v)
+}
+
+// Validate
+// check the options before run the cmd
+func (o *ExecOptions) Validate() error {
+
+	for _, kv := range o.Env {
+		if strings.IndexByte(kv, '=') <= 0 {
+			return errors.Errorf("invalid env %q, should be KEY=VALUE", kv)
+		}
+	}
+
+	for _, l := range o.Rlimits {
+		if len(l.Resource) != 1 || !strings.Contains("cdfnstvu", l.Resource) {
+			return errors.Errorf("unknown rlimit resource %q", l.Resource)
+		}
+		if l.Soft > l.Hard {
+			return errors.Errorf("rlimit %s soft %s exceed hard %s", l.Resource, rlimitValue(l.Soft), rlimitValue(l.Hard))
+		}
+	}
+
+	if len(o.Group) != 0 && len(o.User) == 0 {
+		return errors.New("the group should be used with the user")
+	}
+	return nil
+}
+
+// Writers
+// the stdout and stderr of the cmd, the output is written to the Out and Err,
+// and captured in the buffers only if the Out or Err is nil, so the streamed output is not kept in memory,
+// both are the same writer if CombinedOutput
+func (o *ExecOptions) Writers(stdout, stderr *bytes.Buffer) (io.Writer, io.Writer) {
+
+	out, errOut := io.Writer(stdout), io.Writer(stderr)
+	if o.Out != nil {
+		out = o.Out
+	}
+	if o.Err != nil {
+		errOut = o.Err
+	}
+
+	if o.CombinedOutput {
+		// the stdout and stderr may be written concurrently
+		w := &lockedWriter{w: out}
+		return w, w
+	}
+	return out, errOut
+}
+
+type lockedWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (l *lockedWriter) Write(b []byte) (int, error) {
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.w.Write(b)
+}
+
+// WrapRlimits
+// run the cmd by /bin/sh which set the rlimits before exec the cmd
+// eg: sh -c 'ulimit -n 4096 && ulimit -S -n 1024 && exec "$0" "$@"' cmd args...
+func WrapRlimits(cmd string, args []string, rlimits []Rlimit) (string, []string) {
+
+	if len(rlimits) == 0 {
+		return cmd, args
+	}
+
+	var script []string
+	for _, l := range rlimits {
+		// set both to hard first, so the soft can be lowered later
+		script = append(script, fmt.Sprintf("ulimit -%s %s", l.Resource, rlimitValue(l.Hard)))
+		if l.Soft != l.Hard {
+			script = append(script, fmt.Sprintf("ulimit -S -%s %s", l.Resource, rlimitValue(l.Soft)))
+		}
+	}
+	script = append(script, `exec "$0" "$@"`)
+
+	return "/bin/sh", append([]string{"-c", strings.Join(script, " && "), cmd}, args...)
+}
+
+// WrapEnv
+// run the cmd by `env KEY=VALUE... cmd args...`
+func WrapEnv(cmd string, args []string, env []string) (string, []string) {
+
+	if len(env) == 0 {
+		return cmd, args
+	}
+
+	out := make([]string, 0, len(env)+len(args)+1)
+	out = append(out, env...)
+	out = append(out, cmd)
+	return "env", append(out, args...)
+}
@@ -0,0 +1,53 @@
+package command
+
+import (
+	"strings"
+)
+
+// the chars need not be quoted in the posix shell
+const safeChars = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789@%_-+=:,./"
+
+// Quote
+// quote the arg for the posix shell, the shell will get exactly the same arg
+// eg: $HOME -> '$HOME', the single quote is escaped out of the quotes
+func Quote(arg string) string {
+
+	if len(arg) == 0 {
+		return "''"
+	}
+
+	safe := true
+	for _, r := range arg {
+		if !strings.ContainsRune(safeChars, r) {
+			safe = false
+			break
+		}
+	}
+	if safe {
+		return arg
+	}
+
+	// the single quote can't appear in single quotes, end the quote and escape it
+	return "'" + strings.Replace(arg, "'", `'\''`, -1) + "'"
+}
+
+// Join
+// join the cmd and args to a command line for the posix shell,
+// every arg is quoted, so the argv is same as exec.Command(cmd, args...)
+func Join(cmd string, args []string) string {
+
+	out := make([]string, 0, len(args)+1)
+	out = append(out, Quote(cmd))
+	for _, a := range args {
+		out = append(out, Quote(a))
+	}
+	return strings.Join(out, " ")
+}
+
+// JoinExec
+// like Join, but the cmd run by `exec env --`,
+// the shell aliases, functions and builtins are bypassed,
+// and the shell process is replaced by the cmd
+func JoinExec(cmd string, args []string) string {
+	return "exec env -- " + Join(cmd, args)
+}
@@ -0,0 +1,57 @@
+package command
+
+import (
+	"os/exec"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestQuote(t *testing.T) {
+
+	table := []struct {
+		in  string
+		out string
+	}{
+		{"", "''"},
+		{"abc", "abc"},
+		{"192.168.240.101:3000-4000", "192.168.240.101:3000-4000"},
+		{"generated by vulcanus", "'generated by vulcanus'"},
+		{"it's", `'it'\''s'`},
+		{"$HOME", "'$HOME'"},
+	}
+
+	for _, item := range table {
+		if a := Quote(item.in); a != item.out {
+			t.Fatalf("quote %q: expect %s, got %s", item.in, item.out, a)
+		}
+	}
+}
+
+func TestJoin(t *testing.T) {
+
+	args := []string{
+		"",
+		"generated by vulcanus",
+		`"quoted"`,
+		"it's",
+		"$HOME `id` $(id)",
+		"a; rm -rf /tmp/nothing",
+		"back\\slash",
+		"new\nline",
+		"*",
+	}
+
+	for _, join := range []func(string, []string) string{Join, JoinExec} {
+
+		out, err := exec.Command("/bin/sh", "-c", join("printf", append([]string{"%s\\0"}, args...))).Output()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got := strings.Split(strings.TrimSuffix(string(out), "\x00"), "\x00")
+		if !reflect.DeepEqual(got, args) {
+			t.Fatalf("expect %q, got %q", args, got)
+		}
+	}
+}
@@ -0,0 +1,323 @@
+package remote
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// the env hold the ssh-agent unix socket
+const authSockEnv = "SSH_AUTH_SOCK"
+
+// DefaultKnownHostsFile
+// ~/.ssh/known_hosts
+func DefaultKnownHostsFile() string {
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".ssh", "known_hosts")
+}
+
+// clientConfig
+// build the ssh client config, the returned closer release the ssh-agent connection
+func (cfg *Config) clientConfig() (*ssh.ClientConfig, io.Closer, error) {
+
+	hostKeyCallback, hostKeyAlgorithms, err := cfg.hostKeyCallback()
+	if err != nil {
+		return nil, nil, errors.WithMessage(err, "host key callback")
+	}
+
+	auth, closer, err := cfg.authMethods()
+	if err != nil {
+		return nil, nil, errors.WithMessage(err, "auth methods")
+	}
+
+	return &ssh.ClientConfig{
+		User:              cfg.User,
+		Auth:              auth,
+		HostKeyCallback:   hostKeyCallback,
+		HostKeyAlgorithms: hostKeyAlgorithms,
+		Timeout:           cfg.timeout(),
+	}, closer, nil
+}
+
+// timeout
+// the Timeout or the default
+func (cfg *Config) timeout() time.Duration {
+
+	if cfg.Timeout <= 0 {
+		return defaultTimeout
+	}
+	return cfg.Timeout
+}
+
+// authMethods
+// the auth methods tried in order: agent, public key, password, keyboard-interactive
+func (cfg *Config) authMethods() ([]ssh.AuthMethod, io.Closer, error) {
+
+	var (
+		out    []ssh.AuthMethod
+		closer io.Closer = ioutil.NopCloser(nil)
+	)
+
+	if cfg.UseAgent {
+		sock := os.Getenv(authSockEnv)
+		if len(sock) == 0 {
+			return nil, nil, errors.Errorf("env %s not set", authSockEnv)
+		}
+
+		conn, err := net.Dial("unix", sock)
+		if err != nil {
+			return nil, nil, errors.WithMessagef(err, "dial ssh-agent %s", sock)
+		}
+		closer = conn
+		out = append(out, ssh.PublicKeysCallback(agent.NewClient(conn).Signers))
+	}
+
+	if len(cfg.PrivateKeyFile) != 0 {
+		signer, err := cfg.signer()
+		if err != nil {
+			closer.Close()
+			return nil, nil, err
+		}
+		// Use the PublicKeys method for remote authentication.
+		out = append(out, ssh.PublicKeys(signer))
+	}
+
+	if len(cfg.Password) != 0 {
+		out = append(out, ssh.Password(cfg.Password))
+	}
+
+	if cfg.KeyboardInteractive != nil {
+		out = append(out, ssh.KeyboardInteractive(cfg.KeyboardInteractive))
+	} else if len(cfg.Password) != 0 {
+		// most sshd ask the password by keyboard-interactive
+		out = append(out, ssh.KeyboardInteractive(passwordChallenge(cfg.Password)))
+	}
+
+	if len(out) == 0 {
+		closer.Close()
+		return nil, nil, errors.New("no auth method, please spec private key, password or ssh-agent")
+	}
+	return out, closer, nil
+}
+
+// passwordChallenge
+// answer all the questions with the password
+func passwordChallenge(password string) ssh.KeyboardInteractiveChallenge {
+
+	return func(user, instruction string, questions []string, echos []bool) ([]string, error) {
+		answers := make([]string, len(questions))
+		for i := range answers {
+			answers[i] = password
+		}
+		return answers, nil
+	}
+}
+
+// signer
+// parse the private key, and attach the certificate if spec
+func (cfg *Config) signer() (ssh.Signer, error) {
+
+	key, err := ioutil.ReadFile(cfg.PrivateKeyFile)
+	if err != nil {
+		return nil, errors.WithMessagef(err, "read private key file %s", cfg.PrivateKeyFile)
+	}
+
+	// Create the Signer for this private key.
+	var signer ssh.Signer
+	if len(cfg.Passphrase) != 0 {
+		signer, err = ssh.ParsePrivateKeyWithPassphrase(key, []byte(cfg.Passphrase))
+	} else {
+		signer, err = ssh.ParsePrivateKey(key)
+	}
+	if err != nil {
+		return nil, errors.WithMessagef(err, "parse the private key")
+	}
+
+	if len(cfg.CertificateFile) == 0 {
+		return signer, nil
+	}
+
+	body, err := ioutil.ReadFile(cfg.CertificateFile)
+	if err != nil {
+		return nil, errors.WithMessagef(err, "read certificate file %s", cfg.CertificateFile)
+	}
+
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(body)
+	if err != nil {
+		return nil, errors.WithMessage(err, "parse the certificate")
+	}
+
+	cert, ok := pub.(*ssh.Certificate)
+	if !ok {
+		return nil, errors.Errorf("%s is not a certificate", cfg.CertificateFile)
+	}
+
+	signer, err = ssh.NewCertSigner(cert, signer)
+	if err != nil {
+		return nil, errors.WithMessage(err, "new cert signer")
+	}
+	return signer, nil
+}
+
+// hostKeyCallback
+// verify the host key by the known_hosts file
+func (cfg *Config) hostKeyCallback() (ssh.HostKeyCallback, []string, error) {
+
+	if cfg.HostKeyCallback != nil {
+		return cfg.HostKeyCallback, nil, nil
+	}
+
+	if cfg.InsecureIgnoreHostKey {
+		return ssh.InsecureIgnoreHostKey(), nil, nil
+	}
+
+	file := cfg.KnownHostsFile
+	if len(file) == 0 {
+		file = DefaultKnownHostsFile()
+	}
+
+	if cfg.TrustOnFirstUse {
+		// the known_hosts file will be created on first use
+		if err := touch(file); err != nil {
+			return nil, nil, errors.WithMessagef(err, "create known hosts file %s", file)
+		}
+	}
+
+	callback, err := knownhosts.New(file)
+	if err != nil {
+		return nil, nil, errors.WithMessagef(err, "read known hosts file %s", file)
+	}
+	algorithms := knownHostKeyAlgorithms(callback, address(cfg.Remote))
+
+	if !cfg.TrustOnFirstUse {
+		return callback, algorithms, nil
+	}
+	return trustOnFirstUse(file, callback), algorithms, nil
+}
+
+// the key never recorded in the known_hosts, see knownHostKeyAlgorithms
+var probeHostKey, _ = ssh.NewPublicKey(ed25519.PublicKey(make([]byte, ed25519.PublicKeySize)))
+
+// knownHostKeyAlgorithms
+// the types of the keys recorded for the host, nil if the host is unknown,
+// the server is asked for the known key, otherwise the key of the other type may be negotiated and rejected as changed,
+// the keys are found by the KeyError of the probe key, which lists the known keys of the host
+func knownHostKeyAlgorithms(callback ssh.HostKeyCallback, addr string) []string {
+
+	err := callback(addr, &net.TCPAddr{IP: net.IPv4zero}, probeHostKey)
+	keyErr, ok := err.(*knownhosts.KeyError)
+	if !ok {
+		return nil
+	}
+
+	var out []string
+	for _, k := range keyErr.Want {
+		out = append(out, k.Key.Type())
+	}
+	sort.Strings(out)
+	return out
+}
+
+// the known_hosts file may be shared by many clients
+var knownHostsLock sync.Mutex
+
+// trustOnFirstUse
+// the unknown host key will be added to the known_hosts file,
+// but the changed host key is still rejected,
+// the callback is rebuilt from the file after the key added, so the key is added only once
+func trustOnFirstUse(file string, callback ssh.HostKeyCallback) ssh.HostKeyCallback {
+
+	var mu sync.Mutex
+
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+
+		mu.Lock()
+		known := callback
+		mu.Unlock()
+
+		err := known(hostname, remote, key)
+		if err == nil {
+			return nil
+		}
+
+		keyErr, ok := err.(*knownhosts.KeyError)
+		if !ok || len(keyErr.Want) != 0 {
+			// the host key mismatch, maybe man-in-the-middle attack
+			return err
+		}
+
+		knownHostsLock.Lock()
+		defer knownHostsLock.Unlock()
+
+		// the key may be added by the other clients since the callback built
+		known, err = knownhosts.New(file)
+		if err != nil {
+			return errors.WithMessagef(err, "read known hosts file %s", file)
+		}
+
+		err = known(hostname, remote, key)
+		if keyErr, ok := err.(*knownhosts.KeyError); ok && len(keyErr.Want) == 0 {
+			if err := appendKnownHost(file, hostname, remote, key); err != nil {
+				return err
+			}
+			if known, err = knownhosts.New(file); err != nil {
+				return errors.WithMessagef(err, "read known hosts file %s", file)
+			}
+			err = nil
+		}
+
+		mu.Lock()
+		callback = known
+		mu.Unlock()
+		return err
+	}
+}
+
+// appendKnownHost
+// add the host key to the known_hosts file, the knownHostsLock should be held
+func appendKnownHost(file string, hostname string, remote net.Addr, key ssh.PublicKey) error {
+
+	f, err := os.OpenFile(file, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return errors.WithMessagef(err, "open known hosts file %s", file)
+	}
+	defer f.Close()
+
+	addresses := []string{knownhosts.Normalize(hostname)}
+	if remote != nil && knownhosts.Normalize(remote.String()) != addresses[0] {
+		addresses = append(addresses, knownhosts.Normalize(remote.String()))
+	}
+
+	if _, err := f.WriteString(knownhosts.Line(addresses, key) + "\n"); err != nil {
+		return errors.WithMessagef(err, "write known hosts file %s", file)
+	}
+	return nil
+}
+
+func touch(file string) error {
+
+	if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(file, os.O_CREATE|os.O_RDONLY, 0600)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
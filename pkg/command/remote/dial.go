@@ -0,0 +1,136 @@
+package remote
+
+import (
+	"io"
+	"net"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+)
+
+const defaultPort = "22"
+
+// the default timeout of the tcp connect and the ssh handshake
+const defaultTimeout = 30 * time.Second
+
+// connection
+// the ssh client of the target host, and the resources of the hops before it
+type connection struct {
+	*ssh.Client
+	// the jump host clients and the ssh-agent connections, closed in reverse order
+	closers []io.Closer
+}
+
+func (c *connection) Close() error {
+
+	err := c.Client.Close()
+	for i := len(c.closers) - 1; i >= 0; i-- {
+		c.closers[i].Close()
+	}
+	return err
+}
+
+// dial
+// connect to the target through the ProxyJump hops
+func dial(cfg *Config) (*connection, error) {
+
+	out := &connection{}
+
+	hops := append(append([]*Config{}, cfg.ProxyJump...), cfg)
+
+	var prev *ssh.Client
+	for i, hop := range hops {
+
+		clientConfig, agent, err := hop.clientConfig()
+		if err != nil {
+			out.closeAll()
+			return nil, errors.WithMessagef(err, "client config of hop %d (%s)", i, hop.Remote)
+		}
+		out.closers = append(out.closers, agent)
+
+		addr := address(hop.Remote)
+
+		var clt *ssh.Client
+		if prev == nil {
+			clt, err = dialDirect(addr, clientConfig)
+		} else {
+			clt, err = dialThrough(prev, addr, clientConfig)
+		}
+		if err != nil {
+			out.closeAll()
+			return nil, errors.WithMessagef(err, "dial hop %d (%s)", i, addr)
+		}
+
+		if i < len(hops)-1 {
+			// the jump host is closed after the target, or by closeAll if the next hop failed
+			out.closers = append(out.closers, clt)
+		}
+		prev = clt
+	}
+
+	out.Client = prev
+	return out, nil
+}
+
+// dialDirect
+// connect to the addr, and start the ssh handshake
+func dialDirect(addr string, clientConfig *ssh.ClientConfig) (*ssh.Client, error) {
+
+	conn, err := net.DialTimeout("tcp", addr, clientConfig.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	return handshake(conn, addr, clientConfig)
+}
+
+// dialThrough
+// open a direct-tcpip channel on the jump host, and start the ssh handshake in it
+func dialThrough(jump *ssh.Client, addr string, clientConfig *ssh.ClientConfig) (*ssh.Client, error) {
+
+	conn, err := jump.Dial("tcp", addr)
+	if err != nil {
+		return nil, errors.WithMessage(err, "dial through jump host")
+	}
+	return handshake(conn, addr, clientConfig)
+}
+
+// handshake
+// start the ssh handshake on the conn, the conn is closed if the handshake not done in the timeout,
+// the channel of the jump host not support deadline, so close it by a timer
+func handshake(conn net.Conn, addr string, clientConfig *ssh.ClientConfig) (*ssh.Client, error) {
+
+	timer := time.AfterFunc(clientConfig.Timeout, func() {
+		conn.Close()
+	})
+
+	cc, chans, reqs, err := ssh.NewClientConn(conn, addr, clientConfig)
+	if err != nil {
+		timer.Stop()
+		conn.Close()
+		return nil, errors.WithMessage(err, "handshake")
+	}
+
+	if !timer.Stop() {
+		// the conn closed by the timer right after the handshake
+		cc.Close()
+		return nil, errors.Errorf("handshake timeout after %s", clientConfig.Timeout)
+	}
+	return ssh.NewClient(cc, chans, reqs), nil
+}
+
+func (c *connection) closeAll() {
+	for i := len(c.closers) - 1; i >= 0; i-- {
+		c.closers[i].Close()
+	}
+}
+
+// address
+// add the default ssh port if the remote without port
+func address(remote string) string {
+
+	if _, _, err := net.SplitHostPort(remote); err == nil {
+		return remote
+	}
+	return net.JoinHostPort(remote, defaultPort)
+}
@@ -0,0 +1,152 @@
+package remote
+
+import (
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestProxyJump(t *testing.T) {
+
+	dir := newTempDir(t)
+	defer os.RemoveAll(dir)
+
+	// the bastion accept the public key, the target accept the password
+	keyFile, signer := writeTestKey(t, dir, "")
+	bastion := publicKeyServer(t, signer.PublicKey())
+	defer bastion.Close()
+
+	target := newTestServer(t, &ssh.ServerConfig{
+		PasswordCallback: func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if string(password) == testPassword {
+				return nil, nil
+			}
+			return nil, ssh.ErrNoAuth
+		},
+	})
+	defer target.Close()
+
+	execEcho(t, &Config{
+		Remote:                target.Addr(),
+		User:                  testUser,
+		Password:              testPassword,
+		InsecureIgnoreHostKey: true,
+		ProxyJump: []*Config{
+			{
+				Remote:                bastion.Addr(),
+				User:                  testUser,
+				PrivateKeyFile:        keyFile,
+				InsecureIgnoreHostKey: true,
+			},
+			// the bastion jump to itself, make the chain longer
+			{
+				Remote:                bastion.Addr(),
+				User:                  testUser,
+				PrivateKeyFile:        keyFile,
+				InsecureIgnoreHostKey: true,
+			},
+		},
+	})
+
+	if n := atomic.LoadInt32(&bastion.forwarded); n != 2 {
+		t.Fatalf("expect 2 forwarded channels through the bastion, got %d", n)
+	}
+}
+
+func TestProxyJumpFailed(t *testing.T) {
+
+	dir := newTempDir(t)
+	defer os.RemoveAll(dir)
+
+	keyFile, signer := writeTestKey(t, dir, "")
+	bastion := publicKeyServer(t, signer.PublicKey())
+	defer bastion.Close()
+
+	// the target reject the key
+	target := publicKeyServer(t, newTestSigner(t).PublicKey())
+	defer target.Close()
+
+	_, err := dial(&Config{
+		Remote:                target.Addr(),
+		User:                  testUser,
+		PrivateKeyFile:        keyFile,
+		InsecureIgnoreHostKey: true,
+		ProxyJump: []*Config{
+			{
+				Remote:                bastion.Addr(),
+				User:                  testUser,
+				PrivateKeyFile:        keyFile,
+				InsecureIgnoreHostKey: true,
+			},
+		},
+	})
+	if err == nil {
+		t.Fatal("expect the target rejected")
+	}
+
+	// the bastion client is closed
+	deadline := time.Now().Add(time.Second)
+	for atomic.LoadInt32(&bastion.active) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("the bastion connection leaked")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+const testSSHConfig = `
+User nobody
+
+Host bastion
+    HostName 10.0.0.1
+    Port 2222
+    IdentityFile ~/.ssh/bastion
+
+Host *.internal !skip.internal
+    ProxyJump admin@bastion,bastion:22
+
+Host web.internal
+    HostName=192.168.1.10
+    User root
+    Port 22
+`
+
+func TestSSHConfig(t *testing.T) {
+
+	sc, err := ParseSSHConfig(strings.NewReader(testSSHConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := sc.Config("web.internal")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the first obtained value wins
+	if cfg.Remote != "192.168.1.10:22" || cfg.User != "nobody" {
+		t.Fatalf("unexpected target %s@%s", cfg.User, cfg.Remote)
+	}
+
+	if len(cfg.ProxyJump) != 2 {
+		t.Fatalf("expect 2 hops, got %d", len(cfg.ProxyJump))
+	}
+	if h := cfg.ProxyJump[0]; h.Remote != "10.0.0.1:2222" || h.User != "admin" || !strings.HasSuffix(h.PrivateKeyFile, "/.ssh/bastion") {
+		t.Fatalf("unexpected hop %+v", h)
+	}
+	if h := cfg.ProxyJump[1]; h.Remote != "10.0.0.1:22" || h.User != "nobody" {
+		t.Fatalf("unexpected hop %+v", h)
+	}
+
+	skip, err := sc.Config("skip.internal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(skip.ProxyJump) != 0 || skip.Remote != "skip.internal:22" {
+		t.Fatalf("the negated pattern not work %+v", skip)
+	}
+}
@@ -0,0 +1,503 @@
+package remote
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sxllwx/vulcanus/pkg/command"
+	"golang.org/x/crypto/ssh"
+)
+
+// the global request sent by openssh client as keepalive
+const keepAliveRequest = "keepalive@openssh.com"
+
+var ErrPoolClosed = errors.New("ssh pool already closed")
+
+// PoolConfig
+// the connection management of the ssh client
+type PoolConfig struct {
+	// send the keepalive request every interval, negative means disabled
+	KeepAliveInterval time.Duration
+	// the connection be treated as dead if the keepalive not replied in time
+	KeepAliveTimeout time.Duration
+
+	// the max concurrent sessions per connection, same as the sshd MaxSessions
+	MaxSessions int
+
+	// the backoff of reconnection, doubled every retry until MaxBackoff
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	// the max reconnect retries for a session
+	MaxRetries int
+}
+
+// Complete
+// set default value for PoolConfig
+func (c *PoolConfig) Complete() {
+
+	if c.KeepAliveInterval == 0 {
+		c.KeepAliveInterval = 30 * time.Second
+	}
+	if c.KeepAliveTimeout == 0 {
+		c.KeepAliveTimeout = c.KeepAliveInterval
+	}
+	if c.MaxSessions == 0 {
+		// the default MaxSessions of sshd
+		c.MaxSessions = 10
+	}
+	if c.InitialBackoff == 0 {
+		c.InitialBackoff = 500 * time.Millisecond
+	}
+	if c.MaxBackoff == 0 {
+		c.MaxBackoff = 30 * time.Second
+	}
+	if c.MaxRetries == 0 {
+		c.MaxRetries = 5
+	}
+}
+
+// Stats
+// the state of a pooled host connection
+type Stats struct {
+	Host           string
+	Connected      bool
+	ActiveSessions int
+	MaxSessions    int
+
+	// the number of reconnection after the first connect
+	Reconnects        uint64
+	KeepAliveFailures uint64
+}
+
+// hostConn
+// the connection to a host, reconnect on demand, and limit the concurrent sessions
+type hostConn struct {
+	cfg     *Config
+	poolCfg PoolConfig
+
+	mu     sync.Mutex
+	conn   *connection
+	closed bool
+	// ever connected, the later connects are reconnection
+	connected bool
+	// closed after the in-flight dial done
+	dialing chan struct{}
+
+	// the session semaphore
+	sessions chan struct{}
+
+	reconnects        uint64
+	keepAliveFailures uint64
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+func newHostConn(cfg *Config, poolCfg PoolConfig) *hostConn {
+
+	poolCfg.Complete()
+
+	h := &hostConn{
+		cfg:      cfg,
+		poolCfg:  poolCfg,
+		sessions: make(chan struct{}, poolCfg.MaxSessions),
+		stop:     make(chan struct{}),
+	}
+
+	if poolCfg.KeepAliveInterval > 0 {
+		h.wg.Add(1)
+		go h.keepAlive()
+	}
+	return h
+}
+
+// client
+// the current connection, dial if not connected,
+// the dial is out of the lock, the concurrent callers wait the same dial
+func (h *hostConn) client(ctx context.Context) (*connection, error) {
+
+	for {
+		h.mu.Lock()
+
+		if h.closed {
+			h.mu.Unlock()
+			return nil, ErrPoolClosed
+		}
+
+		if h.conn != nil {
+			conn := h.conn
+			h.mu.Unlock()
+			return conn, nil
+		}
+
+		if h.dialing == nil {
+			break
+		}
+
+		dialing := h.dialing
+		h.mu.Unlock()
+
+		select {
+		case <-dialing:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	dialing := make(chan struct{})
+	h.dialing = dialing
+	h.mu.Unlock()
+
+	conn, err := dial(h.cfg)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.dialing = nil
+	close(dialing)
+
+	if err != nil {
+		return nil, errors.WithMessage(err, "dial")
+	}
+	if h.closed {
+		conn.Close()
+		return nil, ErrPoolClosed
+	}
+
+	if h.connected {
+		atomic.AddUint64(&h.reconnects, 1)
+	}
+	h.connected = true
+	h.conn = conn
+	return conn, nil
+}
+
+// invalidate
+// close the broken connection, the next session will reconnect
+func (h *hostConn) invalidate(conn *connection) {
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.conn != conn {
+		// already replaced
+		return
+	}
+	h.conn.Close()
+	h.conn = nil
+}
+
+// session
+// the session on the pooled connection
+type session struct {
+	*ssh.Session
+	conn *connection
+}
+
+// newSession
+// open a session, wait if the MaxSessions reached, the wait and the retries are canceled by the ctx,
+// the release func must be called after the session closed
+func (h *hostConn) newSession(ctx context.Context) (*session, func(), error) {
+
+	select {
+	case h.sessions <- struct{}{}:
+	case <-h.stop:
+		return nil, nil, ErrPoolClosed
+	case <-ctx.Done():
+		return nil, nil, ctx.Err()
+	}
+	release := func() { <-h.sessions }
+
+	var (
+		backoff = h.poolCfg.InitialBackoff
+		lastErr error
+	)
+
+	for i := 0; ; i++ {
+
+		s, err := h.trySession(ctx)
+		if err == nil {
+			return s, release, nil
+		}
+		if err == ErrPoolClosed || ctx.Err() != nil {
+			release()
+			return nil, nil, err
+		}
+
+		lastErr = err
+		if i >= h.poolCfg.MaxRetries {
+			break
+		}
+
+		t := time.NewTimer(backoff)
+		select {
+		case <-t.C:
+		case <-h.stop:
+			t.Stop()
+			release()
+			return nil, nil, ErrPoolClosed
+		case <-ctx.Done():
+			t.Stop()
+			release()
+			return nil, nil, errors.WithMessage(ctx.Err(), lastErr.Error())
+		}
+		backoff *= 2
+		if backoff > h.poolCfg.MaxBackoff {
+			backoff = h.poolCfg.MaxBackoff
+		}
+	}
+
+	release()
+	return nil, nil, errors.WithMessagef(lastErr, "give up after %d retries", h.poolCfg.MaxRetries)
+}
+
+// trySession
+// open a session, the stale connection will be replaced immediately,
+// the channel refused by the server (e.g. the MaxSessions of sshd reached) is returned to be retried later,
+// the connection is still alive and the sessions on it are kept
+func (h *hostConn) trySession(ctx context.Context) (*session, error) {
+
+	conn, err := h.client(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := conn.NewSession()
+	if err == nil {
+		return &session{Session: s, conn: conn}, nil
+	}
+	if _, ok := err.(*ssh.OpenChannelError); ok {
+		return nil, errors.WithMessage(err, "new session")
+	}
+
+	// the connection is dead, maybe the tcp dropped
+	h.invalidate(conn)
+
+	conn, err = h.client(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	s, err = conn.NewSession()
+	if err != nil {
+		if _, ok := err.(*ssh.OpenChannelError); !ok {
+			h.invalidate(conn)
+		}
+		return nil, errors.WithMessage(err, "new session")
+	}
+	return &session{Session: s, conn: conn}, nil
+}
+
+// keepAlive
+// detect the dead connection in the background
+func (h *hostConn) keepAlive() {
+
+	defer h.wg.Done()
+
+	ticker := time.NewTicker(h.poolCfg.KeepAliveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-h.stop:
+			return
+		case <-ticker.C:
+		}
+
+		h.mu.Lock()
+		conn := h.conn
+		h.mu.Unlock()
+		if conn == nil {
+			continue
+		}
+
+		replied := make(chan error, 1)
+		go func() {
+			_, _, err := conn.SendRequest(keepAliveRequest, true, nil)
+			replied <- err
+		}()
+
+		var err error
+		select {
+		case err = <-replied:
+		case <-time.After(h.poolCfg.KeepAliveTimeout):
+			err = errors.New("keepalive timeout")
+		case <-h.stop:
+			return
+		}
+
+		if err != nil {
+			atomic.AddUint64(&h.keepAliveFailures, 1)
+			h.invalidate(conn)
+		}
+	}
+}
+
+func (h *hostConn) stats() Stats {
+
+	h.mu.Lock()
+	connected := h.conn != nil
+	h.mu.Unlock()
+
+	return Stats{
+		Host:              key(h.cfg),
+		Connected:         connected,
+		ActiveSessions:    len(h.sessions),
+		MaxSessions:       h.poolCfg.MaxSessions,
+		Reconnects:        atomic.LoadUint64(&h.reconnects),
+		KeepAliveFailures: atomic.LoadUint64(&h.keepAliveFailures),
+	}
+}
+
+func (h *hostConn) Close() error {
+
+	h.mu.Lock()
+	if h.closed {
+		h.mu.Unlock()
+		return nil
+	}
+	h.closed = true
+	close(h.stop)
+	conn := h.conn
+	h.conn = nil
+	h.mu.Unlock()
+
+	h.wg.Wait()
+	if conn != nil {
+		return conn.Close()
+	}
+	return nil
+}
+
+// Pool
+// share one connection per host between the clients
+type Pool struct {
+	cfg PoolConfig
+
+	mu     sync.Mutex
+	hosts  map[string]*hostConn
+	closed bool
+}
+
+func NewPool(cfg PoolConfig) *Pool {
+
+	cfg.Complete()
+	return &Pool{
+		cfg:   cfg,
+		hosts: make(map[string]*hostConn),
+	}
+}
+
+// key
+// the host identified by user, address and the jump hosts
+func key(cfg *Config) string {
+
+	hops := make([]string, 0, len(cfg.ProxyJump)+1)
+	for _, h := range cfg.ProxyJump {
+		hops = append(hops, h.User+"@"+address(h.Remote))
+	}
+	hops = append(hops, cfg.User+"@"+address(cfg.Remote))
+	return strings.Join(hops, ",")
+}
+
+// poolKey
+// the key and the auth identity of every hop,
+// the clients with different credentials never share a connection
+func poolKey(cfg *Config) string {
+
+	hops := make([]string, 0, len(cfg.ProxyJump)+1)
+	for _, h := range append(append([]*Config{}, cfg.ProxyJump...), cfg) {
+		hops = append(hops, h.User+"@"+address(h.Remote)+"#"+identity(h))
+	}
+	return strings.Join(hops, ",")
+}
+
+// identity
+// the digest of the auth and the host key verification config, the secrets are not kept in the key,
+// so the connection verified loosely is never shared with the strict client
+func identity(cfg *Config) string {
+
+	h := sha256.New()
+	for _, v := range []string{
+		cfg.PrivateKeyFile, cfg.Passphrase, cfg.CertificateFile, strconv.FormatBool(cfg.UseAgent), cfg.Password,
+		cfg.KnownHostsFile, strconv.FormatBool(cfg.TrustOnFirstUse), strconv.FormatBool(cfg.InsecureIgnoreHostKey),
+	} {
+		h.Write([]byte(v))
+		h.Write([]byte{0})
+	}
+	if cfg.KeyboardInteractive != nil {
+		fmt.Fprintf(h, "%p", cfg.KeyboardInteractive)
+	}
+	h.Write([]byte{0})
+	if cfg.HostKeyCallback != nil {
+		fmt.Fprintf(h, "%p", cfg.HostKeyCallback)
+	}
+	return hex.EncodeToString(h.Sum(nil)[:8])
+}
+
+// Client
+// the client use the shared connection of the host, the connection is established lazily,
+// close the client will not close the shared connection, it is closed by the Pool
+func (p *Pool) Client(cfg *Config) (command.Interface, error) {
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return nil, ErrPoolClosed
+	}
+
+	k := poolKey(cfg)
+	h, ok := p.hosts[k]
+	if !ok {
+		h = newHostConn(cfg, p.cfg)
+		p.hosts[k] = h
+	}
+
+	return &Client{
+		cfg:    cfg,
+		client: h,
+		shared: true,
+	}, nil
+}
+
+// Stats
+// the state of all the hosts, sorted by host
+func (p *Pool) Stats() []Stats {
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	out := make([]Stats, 0, len(p.hosts))
+	for _, h := range p.hosts {
+		out = append(out, h.stats())
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Host < out[j].Host
+	})
+	return out
+}
+
+// Close
+// close all the connections
+func (p *Pool) Close() error {
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.closed = true
+	for k, h := range p.hosts {
+		h.Close()
+		delete(p.hosts, k)
+	}
+	return nil
+}
@@ -0,0 +1,247 @@
+package remote
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+)
+
+func newPoolTestServer(t *testing.T) (*testServer, *Config, func()) {
+
+	dir := newTempDir(t)
+	keyFile, signer := writeTestKey(t, dir, "")
+	s := publicKeyServer(t, signer.PublicKey())
+
+	cfg := &Config{
+		Remote:                s.Addr(),
+		User:                  testUser,
+		PrivateKeyFile:        keyFile,
+		InsecureIgnoreHostKey: true,
+	}
+	return s, cfg, func() {
+		s.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestPoolMaxSessions(t *testing.T) {
+
+	_, cfg, cleanup := newPoolTestServer(t)
+	defer cleanup()
+
+	p := NewPool(PoolConfig{MaxSessions: 1})
+	defer p.Close()
+
+	c, err := p.Client(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	wg := sync.WaitGroup{}
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := c.ExecContext(context.Background(), "sleep", []string{"0.2"}, nil); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if cost := time.Since(start); cost < 600*time.Millisecond {
+		t.Fatalf("the sessions not serialized, cost %s", cost)
+	}
+
+	stats := p.Stats()
+	if len(stats) != 1 || stats[0].ActiveSessions != 0 || !stats[0].Connected {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
+
+func TestPoolReconnect(t *testing.T) {
+
+	s, cfg, cleanup := newPoolTestServer(t)
+	defer cleanup()
+
+	p := NewPool(PoolConfig{
+		KeepAliveInterval: 50 * time.Millisecond,
+		InitialBackoff:    10 * time.Millisecond,
+	})
+	defer p.Close()
+
+	// the clients share the connection
+	c1, _ := p.Client(cfg)
+	c2, _ := p.Client(cfg)
+
+	if _, err := c1.ExecContext(context.Background(), "true", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	s.DropConnections()
+
+	// the keepalive detect the dead connection
+	deadline := time.Now().Add(5 * time.Second)
+	for p.Stats()[0].Connected {
+		if time.Now().After(deadline) {
+			t.Fatal("the dead connection not detected")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	r, err := c2.ExecContext(context.Background(), "echo", []string{"hello"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(r.Stdout, []byte("hello\n")) {
+		t.Fatalf("unexpected output %q", r.Stdout)
+	}
+
+	stats := p.Stats()[0]
+	if stats.Reconnects != 1 || stats.KeepAliveFailures == 0 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
+
+func TestPoolReconnectWithoutKeepAlive(t *testing.T) {
+
+	s, cfg, cleanup := newPoolTestServer(t)
+	defer cleanup()
+
+	c, err := NewClientWithPoolConfig(cfg, PoolConfig{KeepAliveInterval: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	s.DropConnections()
+	time.Sleep(50 * time.Millisecond)
+
+	// the stale connection replaced transparently
+	if _, err := c.ExecContext(context.Background(), "true", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPoolSessionRefused(t *testing.T) {
+
+	s, cfg, cleanup := newPoolTestServer(t)
+	defer cleanup()
+
+	p := NewPool(PoolConfig{KeepAliveInterval: -1, InitialBackoff: 10 * time.Millisecond})
+	defer p.Close()
+
+	c, err := p.Client(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the in-flight session
+	done := make(chan error, 1)
+	go func() {
+		_, err := c.ExecContext(context.Background(), "sleep", []string{"0.3"}, nil)
+		done <- err
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	// the server refuse the channels, the connection is still alive
+	atomic.StoreInt32(&s.refuseSessions, 2)
+	if _, err := c.ExecContext(context.Background(), "true", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := <-done; err != nil {
+		t.Fatalf("the in-flight session broken, %v", err)
+	}
+	if stats := p.Stats()[0]; stats.Reconnects != 0 {
+		t.Fatalf("the alive connection replaced, %+v", stats)
+	}
+}
+
+func TestPoolSessionCanceled(t *testing.T) {
+
+	_, cfg, cleanup := newPoolTestServer(t)
+	defer cleanup()
+
+	p := NewPool(PoolConfig{MaxSessions: 1})
+	defer p.Close()
+
+	c, err := p.Client(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c.ExecContext(context.Background(), "sleep", []string{"1"}, nil)
+	}()
+	time.Sleep(200 * time.Millisecond)
+
+	// the ctx timeout apply to the session wait
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	if _, err := c.ExecContext(ctx, "true", nil, nil); errors.Cause(err) != context.DeadlineExceeded {
+		t.Fatalf("expect deadline exceeded, got %v", err)
+	}
+	if cost := time.Since(start); cost > 500*time.Millisecond {
+		t.Fatalf("the session wait not canceled, cost %s", cost)
+	}
+	<-done
+}
+
+func TestPoolKey(t *testing.T) {
+
+	p := NewPool(PoolConfig{KeepAliveInterval: -1})
+	defer p.Close()
+
+	a := &Config{Remote: "10.0.0.1", User: "root", PrivateKeyFile: "/a/id_rsa"}
+	b := &Config{Remote: "10.0.0.1:22", User: "root", PrivateKeyFile: "/b/id_rsa"}
+	for _, cfg := range []*Config{a, a, b} {
+		if _, err := p.Client(cfg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the same host with different credentials
+	if n := len(p.Stats()); n != 2 {
+		t.Fatalf("expect 2 pooled hosts, got %d", n)
+	}
+}
+
+func TestPoolKeyHostKeyPolicy(t *testing.T) {
+
+	p := NewPool(PoolConfig{KeepAliveInterval: -1})
+	defer p.Close()
+
+	strict := &Config{Remote: "10.0.0.1", User: "root", PrivateKeyFile: "/a/id_rsa"}
+	insecure := *strict
+	insecure.InsecureIgnoreHostKey = true
+	tofu := *strict
+	tofu.TrustOnFirstUse = true
+	otherKnownHosts := *strict
+	otherKnownHosts.KnownHostsFile = "/tmp/known_hosts"
+	callback := *strict
+	callback.HostKeyCallback = ssh.InsecureIgnoreHostKey()
+
+	for _, cfg := range []*Config{strict, &insecure, &tofu, &otherKnownHosts, &callback, strict} {
+		if _, err := p.Client(cfg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the clients differ only in the host key policy never share a connection
+	if n := len(p.Stats()); n != 5 {
+		t.Fatalf("expect 5 pooled hosts, got %d", n)
+	}
+}
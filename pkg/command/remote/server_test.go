@@ -0,0 +1,368 @@
+package remote
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"net"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// testServer
+// the in-process sshd, run the exec request by local /bin/sh
+type testServer struct {
+	t        *testing.T
+	listener net.Listener
+	config   *ssh.ServerConfig
+	hostKey  ssh.Signer
+
+	wg sync.WaitGroup
+
+	// the number of the direct-tcpip channel, the server acting as jump host
+	forwarded int32
+	// the number of the ssh connections not closed
+	active int32
+	// the number of the following session channels to be refused, like the MaxSessions of sshd reached
+	refuseSessions int32
+	// the accepted connections drop all the traffic, like the link is dead, see Freeze
+	frozen int32
+
+	// the accepted connections
+	mu    sync.Mutex
+	conns map[net.Conn]struct{}
+}
+
+func newTestSigner(t *testing.T) ssh.Signer {
+
+	k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := ssh.NewSignerFromKey(k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// writeTestKey
+// generate a private key file, encrypted by the passphrase if not empty
+func writeTestKey(t *testing.T, dir string, passphrase string) (string, ssh.Signer) {
+
+	k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	der, err := x509.MarshalECPrivateKey(k)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	block := &pem.Block{Type: "EC PRIVATE KEY", Bytes: der}
+	if len(passphrase) != 0 {
+		block, err = x509.EncryptPEMBlock(rand.Reader, block.Type, der, []byte(passphrase), x509.PEMCipherAES256)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	file := filepath.Join(dir, "id_ecdsa")
+	if err := ioutil.WriteFile(file, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	signer, err := ssh.NewSignerFromKey(k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return file, signer
+}
+
+func newTestServer(t *testing.T, config *ssh.ServerConfig) *testServer {
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &testServer{
+		t:        t,
+		listener: l,
+		config:   config,
+		hostKey:  newTestSigner(t),
+		conns:    make(map[net.Conn]struct{}),
+	}
+	config.AddHostKey(s.hostKey)
+
+	s.wg.Add(1)
+	go s.serve()
+	return s
+}
+
+func (s *testServer) Addr() string {
+	return s.listener.Addr().String()
+}
+
+func (s *testServer) Close() {
+	s.listener.Close()
+	s.wg.Wait()
+	s.DropConnections()
+}
+
+// DropConnections
+// close all the accepted connections, like the tcp dropped
+func (s *testServer) DropConnections() {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for c := range s.conns {
+		c.Close()
+		delete(s.conns, c)
+	}
+}
+
+// Freeze
+// drop the traffic of the accepted connections silently, the peer is never replied
+func (s *testServer) Freeze() {
+	atomic.StoreInt32(&s.frozen, 1)
+}
+
+// frozenConn
+// the connection drop the traffic after the server frozen
+type frozenConn struct {
+	net.Conn
+	s *testServer
+}
+
+func (c *frozenConn) Read(b []byte) (int, error) {
+
+	for {
+		n, err := c.Conn.Read(b)
+		if err != nil || atomic.LoadInt32(&c.s.frozen) == 0 {
+			return n, err
+		}
+	}
+}
+
+func (c *frozenConn) Write(b []byte) (int, error) {
+
+	if atomic.LoadInt32(&c.s.frozen) != 0 {
+		return len(b), nil
+	}
+	return c.Conn.Write(b)
+}
+
+func (s *testServer) serve() {
+
+	defer s.wg.Done()
+
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.conns[conn] = struct{}{}
+		s.mu.Unlock()
+
+		go s.handleConn(&frozenConn{Conn: conn, s: s})
+	}
+}
+
+func (s *testServer) handleConn(conn net.Conn) {
+
+	sc, chans, reqs, err := ssh.NewServerConn(conn, s.config)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	defer sc.Close()
+
+	atomic.AddInt32(&s.active, 1)
+	defer atomic.AddInt32(&s.active, -1)
+
+	go ssh.DiscardRequests(reqs)
+
+	for nc := range chans {
+
+		if nc.ChannelType() == "direct-tcpip" {
+			go s.handleDirectTCPIP(nc)
+			continue
+		}
+
+		if nc.ChannelType() != "session" {
+			nc.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+
+		if s.refuseSession() {
+			nc.Reject(ssh.ResourceShortage, "too many sessions")
+			continue
+		}
+
+		ch, reqs, err := nc.Accept()
+		if err != nil {
+			continue
+		}
+		go s.handleSession(ch, reqs)
+	}
+}
+
+// refuseSession
+// consume one of the sessions to be refused
+func (s *testServer) refuseSession() bool {
+
+	for {
+		n := atomic.LoadInt32(&s.refuseSessions)
+		if n <= 0 {
+			return false
+		}
+		if atomic.CompareAndSwapInt32(&s.refuseSessions, n, n-1) {
+			return true
+		}
+	}
+}
+
+// handleDirectTCPIP
+// forward the channel to the target address (RFC 4254 7.2)
+func (s *testServer) handleDirectTCPIP(nc ssh.NewChannel) {
+
+	var payload struct {
+		Host       string
+		Port       uint32
+		OriginHost string
+		OriginPort uint32
+	}
+	if err := ssh.Unmarshal(nc.ExtraData(), &payload); err != nil {
+		nc.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+
+	conn, err := net.Dial("tcp", net.JoinHostPort(payload.Host, strconv.Itoa(int(payload.Port))))
+	if err != nil {
+		nc.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+
+	ch, reqs, err := nc.Accept()
+	if err != nil {
+		conn.Close()
+		return
+	}
+	atomic.AddInt32(&s.forwarded, 1)
+	go ssh.DiscardRequests(reqs)
+
+	go func() {
+		io.Copy(conn, ch)
+		conn.Close()
+	}()
+	io.Copy(ch, conn)
+	ch.Close()
+}
+
+func (s *testServer) handleSession(ch ssh.Channel, reqs <-chan *ssh.Request) {
+
+	defer ch.Close()
+
+	var (
+		cmd *exec.Cmd
+		env []string
+		mu  sync.Mutex
+	)
+
+	for req := range reqs {
+
+		switch req.Type {
+		case "env":
+			var kv struct{ Name, Value string }
+			ssh.Unmarshal(req.Payload, &kv)
+			env = append(env, kv.Name+"="+kv.Value)
+			req.Reply(true, nil)
+
+		case "exec":
+			var payload struct{ Command string }
+			ssh.Unmarshal(req.Payload, &payload)
+
+			mu.Lock()
+			cmd = exec.Command("/bin/sh", "-c", payload.Command)
+			cmd.Env = env
+			cmd.Stdout = ch
+			cmd.Stderr = ch.Stderr()
+			stdin, _ := cmd.StdinPipe()
+			err := cmd.Start()
+			mu.Unlock()
+
+			req.Reply(err == nil, nil)
+			if err != nil {
+				return
+			}
+
+			go func() {
+				io.Copy(stdin, ch)
+				stdin.Close()
+			}()
+
+			go func(c *exec.Cmd) {
+				c.Wait()
+
+				status := make([]byte, 4)
+				if ws, ok := c.ProcessState.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+					binary.BigEndian.PutUint32(status, uint32(128+int(ws.Signal())))
+				} else {
+					binary.BigEndian.PutUint32(status, uint32(c.ProcessState.ExitCode()))
+				}
+				ch.SendRequest("exit-status", false, status)
+				ch.Close()
+			}(cmd)
+
+		case "pty-req":
+			// the cmd runs without the real pty
+			req.Reply(true, nil)
+
+		case "subsystem":
+			var payload struct{ Name string }
+			ssh.Unmarshal(req.Payload, &payload)
+			if payload.Name != "sftp" {
+				req.Reply(false, nil)
+				continue
+			}
+
+			server, err := sftp.NewServer(ch)
+			req.Reply(err == nil, nil)
+			if err != nil {
+				return
+			}
+			go func() {
+				server.Serve()
+				server.Close()
+				ch.Close()
+			}()
+
+		case "signal":
+			mu.Lock()
+			if cmd != nil && cmd.Process != nil {
+				cmd.Process.Kill()
+			}
+			mu.Unlock()
+
+		default:
+			req.Reply(false, nil)
+		}
+	}
+}
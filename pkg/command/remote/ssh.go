@@ -2,9 +2,11 @@ package remote
 
 import (
 	"bytes"
+	"context"
 	"io"
-	"io/ioutil"
 	"log"
+	"strings"
+	"time"
 
 	"github.com/pkg/errors"
 	"github.com/sxllwx/vulcanus/pkg/command"
@@ -14,77 +16,234 @@ import (
 type Client struct {
 	cfg     *Config
 	session *ssh.Session
-	client  *ssh.Client
+	client  *hostConn
 	logger  *log.Logger
+
+	// the connection is owned by the Pool
+	shared bool
 }
 
+var _ command.Runner = &Client{}
+
 type Config struct {
-	Remote         string
-	User           string
+	Remote string
+	User   string
+
+	// *** public key auth *** //
 	PrivateKeyFile string
+	// the passphrase of the encrypted PrivateKeyFile
+	Passphrase string
+	// the certificate of the PrivateKeyFile signed by the ca, eg: id_rsa-cert.pub
+	CertificateFile string
+	// use the keys in ssh-agent (SSH_AUTH_SOCK)
+	UseAgent bool
+
+	// *** password auth *** //
+	Password string
+	// answer the keyboard-interactive questions,
+	// default answer all the questions with Password
+	KeyboardInteractive ssh.KeyboardInteractiveChallenge
+
+	// *** host key verification *** //
+	// default is ~/.ssh/known_hosts
+	KnownHostsFile string
+	// add the unknown host key to KnownHostsFile, the changed one is still rejected
+	TrustOnFirstUse bool
+	// skip the host key verification, never use it against production hosts
+	InsecureIgnoreHostKey bool
+	// override the known_hosts verification
+	HostKeyCallback ssh.HostKeyCallback
+
+	// the timeout of the tcp connect and the ssh handshake of every hop,
+	// and the wait of the canceled cmd before the connection treated as dead, default is 30s
+	Timeout time.Duration
+
+	// run the cmd by `exec env --` instead of the user's shell,
+	// the shell aliases, functions and builtins are bypassed
+	NoShell bool
+
+	// the jump hosts (bastion) before the Remote, each one has its own auth
+	// eg: client -> ProxyJump[0] -> ProxyJump[1] -> Remote
+	ProxyJump []*Config
 }
 
 func NewClient(cfg *Config) (command.Interface, error) {
 
-	key, err := ioutil.ReadFile(cfg.PrivateKeyFile)
-	if err != nil {
-		return nil, errors.WithMessagef(err, "read private key file %s", cfg.PrivateKeyFile)
-	}
+	return NewClientWithPoolConfig(cfg, PoolConfig{})
+}
 
-	// Create the Signer for this private key.
-	signer, err := ssh.ParsePrivateKey(key)
-	if err != nil {
-		return nil, errors.WithMessagef(err, "parse the private key")
-	}
+// NewClientWithPoolConfig
+// the client own a dedicated connection with keepalive and reconnection
+func NewClientWithPoolConfig(cfg *Config, poolCfg PoolConfig) (command.Interface, error) {
 
-	clt, err := ssh.Dial("tcp", cfg.Remote, &ssh.ClientConfig{
-		User: cfg.User,
-		Auth: []ssh.AuthMethod{
-			// Use the PublicKeys method for remote authentication.
-			ssh.PublicKeys(signer),
-		},
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
-	})
-	if err != nil {
-		return nil, errors.WithMessage(err, "dial")
+	h := newHostConn(cfg, poolCfg)
+
+	// connect now, report the config error early
+	if _, err := h.client(context.Background()); err != nil {
+		h.Close()
+		return nil, err
 	}
 
 	return &Client{
 		cfg:    cfg,
-		client: clt,
+		client: h,
 	}, nil
 
 }
 
 func (c *Client) Close() error {
 
-	c.client.Close()
-	return nil
+	if c.shared {
+		return nil
+	}
+	return c.client.Close()
 }
 
 func (c *Client) Exec(cmd string, args []string, in io.Reader, out, err io.WriteCloser) error {
 
-	buff := &bytes.Buffer{}
-	buff.WriteString(cmd)
-	for _, a := range args {
-		buff.WriteString(" ")
-		buff.WriteString(a)
+	_, e := c.Run(context.Background(), cmd, args, &command.ExecOptions{
+		In:  in,
+		Out: out,
+		Err: err,
+	})
+	return e
+}
+
+func (c *Client) ExecContext(ctx context.Context, cmd string, args []string, in io.Reader) (*command.Result, error) {
+	return c.ExecStream(ctx, cmd, args, in, nil, nil)
+}
+
+// ExecStream
+// the output is written to the out and err, the nil writer means the output is captured in the Result
+func (c *Client) ExecStream(ctx context.Context, cmd string, args []string, in io.Reader, out, errOut io.Writer) (*command.Result, error) {
+
+	return c.Run(ctx, cmd, args, &command.ExecOptions{
+		In:  in,
+		Out: out,
+		Err: errOut,
+	})
+}
+
+// Run
+// run the cmd with the options, the env is sent by the env request,
+// the env rejected by the sshd (AcceptEnv) is passed by `env KEY=VALUE`,
+// the User and Group are switched by `sudo -n`
+func (c *Client) Run(ctx context.Context, cmd string, args []string, opts *command.ExecOptions) (*command.Result, error) {
+
+	if opts == nil {
+		opts = &command.ExecOptions{}
+	}
+
+	var (
+		stdout = &bytes.Buffer{}
+		stderr = &bytes.Buffer{}
+		start  = time.Now()
+	)
+
+	result := func(err error) (*command.Result, error) {
+		return &command.Result{
+			ExitCode: command.ExitCode(err),
+			Duration: time.Since(start),
+			Stdout:   stdout.Bytes(),
+			Stderr:   stderr.Bytes(),
+		}, err
 	}
 
-	s, e := c.client.NewSession()
+	if e := opts.Validate(); e != nil {
+		return result(e)
+	}
+
+	s, release, e := c.client.newSession(ctx)
 	if e != nil {
-		return errors.WithMessage(e, "new session")
+		return result(errors.WithMessage(e, "new session"))
 	}
+	defer release()
 	defer s.Close()
 
-	s.Stderr = err
-	s.Stdin = in
-	s.Stdout = out
+	s.Stdin = opts.In
+	s.Stdout, s.Stderr = opts.Writers(stdout, stderr)
 
-	e = s.Run(buff.String())
-	if e != nil {
-		return errors.WithMessage(e, "run cmd")
+	cmd, args = command.WrapRlimits(cmd, args, opts.Rlimits)
+	if len(opts.User) != 0 {
+		// sudo reset the env
+		cmd, args = command.WrapEnv(cmd, args, opts.Env)
+		cmd, args = sudo(cmd, args, opts.User, opts.Group)
+	} else {
+		cmd, args = command.WrapEnv(cmd, args, setenv(s.Session, opts.Env))
+	}
+
+	line := c.commandLine(cmd, args)
+	if len(opts.Dir) != 0 {
+		line = "cd " + command.Quote(opts.Dir) + " && " + line
+	}
+	if opts.CombinedOutput {
+		// the stdout and stderr are sent by different channels, merge them by the remote shell to keep the order
+		line = "exec 2>&1 && " + line
 	}
 
-	return nil
+	if e := s.Start(line); e != nil {
+		return result(errors.WithMessage(e, "start cmd"))
+	}
+
+	waitC := make(chan error, 1)
+	go func() {
+		waitC <- s.Wait()
+	}()
+
+	select {
+	case e := <-waitC:
+		return result(exitError(e))
+	case <-ctx.Done():
+		// not all the sshd support signal, close the session anyway
+		s.Signal(ssh.SIGKILL)
+		s.Close()
+
+		t := time.NewTimer(c.cfg.timeout())
+		defer t.Stop()
+
+		select {
+		case <-waitC:
+		case <-t.C:
+			// the close is never replied on the dead link, the wait return after the connection closed
+			c.client.invalidate(s.conn)
+			<-waitC
+		}
+		return result(errors.WithMessage(ctx.Err(), "wait cmd"))
+	}
+}
+
+// setenv
+// send the env to the session, return the env rejected by the sshd
+func setenv(s *ssh.Session, env []string) []string {
+
+	var rejected []string
+	for _, kv := range env {
+		i := strings.IndexByte(kv, '=')
+		if err := s.Setenv(kv[:i], kv[i+1:]); err != nil {
+			rejected = append(rejected, kv)
+		}
+	}
+	return rejected
+}
+
+// sudo
+// run the cmd as the user by `sudo -n`, the password prompt is not supported
+func sudo(cmd string, args []string, user string, group string) (string, []string) {
+
+	out := []string{"-n", "-u", user}
+	if len(group) != 0 {
+		out = append(out, "-g", group)
+	}
+	out = append(out, "--", cmd)
+	return "sudo", append(out, args...)
+}
+
+// commandLine
+// quote the cmd and args, the remote shell will get the same argv as the local exec
+func (c *Client) commandLine(cmd string, args []string) string {
+
+	if c.cfg.NoShell {
+		return command.JoinExec(cmd, args)
+	}
+	return command.Join(cmd, args)
 }
@@ -1,25 +1,531 @@
 package remote
 
 import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"net"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sxllwx/vulcanus/pkg/command"
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+const (
+	testUser     = "root"
+	testPassword = "vulcanus"
 )
 
-var cfg = &Config{
-	Remote:         "192.168.240.101:22",
-	User:           "root",
-	PrivateKeyFile: "/home/scott/.ssh/id_rsa",
+type nopWriteCloser struct {
+	*bytes.Buffer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+func newTempDir(t *testing.T) string {
+
+	dir, err := ioutil.TempDir("", "vulcanus-ssh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+// publicKeyServer
+// the server only accept the spec public key
+func publicKeyServer(t *testing.T, key ssh.PublicKey) *testServer {
+
+	return newTestServer(t, &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, k ssh.PublicKey) (*ssh.Permissions, error) {
+			if bytes.Equal(k.Marshal(), key.Marshal()) {
+				return nil, nil
+			}
+			return nil, ssh.ErrNoAuth
+		},
+	})
+}
+
+func execEcho(t *testing.T, cfg *Config) {
+
+	c, err := NewClient(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	out := nopWriteCloser{&bytes.Buffer{}}
+	if err := c.Exec("echo", []string{"hello"}, nil, out, nopWriteCloser{&bytes.Buffer{}}); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "hello\n" {
+		t.Fatalf("unexpected output %q", out.String())
+	}
 }
 
 func TestClient_Execute(t *testing.T) {
 
+	dir := newTempDir(t)
+	defer os.RemoveAll(dir)
+
+	keyFile, signer := writeTestKey(t, dir, "")
+	s := publicKeyServer(t, signer.PublicKey())
+	defer s.Close()
+
+	execEcho(t, &Config{
+		Remote:                s.Addr(),
+		User:                  testUser,
+		PrivateKeyFile:        keyFile,
+		InsecureIgnoreHostKey: true,
+	})
+}
+
+func TestKnownHosts(t *testing.T) {
+
+	dir := newTempDir(t)
+	defer os.RemoveAll(dir)
+
+	keyFile, signer := writeTestKey(t, dir, "")
+	s := publicKeyServer(t, signer.PublicKey())
+	defer s.Close()
+
+	cfg := &Config{
+		Remote:         s.Addr(),
+		User:           testUser,
+		PrivateKeyFile: keyFile,
+		KnownHostsFile: filepath.Join(dir, "known_hosts"),
+	}
+
+	// the known_hosts not exist
+	if _, err := NewClient(cfg); err == nil {
+		t.Fatal("expect the unknown host rejected")
+	}
+
+	// trust on first use
+	cfg.TrustOnFirstUse = true
+	execEcho(t, cfg)
+
+	body, err := ioutil.ReadFile(cfg.KnownHostsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(body), s.hostKey.PublicKey().Type()) {
+		t.Fatalf("the host key not added: %s", body)
+	}
+
+	// the known host
+	cfg.TrustOnFirstUse = false
+	execEcho(t, cfg)
+
+	// the host key changed, maybe man-in-the-middle attack
+	line := knownhosts.Line([]string{knownhosts.Normalize(s.Addr())}, newTestSigner(t).PublicKey())
+	if err := ioutil.WriteFile(cfg.KnownHostsFile, []byte(line+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cfg.TrustOnFirstUse = true
+	if _, err := NewClient(cfg); err == nil {
+		t.Fatal("expect the changed host key rejected")
+	}
+}
+
+func TestKnownHostKeyType(t *testing.T) {
+
+	dir := newTempDir(t)
+	defer os.RemoveAll(dir)
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	known, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if string(password) == testPassword {
+				return nil, nil
+			}
+			return nil, ssh.ErrNoAuth
+		},
+	}
+	// the ecdsa key is added by the test server too, and it is preferred by default
+	config.AddHostKey(known)
+	s := newTestServer(t, config)
+	defer s.Close()
+
+	// only the ed25519 key is known
+	file := filepath.Join(dir, "known_hosts")
+	line := knownhosts.Line([]string{knownhosts.Normalize(s.Addr())}, known.PublicKey())
+	if err := ioutil.WriteFile(file, []byte(line+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	execEcho(t, &Config{
+		Remote:         s.Addr(),
+		User:           testUser,
+		Password:       testPassword,
+		KnownHostsFile: file,
+	})
+}
+
+func TestTrustOnFirstUseOnce(t *testing.T) {
+
+	dir := newTempDir(t)
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "known_hosts")
+	if err := touch(file); err != nil {
+		t.Fatal(err)
+	}
+
+	// the clients built before any key added
+	var callbacks []ssh.HostKeyCallback
+	for i := 0; i < 2; i++ {
+		known, err := knownhosts.New(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		callbacks = append(callbacks, trustOnFirstUse(file, known))
+	}
+
+	key := newTestSigner(t).PublicKey()
+	remote := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 22}
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := callbacks[i%2]("10.0.0.1:22", remote, key); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	body, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(string(body), "\n"); n != 1 {
+		t.Fatalf("expect the key added once, got %d lines\n%s", n, body)
+	}
+}
+
+func TestPasswordAuth(t *testing.T) {
+
+	s := newTestServer(t, &ssh.ServerConfig{
+		PasswordCallback: func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if string(password) == testPassword {
+				return nil, nil
+			}
+			return nil, ssh.ErrNoAuth
+		},
+	})
+	defer s.Close()
+
+	execEcho(t, &Config{
+		Remote:                s.Addr(),
+		User:                  testUser,
+		Password:              testPassword,
+		InsecureIgnoreHostKey: true,
+	})
+}
+
+func TestKeyboardInteractiveAuth(t *testing.T) {
+
+	s := newTestServer(t, &ssh.ServerConfig{
+		KeyboardInteractiveCallback: func(conn ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+			answers, err := client(conn.User(), "", []string{"Password: "}, []bool{false})
+			if err != nil {
+				return nil, err
+			}
+			if len(answers) == 1 && answers[0] == testPassword {
+				return nil, nil
+			}
+			return nil, ssh.ErrNoAuth
+		},
+	})
+	defer s.Close()
+
+	execEcho(t, &Config{
+		Remote:                s.Addr(),
+		User:                  testUser,
+		Password:              testPassword,
+		InsecureIgnoreHostKey: true,
+	})
+}
+
+func TestPassphraseKeyAuth(t *testing.T) {
+
+	dir := newTempDir(t)
+	defer os.RemoveAll(dir)
+
+	keyFile, signer := writeTestKey(t, dir, "secret")
+	s := publicKeyServer(t, signer.PublicKey())
+	defer s.Close()
+
+	cfg := &Config{
+		Remote:                s.Addr(),
+		User:                  testUser,
+		PrivateKeyFile:        keyFile,
+		InsecureIgnoreHostKey: true,
+	}
+	if _, err := NewClient(cfg); err == nil {
+		t.Fatal("expect the encrypted key without passphrase failed")
+	}
+
+	cfg.Passphrase = "secret"
+	execEcho(t, cfg)
+}
+
+func TestCertificateAuth(t *testing.T) {
+
+	dir := newTempDir(t)
+	defer os.RemoveAll(dir)
+
+	ca := newTestSigner(t)
+	keyFile, signer := writeTestKey(t, dir, "")
+
+	cert := &ssh.Certificate{
+		Key:             signer.PublicKey(),
+		CertType:        ssh.UserCert,
+		KeyId:           "vulcanus",
+		ValidPrincipals: []string{testUser},
+		ValidBefore:     ssh.CertTimeInfinity,
+	}
+	if err := cert.SignCert(rand.Reader, ca); err != nil {
+		t.Fatal(err)
+	}
+	certFile := keyFile + "-cert.pub"
+	if err := ioutil.WriteFile(certFile, ssh.MarshalAuthorizedKey(cert), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	checker := &ssh.CertChecker{
+		IsUserAuthority: func(auth ssh.PublicKey) bool {
+			return bytes.Equal(auth.Marshal(), ca.PublicKey().Marshal())
+		},
+	}
+	s := newTestServer(t, &ssh.ServerConfig{
+		PublicKeyCallback: checker.Authenticate,
+	})
+	defer s.Close()
+
+	execEcho(t, &Config{
+		Remote:                s.Addr(),
+		User:                  testUser,
+		PrivateKeyFile:        keyFile,
+		CertificateFile:       certFile,
+		InsecureIgnoreHostKey: true,
+	})
+}
+
+func TestAgentAuth(t *testing.T) {
+
+	dir := newTempDir(t)
+	defer os.RemoveAll(dir)
+
+	_, signer := writeTestKey(t, dir, "")
+
+	keyring := agent.NewKeyring()
+	raw, err := ssh.ParseRawPrivateKey(mustRead(t, filepath.Join(dir, "id_ecdsa")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := keyring.Add(agent.AddedKey{PrivateKey: raw}); err != nil {
+		t.Fatal(err)
+	}
+
+	sock := filepath.Join(dir, "agent.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go agent.ServeAgent(keyring, conn)
+		}
+	}()
+
+	old := os.Getenv(authSockEnv)
+	os.Setenv(authSockEnv, sock)
+	defer os.Setenv(authSockEnv, old)
+
+	s := publicKeyServer(t, signer.PublicKey())
+	defer s.Close()
+
+	execEcho(t, &Config{
+		Remote:                s.Addr(),
+		User:                  testUser,
+		UseAgent:              true,
+		InsecureIgnoreHostKey: true,
+	})
+}
+
+func mustRead(t *testing.T, file string) []byte {
+
+	body, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return body
+}
+
+func TestQuotedArgs(t *testing.T) {
+
+	dir := newTempDir(t)
+	defer os.RemoveAll(dir)
+
+	keyFile, signer := writeTestKey(t, dir, "")
+	s := publicKeyServer(t, signer.PublicKey())
+	defer s.Close()
+
+	args := []string{"generated by vulcanus", `"quoted"`, "it's", "$HOME; id"}
+
+	for _, noShell := range []bool{false, true} {
+
+		c, err := NewClient(&Config{
+			Remote:                s.Addr(),
+			User:                  testUser,
+			PrivateKeyFile:        keyFile,
+			InsecureIgnoreHostKey: true,
+			NoShell:               noShell,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		r, err := c.ExecContext(context.Background(), "printf", append([]string{"%s\\n"}, args...), nil)
+		c.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e, a := strings.Join(args, "\n")+"\n", string(r.Stdout); e != a {
+			t.Fatalf("expect %q, got %q", e, a)
+		}
+	}
+}
+
+func TestRunOptions(t *testing.T) {
+
+	dir := newTempDir(t)
+	defer os.RemoveAll(dir)
+
+	keyFile, signer := writeTestKey(t, dir, "")
+	s := publicKeyServer(t, signer.PublicKey())
+	defer s.Close()
+
+	c, err := NewClient(&Config{
+		Remote:                s.Addr(),
+		User:                  testUser,
+		PrivateKeyFile:        keyFile,
+		InsecureIgnoreHostKey: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	r, err := c.(command.Runner).Run(context.Background(), "/bin/sh", []string{"-c", `echo "$VULCANUS_A"; pwd; ulimit -n; echo err >&2`}, &command.ExecOptions{
+		Env: []string{"VULCANUS_A=it's a"},
+		Dir: dir,
+		Rlimits: []command.Rlimit{
+			{Resource: command.RlimitNofile, Soft: 64, Hard: 64},
+		},
+		CombinedOutput: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	realDir, _ := filepath.EvalSymlinks(dir)
+	if e, a := "it's a\n"+realDir+"\n64\nerr\n", string(r.Stdout); e != a {
+		t.Fatalf("expect %q, got %q", e, a)
+	}
+}
+
+func TestInteractInput(t *testing.T) {
+
+	_, cfg, cleanup := newPoolTestServer(t)
+	defer cleanup()
+
 	c, err := NewClient(cfg)
 	if err != nil {
 		t.Fatal(err)
 	}
+	defer c.Close()
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	defer w.Close()
+
+	opts := &command.TerminalOptions{In: r}
+	if err := c.(command.Terminal).Interact("true", nil, opts); err != nil {
+		t.Fatal(err)
+	}
+
+	// the options of the caller are kept
+	if len(opts.Term) != 0 {
+		t.Fatalf("the options changed %+v", opts)
+	}
 
-	err = c.Exec("ls", []string{}, os.Stdin, os.Stdout, os.Stderr)
+	// the stdin copy stopped, the later input is read by the caller
+	go w.Write([]byte("after"))
+
+	b := make([]byte, 5)
+	r.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := io.ReadFull(r, b); err != nil || string(b) != "after" {
+		t.Fatalf("expect the input not consumed, got %q %v", b, err)
+	}
+}
+
+func TestRunCanceledDeadLink(t *testing.T) {
+
+	s, cfg, cleanup := newPoolTestServer(t)
+	defer cleanup()
+
+	cfg.Timeout = 200 * time.Millisecond
+	c, err := NewClientWithPoolConfig(cfg, PoolConfig{KeepAliveInterval: -1})
 	if err != nil {
 		t.Fatal(err)
 	}
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		s.Freeze()
+	}()
+
+	start := time.Now()
+	_, err = c.ExecContext(ctx, "sleep", []string{"10"}, nil)
+	if errors.Cause(err) != context.DeadlineExceeded {
+		t.Fatalf("expect the deadline exceeded, got %v", err)
+	}
+	if cost := time.Since(start); cost > 3*time.Second {
+		t.Fatalf("the canceled cmd hung on the dead link, cost %s", cost)
+	}
 }
@@ -0,0 +1,248 @@
+package remote
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// the max ProxyJump hops resolved from the ssh config, avoid the loop
+const maxProxyJumpDepth = 8
+
+// SSHConfig
+// the subset of ssh_config(5): Host, HostName, Port, User, IdentityFile,
+// UserKnownHostsFile and ProxyJump, the Match and Include are ignored
+type SSHConfig struct {
+	hosts []*sshConfigHost
+}
+
+type sshConfigHost struct {
+	patterns []string
+	// lower case key -> values
+	options map[string][]string
+}
+
+// DefaultSSHConfigFile
+// ~/.ssh/config
+func DefaultSSHConfigFile() string {
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".ssh", "config")
+}
+
+// LoadSSHConfig
+// read the ssh config file
+func LoadSSHConfig(file string) (*SSHConfig, error) {
+
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, errors.WithMessagef(err, "open ssh config %s", file)
+	}
+	defer f.Close()
+
+	return ParseSSHConfig(f)
+}
+
+// ParseSSHConfig
+// parse the ssh config content
+func ParseSSHConfig(r io.Reader) (*SSHConfig, error) {
+
+	var (
+		out = &SSHConfig{}
+		// the options before the first Host apply to all the hosts
+		current = &sshConfigHost{patterns: []string{"*"}, options: map[string][]string{}}
+		// the Match block not supported, skip its options
+		skip bool
+	)
+	out.hosts = append(out.hosts, current)
+
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		key, values, err := splitSSHConfigLine(line)
+		if err != nil {
+			return nil, errors.WithMessagef(err, "line %d", n)
+		}
+
+		switch key {
+		case "host":
+			current = &sshConfigHost{patterns: values, options: map[string][]string{}}
+			out.hosts = append(out.hosts, current)
+			skip = false
+		case "match":
+			skip = true
+		case "include":
+			// not supported
+		default:
+			if skip {
+				continue
+			}
+			current.options[key] = append(current.options[key], values...)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, errors.WithMessage(err, "scan ssh config")
+	}
+	return out, nil
+}
+
+// splitSSHConfigLine
+// split "Key Value" or "Key=Value"
+func splitSSHConfigLine(line string) (string, []string, error) {
+
+	i := strings.IndexAny(line, " \t=")
+	if i < 0 {
+		return "", nil, errors.Errorf("no value for %s", line)
+	}
+
+	key := strings.ToLower(line[:i])
+	rest := strings.TrimLeft(line[i:], " \t")
+	rest = strings.TrimPrefix(rest, "=")
+
+	var values []string
+	for _, v := range strings.Fields(rest) {
+		values = append(values, strings.Trim(v, `"`))
+	}
+	if len(values) == 0 {
+		return "", nil, errors.Errorf("no value for %s", key)
+	}
+	return key, values, nil
+}
+
+// match
+// the host match the patterns, the negated pattern (!pattern) take precedence
+func (h *sshConfigHost) match(host string) bool {
+
+	matched := false
+	for _, p := range h.patterns {
+
+		negated := strings.HasPrefix(p, "!")
+		ok, _ := path.Match(strings.TrimPrefix(p, "!"), host)
+		if !ok {
+			continue
+		}
+		if negated {
+			return false
+		}
+		matched = true
+	}
+	return matched
+}
+
+// Get
+// the first obtained value of the key for the host, same as ssh
+func (c *SSHConfig) Get(host string, key string) string {
+
+	key = strings.ToLower(key)
+	for _, h := range c.hosts {
+		if !h.match(host) {
+			continue
+		}
+		if v, ok := h.options[key]; ok {
+			return v[0]
+		}
+	}
+	return ""
+}
+
+// Config
+// the Config of the host alias, the auth fields except the IdentityFile should be set by the caller
+func (c *SSHConfig) Config(alias string) (*Config, error) {
+	return c.config(alias, "", "", 0)
+}
+
+func (c *SSHConfig) config(alias string, user string, port string, depth int) (*Config, error) {
+
+	if depth > maxProxyJumpDepth {
+		return nil, errors.Errorf("too many ProxyJump hops for %s", alias)
+	}
+
+	host := c.Get(alias, "HostName")
+	if len(host) == 0 {
+		host = alias
+	}
+	host = strings.Replace(host, "%h", alias, -1)
+
+	if len(port) == 0 {
+		port = c.Get(alias, "Port")
+	}
+	if len(port) == 0 {
+		port = defaultPort
+	}
+
+	if len(user) == 0 {
+		user = c.Get(alias, "User")
+	}
+	if len(user) == 0 {
+		user = os.Getenv("USER")
+	}
+
+	out := &Config{
+		Remote:         net.JoinHostPort(host, port),
+		User:           user,
+		PrivateKeyFile: expandHome(c.Get(alias, "IdentityFile")),
+		KnownHostsFile: expandHome(c.Get(alias, "UserKnownHostsFile")),
+	}
+
+	jump := c.Get(alias, "ProxyJump")
+	if len(jump) == 0 || strings.EqualFold(jump, "none") {
+		return out, nil
+	}
+
+	for _, hop := range strings.Split(jump, ",") {
+
+		hopUser, hopHost, hopPort := splitJump(hop)
+		cfg, err := c.config(hopHost, hopUser, hopPort, depth+1)
+		if err != nil {
+			return nil, errors.WithMessagef(err, "resolve ProxyJump %s", hop)
+		}
+		// the hops of the hop come first
+		out.ProxyJump = append(out.ProxyJump, cfg.ProxyJump...)
+		cfg.ProxyJump = nil
+		out.ProxyJump = append(out.ProxyJump, cfg)
+	}
+	return out, nil
+}
+
+// splitJump
+// split the [user@]host[:port]
+func splitJump(hop string) (user string, host string, port string) {
+
+	hop = strings.TrimSpace(hop)
+	if i := strings.LastIndex(hop, "@"); i >= 0 {
+		user, hop = hop[:i], hop[i+1:]
+	}
+
+	if h, p, err := net.SplitHostPort(hop); err == nil {
+		return user, h, p
+	}
+	return user, hop, ""
+}
+
+func expandHome(file string) string {
+
+	if !strings.HasPrefix(file, "~/") {
+		return file
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return file
+	}
+	return filepath.Join(home, file[2:])
+}
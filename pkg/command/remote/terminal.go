@@ -0,0 +1,116 @@
+package remote
+
+import (
+	"context"
+	"io/ioutil"
+	"syscall"
+
+	"github.com/pkg/errors"
+	"github.com/sxllwx/vulcanus/pkg/command"
+	"golang.org/x/crypto/ssh"
+)
+
+var _ command.Terminal = &Client{}
+
+// Interact
+// request a pty on the remote host, and run the cmd in it
+func (c *Client) Interact(cmd string, args []string, opts *command.TerminalOptions) error {
+
+	// the options of the caller are not changed
+	o := command.TerminalOptions{}
+	if opts != nil {
+		o = *opts
+	}
+	opts = &o
+	opts.Complete()
+
+	s, release, e := c.client.newSession(context.Background())
+	if e != nil {
+		return errors.WithMessage(e, "new session")
+	}
+	defer release()
+	defer s.Close()
+
+	modes := ssh.TerminalModes{
+		ssh.ECHO:          1,
+		ssh.TTY_OP_ISPEED: 14400,
+		ssh.TTY_OP_OSPEED: 14400,
+	}
+	if e := s.RequestPty(opts.Term, int(opts.Size.Rows), int(opts.Size.Cols), modes); e != nil {
+		return errors.WithMessage(e, "request pty")
+	}
+
+	// the copy of the session.Stdin can not be stopped, the input after return would be consumed
+	if opts.In != nil {
+		stdin, e := s.StdinPipe()
+		if e != nil {
+			return errors.WithMessage(e, "stdin pipe")
+		}
+		stop := command.CopyInput(stdin, opts.In)
+		defer stop()
+	}
+	s.Stdout = opts.Out
+	if s.Stdout == nil {
+		s.Stdout = ioutil.Discard
+	}
+	// stderr merged in the pty
+	s.Stderr = s.Stdout
+
+	if len(cmd) == 0 {
+		e = s.Shell()
+	} else {
+		e = s.Start(c.commandLine(cmd, args))
+	}
+	if e != nil {
+		return errors.WithMessage(e, "start")
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case size, ok := <-opts.Resize:
+				if !ok {
+					opts.Resize = nil
+					continue
+				}
+				s.WindowChange(int(size.Rows), int(size.Cols))
+			case sig, ok := <-opts.Signals:
+				if !ok {
+					opts.Signals = nil
+					continue
+				}
+				if name := command.SignalName(sig); len(name) != 0 {
+					s.Signal(ssh.Signal(name))
+				}
+			}
+		}
+	}()
+
+	return exitError(s.Wait())
+}
+
+// exitError
+// convert the *ssh.ExitError to *command.ExitError
+func exitError(err error) error {
+
+	e, ok := err.(*ssh.ExitError)
+	if !ok {
+		return err
+	}
+
+	out := &command.ExitError{
+		Code:   e.ExitStatus(),
+		Signal: e.Signal(),
+	}
+	if len(out.Signal) != 0 {
+		if sig, ok := command.SignalByName(out.Signal); ok {
+			out.Code = 128 + int(sig.(syscall.Signal))
+		}
+	}
+	return out
+}
@@ -0,0 +1,129 @@
+package remote
+
+import (
+	"context"
+	"io"
+	"os"
+
+	"github.com/pkg/errors"
+	"github.com/pkg/sftp"
+	"github.com/sxllwx/vulcanus/pkg/command"
+)
+
+var _ command.FileTransfer = &Client{}
+
+// sftpFS
+// the FS of the remote host over sftp
+type sftpFS struct {
+	*sftp.Client
+}
+
+func (fs sftpFS) Open(name string) (io.ReadCloser, error) {
+	return fs.Client.Open(name)
+}
+
+func (fs sftpFS) Create(name string) (io.WriteCloser, error) {
+
+	f, err := fs.Client.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		return nil, err
+	}
+	_, fsync := fs.Client.HasExtension("fsync@openssh.com")
+	return sftpFile{File: f, fsync: fsync}, nil
+}
+
+// Rename
+// use the posix-rename@openssh.com extension if the server support it,
+// otherwise the standard sftp rename which fail if the newName exist,
+// the newName is never removed first, so a failed rename keep the destination
+func (fs sftpFS) Rename(oldName string, newName string) error {
+
+	if _, ok := fs.Client.HasExtension("posix-rename@openssh.com"); ok {
+		return fs.Client.PosixRename(oldName, newName)
+	}
+	return fs.Client.Rename(oldName, newName)
+}
+
+// sftpFile
+// the remote file flushed by the fsync@openssh.com extension,
+// the Sync is a no-op if the server not support it
+type sftpFile struct {
+	*sftp.File
+	fsync bool
+}
+
+func (f sftpFile) Sync() error {
+
+	if !f.fsync {
+		return nil
+	}
+	return f.File.Sync()
+}
+
+// sftp
+// start the sftp subsystem on a new session
+func (c *Client) sftp() (*sftp.Client, func(), error) {
+
+	s, release, err := c.client.newSession(context.Background())
+	if err != nil {
+		return nil, nil, errors.WithMessage(err, "new session")
+	}
+
+	closeAll := func() {
+		s.Close()
+		release()
+	}
+
+	w, err := s.StdinPipe()
+	if err != nil {
+		closeAll()
+		return nil, nil, errors.WithMessage(err, "stdin pipe")
+	}
+	r, err := s.StdoutPipe()
+	if err != nil {
+		closeAll()
+		return nil, nil, errors.WithMessage(err, "stdout pipe")
+	}
+
+	if err := s.RequestSubsystem("sftp"); err != nil {
+		closeAll()
+		return nil, nil, errors.WithMessage(err, "request sftp subsystem")
+	}
+
+	clt, err := sftp.NewClientPipe(r, w)
+	if err != nil {
+		closeAll()
+		return nil, nil, errors.WithMessage(err, "new sftp client")
+	}
+
+	return clt, func() {
+		clt.Close()
+		closeAll()
+	}, nil
+}
+
+// Upload
+// copy the local file to the remote host over sftp
+func (c *Client) Upload(local string, remote string, opts *command.TransferOptions) error {
+
+	clt, closeAll, err := c.sftp()
+	if err != nil {
+		return err
+	}
+	defer closeAll()
+
+	return command.Transfer(command.LocalFS{}, local, sftpFS{clt}, remote, opts)
+}
+
+// Download
+// copy the file on remote host to local over sftp
+func (c *Client) Download(remote string, local string, opts *command.TransferOptions) error {
+
+	clt, closeAll, err := c.sftp()
+	if err != nil {
+		return err
+	}
+	defer closeAll()
+
+	return command.Transfer(sftpFS{clt}, remote, command.LocalFS{}, local, opts)
+}
@@ -0,0 +1,95 @@
+package remote
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sxllwx/vulcanus/pkg/command"
+	vio "github.com/sxllwx/vulcanus/pkg/io"
+)
+
+func TestTransfer(t *testing.T) {
+
+	_, cfg, cleanup := newPoolTestServer(t)
+	defer cleanup()
+
+	dir := newTempDir(t)
+	defer os.RemoveAll(dir)
+
+	content := make([]byte, 256*1024)
+	rand.Read(content)
+
+	src := filepath.Join(dir, "src")
+	if err := ioutil.WriteFile(src, content, 0751); err != nil {
+		t.Fatal(err)
+	}
+	// the exist file will be replaced
+	dst := filepath.Join(dir, "dst")
+	if err := ioutil.WriteFile(dst, []byte("old"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := NewClient(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	ft := c.(command.FileTransfer)
+
+	var w vio.MeasurableReadWriteCloser
+	err = ft.Upload(src, dst, &command.TransferOptions{
+		Verify: true,
+		Progress: func(total int64, mw vio.MeasurableReadWriteCloser) {
+			if total != int64(len(content)) {
+				t.Errorf("expect total %d, got %d", len(content), total)
+			}
+			w = mw
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.WriteMetric().TotalBytes() != uint64(len(content)) {
+		t.Fatalf("the progress not reported, %d bytes", w.WriteMetric().TotalBytes())
+	}
+
+	assertFile(t, dst, content, 0751)
+
+	back := filepath.Join(dir, "back")
+	if err := ft.Download(dst, back, &command.TransferOptions{Mode: 0600, Verify: true}); err != nil {
+		t.Fatal(err)
+	}
+	assertFile(t, back, content, 0600)
+
+	// no temp file left
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 3 {
+		t.Fatalf("expect 3 files, got %d", len(files))
+	}
+}
+
+func assertFile(t *testing.T, name string, content []byte, mode os.FileMode) {
+
+	info, err := os.Stat(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != mode {
+		t.Fatalf("expect mode %s, got %s", mode, info.Mode().Perm())
+	}
+
+	body, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(body, content) {
+		t.Fatalf("the content of %s not match", name)
+	}
+}
@@ -0,0 +1,45 @@
+package command
+
+import (
+	"os"
+	"syscall"
+)
+
+// the signal names without the SIG prefix, same as the ssh protocol (RFC 4254 6.10)
+var signalNames = map[syscall.Signal]string{
+	syscall.SIGABRT: "ABRT",
+	syscall.SIGALRM: "ALRM",
+	syscall.SIGFPE:  "FPE",
+	syscall.SIGHUP:  "HUP",
+	syscall.SIGILL:  "ILL",
+	syscall.SIGINT:  "INT",
+	syscall.SIGKILL: "KILL",
+	syscall.SIGPIPE: "PIPE",
+	syscall.SIGQUIT: "QUIT",
+	syscall.SIGSEGV: "SEGV",
+	syscall.SIGTERM: "TERM",
+}
+
+// SignalName
+// the name of signal, eg: os.Interrupt -> INT
+// empty for the signal not supported
+func SignalName(sig os.Signal) string {
+
+	s, ok := sig.(syscall.Signal)
+	if !ok {
+		return ""
+	}
+	return signalNames[s]
+}
+
+// SignalByName
+// the signal of the name, eg: INT -> os.Interrupt
+func SignalByName(name string) (os.Signal, bool) {
+
+	for s, n := range signalNames {
+		if n == name {
+			return s, true
+		}
+	}
+	return nil, false
+}
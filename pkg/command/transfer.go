@@ -0,0 +1,208 @@
+package command
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
+	"os"
+	"path"
+
+	"github.com/pkg/errors"
+	vio "github.com/sxllwx/vulcanus/pkg/io"
+)
+
+// FileTransfer
+// push and pull files between the local and the host
+type FileTransfer interface {
+	// Upload
+	// copy the local file to the host
+	Upload(local string, remote string, opts *TransferOptions) error
+	// Download
+	// copy the file on the host to local
+	Download(remote string, local string, opts *TransferOptions) error
+}
+
+// TransferOptions
+// the options of the file transfer
+type TransferOptions struct {
+	// the mode of the destination file, default is the mode of the source file
+	Mode os.FileMode
+
+	// re-read the destination file, and compare its sha256 with the source
+	Verify bool
+
+	// called when the transfer start, the writer is the measurable destination,
+	// poll its WriteMetric for the progress
+	Progress func(total int64, w vio.MeasurableReadWriteCloser)
+
+	// limit the write rate of the destination, eg: the throttle of the job shared by the transfers
+	Throttles []*vio.Throttle
+}
+
+// ErrChecksumMismatch
+// the destination file is not same as the source
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+// FS
+// the file system operations used by the transfer
+type FS interface {
+	Open(name string) (io.ReadCloser, error)
+	Create(name string) (io.WriteCloser, error)
+	Stat(name string) (os.FileInfo, error)
+	Chmod(name string, mode os.FileMode) error
+	// Rename
+	// replace the newName atomically if it exist
+	Rename(oldName string, newName string) error
+	Remove(name string) error
+}
+
+// Transfer
+// copy the file between the FS, the destination is written to a temp file in the same dir,
+// and renamed to the destination after all the content flushed
+func Transfer(src FS, srcName string, dst FS, dstName string, opts *TransferOptions) error {
+
+	if opts == nil {
+		opts = &TransferOptions{}
+	}
+
+	info, err := src.Stat(srcName)
+	if err != nil {
+		return errors.WithMessagef(err, "stat %s", srcName)
+	}
+	if !info.Mode().IsRegular() {
+		return errors.Errorf("%s is not a regular file", srcName)
+	}
+
+	mode := opts.Mode
+	if mode == 0 {
+		mode = info.Mode().Perm()
+	}
+
+	r, err := src.Open(srcName)
+	if err != nil {
+		return errors.WithMessagef(err, "open %s", srcName)
+	}
+	defer r.Close()
+
+	tmp := tempName(dstName)
+	w, err := dst.Create(tmp)
+	if err != nil {
+		return errors.WithMessagef(err, "create %s", tmp)
+	}
+
+	mw := vio.DecorateReadWriteCloser(writeOnly{w})
+	if len(opts.Throttles) != 0 {
+		mw = vio.ThrottleReadWriteCloser(mw, opts.Throttles...)
+	}
+	if opts.Progress != nil {
+		opts.Progress(info.Size(), mw)
+	}
+
+	srcHash := sha256.New()
+	_, err = io.Copy(mw, io.TeeReader(r, srcHash))
+	if s, ok := w.(syncer); ok && err == nil {
+		err = errors.WithMessage(s.Sync(), "sync")
+	}
+	if e := mw.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		dst.Remove(tmp)
+		return errors.WithMessagef(err, "copy %s to %s", srcName, tmp)
+	}
+
+	if err := dst.Chmod(tmp, mode); err != nil {
+		dst.Remove(tmp)
+		return errors.WithMessagef(err, "chmod %s", tmp)
+	}
+
+	if opts.Verify {
+		if err := verify(dst, tmp, srcHash); err != nil {
+			dst.Remove(tmp)
+			return err
+		}
+	}
+
+	if err := dst.Rename(tmp, dstName); err != nil {
+		dst.Remove(tmp)
+		return errors.WithMessagef(err, "rename %s to %s", tmp, dstName)
+	}
+	return nil
+}
+
+// verify
+// the sha256 of the file must equal to the expected
+func verify(fs FS, name string, expected hash.Hash) error {
+
+	r, err := fs.Open(name)
+	if err != nil {
+		return errors.WithMessagef(err, "open %s", name)
+	}
+	defer r.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return errors.WithMessagef(err, "read %s", name)
+	}
+
+	if !bytes.Equal(h.Sum(nil), expected.Sum(nil)) {
+		return errors.WithMessagef(ErrChecksumMismatch, "expect sha256 %x, got %x", expected.Sum(nil), h.Sum(nil))
+	}
+	return nil
+}
+
+// tempName
+// the temp file in the same dir of the name, so the rename is atomic
+func tempName(name string) string {
+
+	b := make([]byte, 6)
+	rand.Read(b)
+	return path.Join(path.Dir(name), "."+path.Base(name)+".vulcanus-"+hex.EncodeToString(b))
+}
+
+// syncer
+// the file flushed to the stable storage before renamed, eg: *os.File
+type syncer interface {
+	Sync() error
+}
+
+// writeOnly
+// the measurable decorator need a io.ReadWriteCloser
+type writeOnly struct {
+	io.WriteCloser
+}
+
+func (writeOnly) Read(b []byte) (int, error) {
+	return 0, io.EOF
+}
+
+// LocalFS
+// the FS of the local file system
+type LocalFS struct{}
+
+func (LocalFS) Open(name string) (io.ReadCloser, error) {
+	return os.Open(name)
+}
+
+func (LocalFS) Create(name string) (io.WriteCloser, error) {
+	return os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+}
+
+func (LocalFS) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func (LocalFS) Chmod(name string, mode os.FileMode) error {
+	return os.Chmod(name, mode)
+}
+
+func (LocalFS) Rename(oldName string, newName string) error {
+	return os.Rename(oldName, newName)
+}
+
+func (LocalFS) Remove(name string) error {
+	return os.Remove(name)
+}
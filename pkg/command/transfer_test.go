@@ -0,0 +1,60 @@
+package command
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+// corruptFS
+// flip the content on read back
+type corruptFS struct {
+	LocalFS
+	created map[string]bool
+}
+
+func (fs corruptFS) Create(name string) (io.WriteCloser, error) {
+	fs.created[name] = true
+	return fs.LocalFS.Create(name)
+}
+
+func (fs corruptFS) Open(name string) (io.ReadCloser, error) {
+	if !fs.created[name] {
+		return fs.LocalFS.Open(name)
+	}
+	return ioutil.NopCloser(bytes.NewReader([]byte("corrupted"))), nil
+}
+
+func TestTransferVerify(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "vulcanus-transfer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "src")
+	if err := ioutil.WriteFile(src, []byte("content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	dst := filepath.Join(dir, "dst")
+	err = Transfer(LocalFS{}, src, corruptFS{created: map[string]bool{}}, dst, &TransferOptions{Verify: true})
+	if errors.Cause(err) != ErrChecksumMismatch {
+		t.Fatalf("expect checksum mismatch, got %v", err)
+	}
+
+	// the destination and temp file not left
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Fatalf("expect only the src left, got %d files", len(files))
+	}
+}
@@ -6,8 +6,9 @@ import (
 	"time"
 )
 
-// internal measurable interface
-type measurable interface {
+// Metric
+// the read or write metric of a measurable stream
+type Metric interface {
 
 	// real time metric
 	BytesPerSecond() uint64
@@ -19,22 +20,33 @@ type measurable interface {
 	// Read/Write bytes per second
 	AverageBytesPerSecond() float64
 
+	// Done
+	// closed after the stream closed
+	Done() <-chan struct{}
+}
+
+// internal measurable interface
+type measurable interface {
+	Metric
+
 	// calculate the metric
 	addTotal(uint64)
 	stop()
+}
 
-	// Done
-	Done() <-chan struct{}
+// Measurable
+// the stream with the read and write metric
+type Measurable interface {
+	ReadMetric() Metric
+	WriteMetric() Metric
 }
 
 type MeasurableReadWriteCloser interface {
-	ReadMetric() measurable
-	WriteMetric() measurable
+	Measurable
 	io.ReadWriteCloser
 }
 
 type MeasurableConn interface {
-	ReadMetric() measurable
-	WriteMetric() measurable
+	Measurable
 	net.Conn
 }
@@ -12,20 +12,26 @@ import (
 // basic model of the metric of everyone call be measurable
 type defaultMeasurableSuite struct {
 
+	// metric value, keep the 64-bit fields first for the atomic on 32-bit platform
+	totalBytes uint64
+	bps        uint64
+	// the unix nano of the stop, zero if running
+	stopped int64
+
 	// lifecycle manager
 	ctx    context.Context
 	cancel context.CancelFunc
 
-	// metric value
-	totalBytes uint64
-	bps        uint64
-
 	start time.Time
 
 	ticker *time.Ticker
 }
 
 func (r *defaultMeasurableSuite) Cost() time.Duration {
+
+	if stopped := atomic.LoadInt64(&r.stopped); stopped != 0 {
+		return time.Unix(0, stopped).Sub(r.start)
+	}
 	return time.Since(r.start)
 }
 
@@ -38,7 +44,7 @@ func (r *defaultMeasurableSuite) BytesPerSecond() uint64 {
 }
 
 func (r *defaultMeasurableSuite) AverageBytesPerSecond() float64 {
-	return float64(atomic.LoadUint64(&r.totalBytes)) / time.Since(r.start).Seconds()
+	return float64(atomic.LoadUint64(&r.totalBytes)) / r.Cost().Seconds()
 }
 
 func (r *defaultMeasurableSuite) addTotal(t uint64) {
@@ -46,6 +52,8 @@ func (r *defaultMeasurableSuite) addTotal(t uint64) {
 }
 
 func (r *defaultMeasurableSuite) stop() {
+	// the cost is frozen at the first stop
+	atomic.CompareAndSwapInt64(&r.stopped, 0, time.Now().UnixNano())
 	r.cancel()
 }
 
@@ -103,11 +111,11 @@ func DecorateReadWriteCloser(rwc io.ReadWriteCloser) MeasurableReadWriteCloser {
 	}
 }
 
-func (rwc *readWriteCloser) ReadMetric() measurable {
+func (rwc *readWriteCloser) ReadMetric() Metric {
 	return rwc.rm
 }
 
-func (rwc *readWriteCloser) WriteMetric() measurable {
+func (rwc *readWriteCloser) WriteMetric() Metric {
 	return rwc.wm
 }
 
@@ -154,11 +162,11 @@ func DecorateConn(c net.Conn) MeasurableConn {
 	}
 }
 
-func (c *conn) ReadMetric() measurable {
+func (c *conn) ReadMetric() Metric {
 	return c.rm
 }
 
-func (c *conn) WriteMetric() measurable {
+func (c *conn) WriteMetric() Metric {
 	return c.wm
 }
 
@@ -193,29 +201,17 @@ func (c *conn) Close() error {
 }
 
 // MeasurableTCPDialer
-// Dial address use tcp, but got a MeasurableConn
+// Dial address use tcp, but got a MeasurableConn,
+// the dial is canceled by the ctx, and the error of the ctx is returned
 func MeasurableTCPDialer(ctx context.Context, address string) (net.Conn, error) {
 
-	var (
-		out net.Conn
-		err error
-	)
-
-	c := make(chan struct{})
-
-	go func() {
-		out, err = net.Dial("tcp", address)
-		close(c)
-	}()
-
-	select {
-	case <-ctx.Done():
-		return nil, context.DeadlineExceeded
-	case <-c:
-
-		if err != nil {
-			return nil, err
+	d := &net.Dialer{}
+	out, err := d.DialContext(ctx, "tcp", address)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
 		}
-		return DecorateConn(out), nil
+		return nil, err
 	}
+	return DecorateConn(out), nil
 }
@@ -0,0 +1,273 @@
+package io
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Labels
+// the labels of the registered stream, the streams with the same labels are aggregated
+type Labels struct {
+	// the remote side, eg: 10.0.0.1:22
+	Peer string
+	// what the stream used for, eg: ssh, sftp, sync
+	Purpose string
+}
+
+// DefaultDurationBuckets
+// the upper bounds (seconds) of the stream duration histogram
+var DefaultDurationBuckets = []float64{0.1, 0.5, 1, 5, 10, 30, 60, 300, 1800, 3600}
+
+// DefaultRegistry
+// the registry exposed by MetricsHandler
+var DefaultRegistry = NewRegistry(DefaultDurationBuckets)
+
+// MetricsHandler
+// the DefaultRegistry in the prometheus text format
+func MetricsHandler() http.Handler {
+	return DefaultRegistry
+}
+
+// series
+// the aggregated metrics of the streams with the same labels
+type series struct {
+	// the bytes of the closed streams
+	closedRead    uint64
+	closedWritten uint64
+
+	// the duration histogram of the closed streams
+	buckets []uint64
+	sum     float64
+	count   uint64
+
+	// the open streams
+	open map[Measurable]struct{}
+}
+
+// Registry
+// aggregate the registered streams by labels, the closed streams are folded into the counters and the histogram,
+// the series without open streams is exported by the next scrape then removed, so the peers are not kept forever
+type Registry struct {
+	buckets []float64
+
+	mu     sync.Mutex
+	series map[Labels]*series
+}
+
+// NewRegistry
+// the registry with the duration histogram buckets in seconds
+func NewRegistry(buckets []float64) *Registry {
+
+	b := append([]float64(nil), buckets...)
+	sort.Float64s(b)
+	return &Registry{
+		buckets: b,
+		series:  map[Labels]*series{},
+	}
+}
+
+func (r *Registry) get(labels Labels) *series {
+
+	s, ok := r.series[labels]
+	if !ok {
+		s = &series{
+			buckets: make([]uint64, len(r.buckets)),
+			open:    map[Measurable]struct{}{},
+		}
+		r.series[labels] = s
+	}
+	return s
+}
+
+// Register
+// track the stream until its metrics done (the stream closed)
+func (r *Registry) Register(labels Labels, m Measurable) {
+
+	r.mu.Lock()
+	r.get(labels).open[m] = struct{}{}
+	r.mu.Unlock()
+
+	go func() {
+		<-m.ReadMetric().Done()
+		<-m.WriteMetric().Done()
+		r.fold(labels, m)
+	}()
+}
+
+// fold
+// move the closed stream to the counters and the histogram
+func (r *Registry) fold(labels Labels, m Measurable) {
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	s, ok := r.series[labels]
+	if !ok {
+		return
+	}
+	if _, ok := s.open[m]; !ok {
+		return
+	}
+	delete(s.open, m)
+
+	s.closedRead += m.ReadMetric().TotalBytes()
+	s.closedWritten += m.WriteMetric().TotalBytes()
+
+	d := math.Max(m.ReadMetric().Cost().Seconds(), m.WriteMetric().Cost().Seconds())
+	for i, upper := range r.buckets {
+		if d <= upper {
+			s.buckets[i]++
+		}
+	}
+	s.sum += d
+	s.count++
+}
+
+// DecorateConn
+// the io.DecorateConn registered with the labels
+func (r *Registry) DecorateConn(c net.Conn, labels Labels) MeasurableConn {
+
+	out := DecorateConn(c)
+	r.Register(labels, out)
+	return out
+}
+
+// DecorateReadWriteCloser
+// the io.DecorateReadWriteCloser registered with the labels
+func (r *Registry) DecorateReadWriteCloser(rwc io.ReadWriteCloser, labels Labels) MeasurableReadWriteCloser {
+
+	out := DecorateReadWriteCloser(rwc)
+	r.Register(labels, out)
+	return out
+}
+
+// sample
+// the value of a series at the scrape
+type sample struct {
+	labels Labels
+
+	read, written       uint64
+	readBPS, writtenBPS uint64
+	open                int
+
+	buckets []uint64
+	sum     float64
+	count   uint64
+}
+
+// samples
+// the values of the series, the series without open streams is removed after sampled
+func (r *Registry) samples() []sample {
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	out := make([]sample, 0, len(r.series))
+	for labels, s := range r.series {
+
+		v := sample{
+			labels:  labels,
+			read:    s.closedRead,
+			written: s.closedWritten,
+			open:    len(s.open),
+			buckets: append([]uint64(nil), s.buckets...),
+			sum:     s.sum,
+			count:   s.count,
+		}
+		for m := range s.open {
+			v.read += m.ReadMetric().TotalBytes()
+			v.written += m.WriteMetric().TotalBytes()
+			v.readBPS += m.ReadMetric().BytesPerSecond()
+			v.writtenBPS += m.WriteMetric().BytesPerSecond()
+		}
+		out = append(out, v)
+
+		if len(s.open) == 0 {
+			delete(r.series, labels)
+		}
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].labels.Peer != out[j].labels.Peer {
+			return out[i].labels.Peer < out[j].labels.Peer
+		}
+		return out[i].labels.Purpose < out[j].labels.Purpose
+	})
+	return out
+}
+
+// the names of the exported metrics
+const (
+	metricReadBytes       = "vulcanus_io_read_bytes_total"
+	metricWrittenBytes    = "vulcanus_io_written_bytes_total"
+	metricReadRate        = "vulcanus_io_read_bytes_per_second"
+	metricWrittenRate     = "vulcanus_io_written_bytes_per_second"
+	metricOpenStreams     = "vulcanus_io_open_streams"
+	metricStreamDurations = "vulcanus_io_stream_duration_seconds"
+)
+
+// WriteTo
+// write the metrics in the prometheus text exposition format
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+
+	samples := r.samples()
+	buf := &bytes.Buffer{}
+
+	writeMetric := func(name string, typ string, help string, value func(sample) string) {
+		fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+		for _, s := range samples {
+			fmt.Fprintf(buf, "%s{%s} %s\n", name, formatLabels(s.labels), value(s))
+		}
+	}
+
+	writeMetric(metricReadBytes, "counter", "The bytes read from the streams.",
+		func(s sample) string { return strconv.FormatUint(s.read, 10) })
+	writeMetric(metricWrittenBytes, "counter", "The bytes written to the streams.",
+		func(s sample) string { return strconv.FormatUint(s.written, 10) })
+	writeMetric(metricReadRate, "gauge", "The read rate of the open streams.",
+		func(s sample) string { return strconv.FormatUint(s.readBPS, 10) })
+	writeMetric(metricWrittenRate, "gauge", "The write rate of the open streams.",
+		func(s sample) string { return strconv.FormatUint(s.writtenBPS, 10) })
+	writeMetric(metricOpenStreams, "gauge", "The open streams.",
+		func(s sample) string { return strconv.Itoa(s.open) })
+
+	name := metricStreamDurations
+	fmt.Fprintf(buf, "# HELP %s The duration of the closed streams.\n# TYPE %s histogram\n", name, name)
+	for _, s := range samples {
+		labels := formatLabels(s.labels)
+		for i, upper := range r.buckets {
+			fmt.Fprintf(buf, "%s_bucket{%s,le=\"%s\"} %d\n", name, labels, formatFloat(upper), s.buckets[i])
+		}
+		fmt.Fprintf(buf, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, labels, s.count)
+		fmt.Fprintf(buf, "%s_sum{%s} %s\n", name, labels, formatFloat(s.sum))
+		fmt.Fprintf(buf, "%s_count{%s} %d\n", name, labels, s.count)
+	}
+
+	return buf.WriteTo(w)
+}
+
+// ServeHTTP
+// expose the metrics for the prometheus scrape
+func (r *Registry) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.WriteTo(w)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatLabels(l Labels) string {
+	return fmt.Sprintf(`peer="%s",purpose="%s"`, labelEscaper.Replace(l.Peer), labelEscaper.Replace(l.Purpose))
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
@@ -0,0 +1,99 @@
+package io
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRegistry(t *testing.T) {
+
+	r := NewRegistry([]float64{1, 10})
+
+	closed := r.DecorateReadWriteCloser(&bufferRWC{}, Labels{Peer: "10.0.0.1:22", Purpose: "sftp"})
+	closed.Write(make([]byte, 100))
+	closed.Close()
+
+	open := r.DecorateReadWriteCloser(&bufferRWC{}, Labels{Peer: "10.0.0.1:22", Purpose: "sftp"})
+	defer open.Close()
+	open.Write(make([]byte, 20))
+
+	other := r.DecorateReadWriteCloser(&bufferRWC{}, Labels{Peer: `a "b"`, Purpose: "sync"})
+	defer other.Close()
+
+	// wait the closed stream folded
+	deadline := time.Now().Add(time.Second)
+	for {
+		samples := r.samples()
+		if len(samples) == 2 && samples[0].count == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expect the closed stream folded, got %+v", samples)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Fatalf("unexpected content type %s", ct)
+	}
+
+	body := w.Body.String()
+	for _, line := range []string{
+		"# TYPE vulcanus_io_written_bytes_total counter",
+		`vulcanus_io_written_bytes_total{peer="10.0.0.1:22",purpose="sftp"} 120`,
+		`vulcanus_io_open_streams{peer="10.0.0.1:22",purpose="sftp"} 1`,
+		`vulcanus_io_open_streams{peer="a \"b\"",purpose="sync"} 1`,
+		"# TYPE vulcanus_io_stream_duration_seconds histogram",
+		`vulcanus_io_stream_duration_seconds_bucket{peer="10.0.0.1:22",purpose="sftp",le="1"} 1`,
+		`vulcanus_io_stream_duration_seconds_bucket{peer="10.0.0.1:22",purpose="sftp",le="+Inf"} 1`,
+		`vulcanus_io_stream_duration_seconds_count{peer="10.0.0.1:22",purpose="sftp"} 1`,
+		`vulcanus_io_stream_duration_seconds_count{peer="a \"b\"",purpose="sync"} 0`,
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Fatalf("expect %q in\n%s", line, body)
+		}
+	}
+}
+
+func TestRegistryRemoveIdle(t *testing.T) {
+
+	r := NewRegistry(DefaultDurationBuckets)
+
+	rwc := r.DecorateReadWriteCloser(&bufferRWC{}, Labels{Peer: "10.0.0.1:22", Purpose: "ssh"})
+	rwc.Write(make([]byte, 10))
+	rwc.Close()
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		r.mu.Lock()
+		s := r.series[Labels{Peer: "10.0.0.1:22", Purpose: "ssh"}]
+		folded := s != nil && s.count == 1
+		r.mu.Unlock()
+		if folded {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expect the closed stream folded")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// the closed peer is exported once
+	buf := &bytes.Buffer{}
+	r.WriteTo(buf)
+	if !strings.Contains(buf.String(), `vulcanus_io_written_bytes_total{peer="10.0.0.1:22",purpose="ssh"} 10`) {
+		t.Fatalf("expect the closed peer exported\n%s", buf)
+	}
+
+	buf.Reset()
+	r.WriteTo(buf)
+	if strings.Contains(buf.String(), "10.0.0.1:22") || len(r.series) != 0 {
+		t.Fatalf("expect the closed peer removed\n%s", buf)
+	}
+}
@@ -0,0 +1,309 @@
+package io
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var ErrThrottleClosed = errors.New("throttled stream already closed")
+
+// Limiter
+// the token bucket of bytes, the rate can be changed at runtime,
+// share a Limiter between many readers or writers to limit their total rate
+type Limiter struct {
+	mu sync.Mutex
+	// bytes per second, non-positive means unlimited
+	rate float64
+	// the max bytes taken at once
+	burst int
+	// the burst follow the rate, see NewLimiter
+	autoBurst bool
+	tokens    float64
+	last      time.Time
+}
+
+// NewLimiter
+// the limiter of bytesPerSecond, the burst is the max bytes sent at once,
+// the non-positive burst means the bytes of 100ms
+func NewLimiter(bytesPerSecond int64, burst int) *Limiter {
+
+	out := &Limiter{last: time.Now()}
+	out.SetLimit(bytesPerSecond, burst)
+	out.tokens = float64(out.burst)
+	return out
+}
+
+// SetLimit
+// change the rate and burst, the waiters get the new rate after their current wait
+func (l *Limiter) SetLimit(bytesPerSecond int64, burst int) {
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.advance(time.Now())
+
+	l.autoBurst = burst <= 0
+	if burst <= 0 {
+		burst = int(bytesPerSecond / 10)
+	}
+	if burst <= 0 {
+		burst = 1
+	}
+
+	l.rate = float64(bytesPerSecond)
+	l.burst = burst
+	if l.tokens > float64(burst) {
+		l.tokens = float64(burst)
+	}
+}
+
+// SetRate
+// change the rate, the burst set by user is kept
+func (l *Limiter) SetRate(bytesPerSecond int64) {
+
+	l.mu.Lock()
+	burst := l.burst
+	if l.autoBurst {
+		burst = 0
+	}
+	l.mu.Unlock()
+
+	l.SetLimit(bytesPerSecond, burst)
+}
+
+// Rate
+// the bytes per second, non-positive means unlimited
+func (l *Limiter) Rate() int64 {
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return int64(l.rate)
+}
+
+// Burst
+// the max bytes taken at once
+func (l *Limiter) Burst() int {
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.burst
+}
+
+// advance
+// fill the tokens since the last time
+func (l *Limiter) advance(now time.Time) {
+
+	if l.rate > 0 {
+		l.tokens = math.Min(l.tokens+now.Sub(l.last).Seconds()*l.rate, float64(l.burst))
+	}
+	l.last = now
+}
+
+// reserve
+// take n tokens in advance, the caller should wait the returned duration
+func (l *Limiter) reserve(n int) time.Duration {
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.rate <= 0 {
+		return 0
+	}
+
+	l.advance(time.Now())
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+// WaitN
+// wait until n bytes allowed, the n larger than the burst is allowed, but wait longer
+func (l *Limiter) WaitN(ctx context.Context, n int) error {
+
+	wait := l.reserve(n)
+	if wait <= 0 {
+		return nil
+	}
+
+	t := time.NewTimer(wait)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Throttle
+// the limiters of the read and write direction, the nil limiter means unlimited
+type Throttle struct {
+	Read  *Limiter
+	Write *Limiter
+}
+
+// NewThrottle
+// the throttle of bytes per second, the non-positive rate means unlimited
+func NewThrottle(readBytesPerSecond int64, writeBytesPerSecond int64) *Throttle {
+
+	return &Throttle{
+		Read:  NewLimiter(readBytesPerSecond, 0),
+		Write: NewLimiter(writeBytesPerSecond, 0),
+	}
+}
+
+// throttler
+// wait all the limiters of the direction, eg: the per conn throttle and the group throttle
+type throttler struct {
+	readers []*Limiter
+	writers []*Limiter
+
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func newThrottler(throttles []*Throttle) *throttler {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	out := &throttler{ctx: ctx, cancel: cancel}
+	for _, t := range throttles {
+		if t == nil {
+			continue
+		}
+		if t.Read != nil {
+			out.readers = append(out.readers, t.Read)
+		}
+		if t.Write != nil {
+			out.writers = append(out.writers, t.Write)
+		}
+	}
+	return out
+}
+
+// chunk
+// the max bytes of a single read or write, so a large buffer do not burst over the limit
+func chunk(limiters []*Limiter, n int) int {
+
+	for _, l := range limiters {
+		if l.Rate() > 0 {
+			if b := l.Burst(); b < n {
+				n = b
+			}
+		}
+	}
+	return n
+}
+
+func wait(ctx context.Context, limiters []*Limiter, n int) error {
+
+	for _, l := range limiters {
+		if err := l.WaitN(ctx, n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// read
+// read at most a chunk, then wait the read bytes allowed
+func (t *throttler) read(r func([]byte) (int, error), b []byte) (int, error) {
+
+	if len(t.readers) == 0 || len(b) == 0 {
+		return r(b)
+	}
+
+	n, err := r(b[:chunk(t.readers, len(b))])
+	if n > 0 {
+		// the closed throttler stop waiting, the read bytes are still returned
+		wait(t.ctx, t.readers, n)
+	}
+	return n, err
+}
+
+// write
+// write chunk by chunk, wait every chunk allowed before written
+func (t *throttler) write(w func([]byte) (int, error), b []byte) (int, error) {
+
+	if len(t.writers) == 0 {
+		return w(b)
+	}
+
+	written := 0
+	for written < len(b) {
+
+		size := chunk(t.writers, len(b)-written)
+		if err := wait(t.ctx, t.writers, size); err != nil {
+			return written, ErrThrottleClosed
+		}
+
+		n, err := w(b[written : written+size])
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// ThrottleReadWriteCloser
+// limit the rate of the rwc by all the throttles, eg: its own throttle and the group throttle
+func ThrottleReadWriteCloser(rwc MeasurableReadWriteCloser, throttles ...*Throttle) MeasurableReadWriteCloser {
+	return &throttledReadWriteCloser{
+		MeasurableReadWriteCloser: rwc,
+		t:                         newThrottler(throttles),
+	}
+}
+
+type throttledReadWriteCloser struct {
+	MeasurableReadWriteCloser
+	t *throttler
+}
+
+func (rwc *throttledReadWriteCloser) Read(b []byte) (int, error) {
+	return rwc.t.read(rwc.MeasurableReadWriteCloser.Read, b)
+}
+
+func (rwc *throttledReadWriteCloser) Write(b []byte) (int, error) {
+	return rwc.t.write(rwc.MeasurableReadWriteCloser.Write, b)
+}
+
+func (rwc *throttledReadWriteCloser) Close() error {
+	rwc.t.cancel()
+	return rwc.MeasurableReadWriteCloser.Close()
+}
+
+// ThrottleConn
+// limit the rate of the conn by all the throttles, eg: its own throttle and the group throttle
+func ThrottleConn(c MeasurableConn, throttles ...*Throttle) MeasurableConn {
+	return &throttledConn{
+		MeasurableConn: c,
+		t:              newThrottler(throttles),
+	}
+}
+
+type throttledConn struct {
+	MeasurableConn
+	t *throttler
+}
+
+func (c *throttledConn) Read(b []byte) (int, error) {
+	return c.t.read(c.MeasurableConn.Read, b)
+}
+
+func (c *throttledConn) Write(b []byte) (int, error) {
+	return c.t.write(c.MeasurableConn.Write, b)
+}
+
+func (c *throttledConn) Close() error {
+	c.t.cancel()
+	return c.MeasurableConn.Close()
+}
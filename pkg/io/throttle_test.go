@@ -0,0 +1,137 @@
+package io
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+	"time"
+)
+
+type bufferRWC struct {
+	mu sync.Mutex
+	bytes.Buffer
+}
+
+func (b *bufferRWC) Write(p []byte) (int, error) {
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.Buffer.Write(p)
+}
+
+func (b *bufferRWC) Close() error { return nil }
+
+func TestThrottleWrite(t *testing.T) {
+
+	buf := &bufferRWC{}
+	rwc := ThrottleReadWriteCloser(DecorateReadWriteCloser(buf), NewThrottle(0, 20*1024))
+	defer rwc.Close()
+
+	start := time.Now()
+	n, err := rwc.Write(make([]byte, 10*1024))
+	if err != nil || n != 10*1024 {
+		t.Fatalf("unexpected write %d %v", n, err)
+	}
+
+	// the first 2KB by the burst, the 8KB left at 20KB/s
+	if d := time.Since(start); d < 300*time.Millisecond || d > 2*time.Second {
+		t.Fatalf("expect the write throttled, took %s", d)
+	}
+	if rwc.WriteMetric().TotalBytes() != 10*1024 {
+		t.Fatalf("expect the write measured, got %d", rwc.WriteMetric().TotalBytes())
+	}
+}
+
+func TestThrottleRead(t *testing.T) {
+
+	buf := &bufferRWC{}
+	buf.Buffer.Write(make([]byte, 6*1024))
+
+	rwc := ThrottleReadWriteCloser(DecorateReadWriteCloser(buf), NewThrottle(10*1024, 0))
+	defer rwc.Close()
+
+	start := time.Now()
+	total := 0
+	b := make([]byte, 4*1024)
+	for total < 6*1024 {
+		n, err := rwc.Read(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// at most a burst at once
+		if n > 1024 {
+			t.Fatalf("expect read at most the burst, got %d", n)
+		}
+		total += n
+	}
+
+	// the first 1KB by the burst, the 5KB left at 10KB/s
+	if d := time.Since(start); d < 400*time.Millisecond {
+		t.Fatalf("expect the read throttled, took %s", d)
+	}
+}
+
+func TestThrottleGroup(t *testing.T) {
+
+	group := NewThrottle(0, 20*1024)
+
+	start := time.Now()
+	wg := sync.WaitGroup{}
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			rwc := ThrottleReadWriteCloser(DecorateReadWriteCloser(&bufferRWC{}), NewThrottle(0, 0), group)
+			defer rwc.Close()
+
+			if _, err := rwc.Write(make([]byte, 5*1024)); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// 10KB shared the 20KB/s
+	if d := time.Since(start); d < 300*time.Millisecond {
+		t.Fatalf("expect the group throttled, took %s", d)
+	}
+
+	// unlimited at runtime
+	group.Write.SetRate(0)
+
+	start = time.Now()
+	rwc := ThrottleReadWriteCloser(DecorateReadWriteCloser(&bufferRWC{}), group)
+	defer rwc.Close()
+
+	if _, err := rwc.Write(make([]byte, 1024*1024)); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d > 100*time.Millisecond {
+		t.Fatalf("expect unlimited, took %s", d)
+	}
+}
+
+func TestThrottleClose(t *testing.T) {
+
+	rwc := ThrottleReadWriteCloser(DecorateReadWriteCloser(&bufferRWC{}), NewThrottle(0, 1024))
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := rwc.Write(make([]byte, 100*1024))
+		done <- err
+	}()
+
+	time.Sleep(20 * time.Millisecond)
+	rwc.Close()
+
+	select {
+	case err := <-done:
+		if err != ErrThrottleClosed {
+			t.Fatalf("expect throttle closed, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expect the write stopped by close")
+	}
+}
@@ -0,0 +1,210 @@
+package net
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	vio "github.com/sxllwx/vulcanus/pkg/io"
+)
+
+// DialLayer
+// wrap the dialed conn, eg: track or measure it, the conn should be closed if the error returned
+type DialLayer func(net.Conn) (net.Conn, error)
+
+// TrackLayer
+// track the dialed conn by the tracker
+func TrackLayer(t *ConnTracker) DialLayer {
+	return t.Track
+}
+
+// MeasureLayer
+// wrap the dialed conn by io.DecorateConn
+func MeasureLayer() DialLayer {
+	return func(conn net.Conn) (net.Conn, error) {
+		return vio.DecorateConn(conn), nil
+	}
+}
+
+// RegistryLayer
+// wrap the dialed conn by the registry, labeled by the remote address and the purpose
+func RegistryLayer(r *vio.Registry, purpose string) DialLayer {
+	return func(conn net.Conn) (net.Conn, error) {
+		return r.DecorateConn(conn, vio.Labels{Peer: conn.RemoteAddr().String(), Purpose: purpose}), nil
+	}
+}
+
+// Dialer
+// the net.Dialer with retry, TLS and layers, the zero value is ready to use,
+// the DialContext can be used as the http.Transport.DialContext
+type Dialer struct {
+	// the timeout of every attempt, include the TLS handshake
+	Timeout time.Duration
+	// the keepalive period of the tcp conn, zero means the default of net.Dialer, negative means disabled
+	KeepAlive time.Duration
+	// the delay before the fallback to the other ip family (happy eyeballs),
+	// zero means the default of net.Dialer, negative means disabled
+	FallbackDelay time.Duration
+
+	// the retries after the first failed attempt,
+	// the backoff doubled every retry until MaxBackoff
+	Retries        int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+
+	// the TLS client config, nil means plain conn,
+	// the empty ServerName is set by the dialed host
+	TLSConfig *tls.Config
+
+	// applied to the raw conn in order before the TLS handshake,
+	// so the tracker and metrics see the wire bytes
+	Layers []DialLayer
+}
+
+// Dial
+// dial without context
+func (d *Dialer) Dial(network string, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+// DialContext
+// dial the address, retry the failed attempt until the Retries exhausted or the ctx done,
+// only the network errors may recover are retried, see retryable,
+// the errors of the layers and the TLS handshake are returned immediately
+func (d *Dialer) DialContext(ctx context.Context, network string, address string) (net.Conn, error) {
+
+	backoff := d.InitialBackoff
+	if backoff <= 0 {
+		backoff = 100 * time.Millisecond
+	}
+	maxBackoff := d.MaxBackoff
+	if maxBackoff <= 0 {
+		maxBackoff = 10 * time.Second
+	}
+
+	for i := 0; ; i++ {
+
+		conn, retry, err := d.dial(ctx, network, address)
+		if err == nil {
+			return conn, nil
+		}
+		if ctx.Err() != nil || !retry {
+			return nil, err
+		}
+		if i >= d.Retries {
+			if d.Retries > 0 {
+				return nil, errors.WithMessagef(err, "give up after %d retries", d.Retries)
+			}
+			return nil, err
+		}
+
+		t := time.NewTimer(backoff)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return nil, errors.WithMessage(ctx.Err(), err.Error())
+		}
+
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// retryable
+// the dial error may recover later, eg: timeout, reset, unreachable, the temporary dns failure,
+// the refused conn and the unknown host are not retried, they are likely a wrong address
+func retryable(err error) bool {
+
+	switch e := err.(type) {
+	case *net.DNSError:
+		return e.IsTimeout || e.IsTemporary
+	case *net.OpError:
+		if se, ok := e.Err.(*os.SyscallError); ok && se.Err == syscall.ECONNREFUSED {
+			return false
+		}
+		return retryable(e.Err)
+	}
+	return true
+}
+
+// dial
+// a single attempt, the bool reports the error may recover by retry
+func (d *Dialer) dial(ctx context.Context, network string, address string) (net.Conn, bool, error) {
+
+	if d.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.Timeout)
+		defer cancel()
+	}
+
+	nd := &net.Dialer{
+		KeepAlive:     d.KeepAlive,
+		FallbackDelay: d.FallbackDelay,
+	}
+
+	conn, err := nd.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, retryable(err), err
+	}
+
+	for _, layer := range d.Layers {
+		wrapped, err := layer(conn)
+		if err != nil {
+			conn.Close()
+			return nil, false, err
+		}
+		conn = wrapped
+	}
+
+	if d.TLSConfig == nil {
+		return conn, false, nil
+	}
+
+	cfg := d.TLSConfig.Clone()
+	if len(cfg.ServerName) == 0 {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			host = address
+		}
+		cfg.ServerName = host
+	}
+
+	tc := tls.Client(conn, cfg)
+	if err := handshake(ctx, tc); err != nil {
+		conn.Close()
+		return nil, false, err
+	}
+	return tc, false, nil
+}
+
+// handshake
+// the TLS handshake canceled by the ctx
+func handshake(ctx context.Context, tc *tls.Conn) error {
+
+	if deadline, ok := ctx.Deadline(); ok {
+		tc.SetDeadline(deadline)
+		defer tc.SetDeadline(time.Time{})
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- tc.Handshake()
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		// unblock the handshake
+		tc.Close()
+		<-done
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,173 @@
+package net
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	vio "github.com/sxllwx/vulcanus/pkg/io"
+)
+
+func TestDialerLayers(t *testing.T) {
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer s.Close()
+
+	tracker := NewConnTracker(0, 0)
+	d := &Dialer{
+		Timeout: time.Second,
+		Layers:  []DialLayer{TrackLayer(tracker), MeasureLayer()},
+	}
+
+	var dialed net.Conn
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := d.DialContext(ctx, network, addr)
+			dialed = conn
+			return conn, err
+		},
+	}}
+
+	resp, err := client.Get(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "ok" {
+		t.Fatalf("unexpected body %q", body)
+	}
+
+	if tracker.Len() != 1 {
+		t.Fatalf("expect the conn tracked, got %d", tracker.Len())
+	}
+	mc, ok := dialed.(vio.MeasurableConn)
+	if !ok {
+		t.Fatalf("expect measurable conn, got %T", dialed)
+	}
+	if mc.ReadMetric().TotalBytes() == 0 {
+		t.Fatal("expect the read bytes measured")
+	}
+
+	client.CloseIdleConnections()
+	tracker.Stop()
+}
+
+func TestDialerTLS(t *testing.T) {
+
+	s := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer s.Close()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(s.Certificate())
+
+	// the server name is verified by the dialed host
+	d := &Dialer{
+		Timeout:   time.Second,
+		TLSConfig: &tls.Config{RootCAs: pool},
+	}
+
+	conn, err := d.Dial("tcp", s.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	tc, ok := conn.(*tls.Conn)
+	if !ok || !tc.ConnectionState().HandshakeComplete {
+		t.Fatalf("expect the TLS handshake completed, got %T", conn)
+	}
+}
+
+func TestDialerRetry(t *testing.T) {
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// every attempt timeout
+	d := &Dialer{Timeout: time.Nanosecond, Retries: 2, InitialBackoff: 20 * time.Millisecond}
+
+	start := time.Now()
+	if _, err := d.Dial("tcp", l.Addr().String()); err == nil {
+		t.Fatal("expect dial failed")
+	}
+	// 20ms + 40ms
+	if elapsed := time.Since(start); elapsed < 60*time.Millisecond {
+		t.Fatalf("expect retried with backoff, took %s", elapsed)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Millisecond)
+	defer cancel()
+
+	d.Retries = 10
+	start = time.Now()
+	if _, err := d.DialContext(ctx, "tcp", l.Addr().String()); err == nil {
+		t.Fatal("expect dial failed")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("expect stop retry after the ctx done, took %s", elapsed)
+	}
+}
+
+func TestDialerNoRetry(t *testing.T) {
+
+	// a closed port
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	d := &Dialer{Retries: 3, InitialBackoff: 200 * time.Millisecond}
+
+	start := time.Now()
+	if _, err := d.Dial("tcp", addr); err == nil {
+		t.Fatal("expect dial failed")
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Fatalf("expect the refused conn not retried, took %s", elapsed)
+	}
+
+	l, err = net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	calls := 0
+	d.Layers = []DialLayer{func(conn net.Conn) (net.Conn, error) {
+		calls++
+		return nil, ErrTrackerClosed
+	}}
+	if _, err := d.Dial("tcp", l.Addr().String()); err != ErrTrackerClosed || calls != 1 {
+		t.Fatalf("expect the layer error returned immediately, got %v after %d calls", err, calls)
+	}
+
+	for _, c := range []struct {
+		err   error
+		retry bool
+	}{
+		{&net.DNSError{Err: "no such host", Name: "a.invalid"}, false},
+		{&net.DNSError{Err: "server misbehaving", Name: "a.invalid", IsTemporary: true}, true},
+		{&net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}, false},
+		{&net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ENETUNREACH)}, true},
+	} {
+		if retryable(c.err) != c.retry {
+			t.Fatalf("expect retryable(%v) %v", c.err, c.retry)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package firewall
+
+import (
+	"context"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/sxllwx/vulcanus/pkg/command"
+	"github.com/sxllwx/vulcanus/pkg/net/iptables"
+)
+
+// Interface
+// the backend-neutral firewall manager, the port-forward and masquerade api of iptables.Manager
+type Interface interface {
+	// CreateChainForTable
+	// new a chain in the table, eg: nat, filter
+	CreateChainForTable(table string, chain string) error
+	// AppendChainToParentChain
+	// jump from the parent chain to the chain, the parent may be the built-in chain, eg: PREROUTING
+	AppendChainToParentChain(table string, parent string, chain string, comment string) error
+	// AppendDNATRuleToChain
+	// forward the dport (eg: 3000, 1000:2000) to the destination (eg: 10.0.0.1:3000, [fd00::1]:3000)
+	AppendDNATRuleToChain(chain string, protocol string, dport string, toDestination string, comment string) error
+	// AppendSNATRuleToChain
+	// masquerade the packets to the destination ip or cidr
+	AppendSNATRuleToChain(chain string, d string, comment string) error
+	// DeleteChain
+	// remove the jump from the parent, then flush and delete the chain
+	DeleteChain(table string, parent string, chain string, comment string) error
+	// Reset
+	// remove the rules of the backend
+	Reset() error
+	io.Closer
+}
+
+var _ Interface = &iptables.Manager{}
+
+// Family
+// the ip family
+type Family string
+
+const (
+	IPv4 Family = "ipv4"
+	IPv6 Family = "ipv6"
+)
+
+// Backend
+// the kernel firewall backend
+type Backend string
+
+const (
+	// detect the backend on the host
+	BackendAuto Backend = ""
+	// iptables or ip6tables
+	BackendIPTables Backend = "iptables"
+	// nft in JSON mode
+	BackendNFTables Backend = "nftables"
+)
+
+// NFTCommand
+// the nftables command
+const NFTCommand = "nft"
+
+// the timeout of the detection commands
+const detectTimeout = 10 * time.Second
+
+// New
+// the firewall of the family on the host, the BackendAuto detect the backend by Detect
+func New(h command.Interface, family Family, backend Backend) (Interface, error) {
+
+	if family != IPv4 && family != IPv6 {
+		return nil, errors.Errorf("unknown family %q", family)
+	}
+
+	if backend == BackendAuto {
+		var err error
+		backend, err = Detect(h)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	switch backend {
+	case BackendIPTables:
+		if family == IPv6 {
+			return iptables.NewIP6Manager(h), nil
+		}
+		return iptables.NewManager(h), nil
+	case BackendNFTables:
+		return NewNFTables(h, family), nil
+	default:
+		return nil, errors.Errorf("unknown backend %q", backend)
+	}
+}
+
+// Detect
+// the backend used by the host:
+// the legacy iptables is used if it is installed, mixing it with nftables is confusing,
+// otherwise the nftables is used if nft is installed, eg: the iptables is the nf_tables variant
+func Detect(h command.Interface) (Backend, error) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), detectTimeout)
+	defer cancel()
+
+	r, iptErr := h.ExecContext(ctx, iptables.IptablesCommand, []string{"-V"}, nil)
+	if iptErr == nil && !strings.Contains(string(r.Stdout), "nf_tables") {
+		return BackendIPTables, nil
+	}
+
+	if _, err := h.ExecContext(ctx, NFTCommand, []string{"--version"}, nil); err == nil {
+		return BackendNFTables, nil
+	}
+
+	if iptErr == nil {
+		return BackendIPTables, nil
+	}
+	return "", errors.New("neither iptables nor nft found")
+}
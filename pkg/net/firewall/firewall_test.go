@@ -0,0 +1,183 @@
+package firewall
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/sxllwx/vulcanus/pkg/command/fake"
+	"github.com/sxllwx/vulcanus/pkg/net/iptables"
+)
+
+func TestDetect(t *testing.T) {
+
+	cases := []struct {
+		iptables string
+		nft      bool
+		expect   Backend
+	}{
+		{iptables: "iptables v1.8.4 (legacy)\n", nft: true, expect: BackendIPTables},
+		{iptables: "iptables v1.8.7 (nf_tables)\n", nft: true, expect: BackendNFTables},
+		{iptables: "iptables v1.8.7 (nf_tables)\n", nft: false, expect: BackendIPTables},
+		{nft: true, expect: BackendNFTables},
+	}
+
+	for _, c := range cases {
+		h := fake.NewHost()
+		if len(c.iptables) != 0 {
+			h.On(iptables.IptablesCommand, "-V").Stdout(c.iptables)
+		} else {
+			h.On(iptables.IptablesCommand, "-V").Exit(127)
+		}
+		if c.nft {
+			h.On(NFTCommand, "--version").Stdout("nftables v0.9.3 (Topsy)\n")
+		} else {
+			h.On(NFTCommand, "--version").Exit(127)
+		}
+
+		b, err := Detect(h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b != c.expect {
+			t.Fatalf("expect %s for %q, got %s", c.expect, c.iptables, b)
+		}
+	}
+
+	h := fake.NewHost()
+	h.Fallback().Exit(127)
+	if _, err := Detect(h); err == nil {
+		t.Fatal("expect no backend")
+	}
+}
+
+func TestNew(t *testing.T) {
+
+	h := fake.NewHost()
+	h.On(iptables.IptablesCommand, "-V").Stdout("iptables v1.8.4 (legacy)\n")
+	h.OnMatch(iptables.Ip6tablesCommand, fake.Exact("-t"), fake.Any(), fake.Exact("-S"), fake.Rest()).Exit(1)
+	h.OnMatch(iptables.Ip6tablesCommand, fake.Rest())
+
+	fw, err := New(h, IPv6, BackendAuto)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fw.CreateChainForTable(iptables.NATTableName, "VULCANUS-A"); err != nil {
+		t.Fatal(err)
+	}
+	if lines := h.CommandLines(); lines[len(lines)-1] != "ip6tables -t nat -N VULCANUS-A" {
+		t.Fatalf("expect ip6tables, got %q", lines)
+	}
+
+	fw, err = New(h, IPv4, BackendNFTables)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := fw.(*NFTables); !ok {
+		t.Fatalf("expect nftables, got %T", fw)
+	}
+
+	if _, err := New(h, "ipx", BackendIPTables); err == nil {
+		t.Fatal("expect unknown family rejected")
+	}
+}
+
+// nftInput
+// the nft JSON sent to the stdin
+func nftInput(t *testing.T, stdin []byte) []map[string]map[string]interface{} {
+
+	var body struct {
+		Nftables []map[string]map[string]interface{} `json:"nftables"`
+	}
+	if err := json.Unmarshal(stdin, &body); err != nil {
+		t.Fatal(err)
+	}
+	return body.Nftables
+}
+
+func TestNFTablesDNAT(t *testing.T) {
+
+	h := fake.NewHost()
+	h.On(NFTCommand, "-j", "list", "table", "ip6", "vulcanus_nat").Stderr("Error: No such file or directory").Exit(1).Once()
+	h.On(NFTCommand, "-j", "list", "table", "ip6", "vulcanus_nat").Stdout(`{"nftables": [
+		{"table": {"family": "ip6", "name": "vulcanus_nat", "handle": 1}},
+		{"chain": {"family": "ip6", "table": "vulcanus_nat", "name": "VULCANUS-A", "handle": 2}},
+		{"rule": {"family": "ip6", "table": "vulcanus_nat", "chain": "VULCANUS-A", "handle": 3, "comment": "generated by vulcanus", "expr": [
+			{"match": {"op": "==", "left": {"payload": {"protocol": "tcp", "field": "dport"}}, "right": {"range": [1000, 2000]}}},
+			{"dnat": {"addr": "fd00::1", "port": 3000}}
+		]}}
+	]}`)
+	h.On(NFTCommand, "-j", "-f", "-")
+
+	n := NewNFTables(h, IPv6)
+	if err := n.AppendDNATRuleToChain("VULCANUS-A", "tcp", "1000:2000", "[fd00::1]:3000", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	cmds := nftInput(t, h.Calls()[1].Stdin)
+	rule := cmds[0]["add"]["rule"].(map[string]interface{})
+	if rule["family"] != "ip6" || rule["table"] != "vulcanus_nat" || rule["comment"] != iptables.DefaultComment {
+		t.Fatalf("unexpected rule %v", rule)
+	}
+
+	var expect []interface{}
+	json.Unmarshal([]byte(`[
+		{"match": {"op": "==", "left": {"payload": {"protocol": "tcp", "field": "dport"}}, "right": {"range": [1000, 2000]}}},
+		{"dnat": {"addr": "fd00::1", "port": 3000}}
+	]`), &expect)
+	if !reflect.DeepEqual(rule["expr"], expect) {
+		t.Fatalf("expect %v, got %v", expect, rule["expr"])
+	}
+
+	// the rule already exist
+	if err := n.AppendDNATRuleToChain("VULCANUS-A", "tcp", "1000:2000", "[fd00::1]:3000", ""); err != nil {
+		t.Fatal(err)
+	}
+	if len(h.Calls()) != 3 {
+		t.Fatalf("expect the existing rule not added again %q", h.CommandLines())
+	}
+
+	if err := n.AppendDNATRuleToChain("VULCANUS-A", "tcp", "80", "10.0.0.1:80:90", ""); err == nil {
+		t.Fatal("expect the invalid destination rejected")
+	}
+}
+
+func TestNFTablesDeleteChain(t *testing.T) {
+
+	h := fake.NewHost()
+	h.On(NFTCommand, "-j", "list", "table", "ip", "vulcanus_nat").Stdout(`{"nftables": [
+		{"metainfo": {"json_schema_version": 1}},
+		{"table": {"family": "ip", "name": "vulcanus_nat", "handle": 1}},
+		{"chain": {"family": "ip", "table": "vulcanus_nat", "name": "VULCANUS-A", "handle": 2}},
+		{"rule": {"family": "ip", "table": "vulcanus_nat", "chain": "PREROUTING", "handle": 4, "comment": "generated by vulcanus: desktop a", "expr": [{"jump": {"target": "VULCANUS-A"}}]}},
+		{"rule": {"family": "ip", "table": "vulcanus_nat", "chain": "PREROUTING", "handle": 5, "comment": "desktop b", "expr": [{"jump": {"target": "VULCANUS-B"}}]}}
+	]}`)
+	h.On(NFTCommand, "-j", "-f", "-")
+
+	n := NewNFTables(h, IPv4)
+	if err := n.DeleteChain(iptables.NATTableName, iptables.PREROUTINGChainName, "VULCANUS-A", "desktop a"); err != nil {
+		t.Fatal(err)
+	}
+
+	cmds := nftInput(t, h.Calls()[1].Stdin)
+	if len(cmds) != 3 {
+		t.Fatalf("unexpected commands %v", cmds)
+	}
+	if handle := cmds[0]["delete"]["rule"].(map[string]interface{})["handle"]; handle != float64(4) {
+		t.Fatalf("expect delete the rule 4, got %v", handle)
+	}
+	if _, ok := cmds[1]["flush"]["chain"]; !ok {
+		t.Fatalf("expect flush chain, got %v", cmds[1])
+	}
+	if _, ok := cmds[2]["delete"]["chain"]; !ok {
+		t.Fatalf("expect delete chain, got %v", cmds[2])
+	}
+
+	// the jump and chain already removed
+	if err := n.DeleteChain(iptables.NATTableName, iptables.PREROUTINGChainName, "VULCANUS-C", ""); err != nil {
+		t.Fatal(err)
+	}
+	if len(h.Calls()) != 3 {
+		t.Fatalf("unexpected calls %q", h.CommandLines())
+	}
+}
@@ -0,0 +1,554 @@
+package firewall
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/sxllwx/vulcanus/pkg/command"
+	"github.com/sxllwx/vulcanus/pkg/net/iptables"
+)
+
+// the prefix of the nft tables owned by vulcanus, one nft table per iptables table
+// eg: nat -> vulcanus_nat
+const NFTTablePrefix = "vulcanus_"
+
+// nftHook
+// the base chain of the built-in chain
+type nftHook struct {
+	hook string
+	prio int
+}
+
+// the built-in chains of the nat and filter table, the priority is same as iptables
+var nftHooks = map[string]map[string]nftHook{
+	iptables.NATTableName: {
+		iptables.PREROUTINGChainName:  {hook: "prerouting", prio: -100},
+		iptables.INPUTChainName:       {hook: "input", prio: 100},
+		iptables.OUTPUTChainName:      {hook: "output", prio: -100},
+		iptables.POSTROUTINGChainName: {hook: "postrouting", prio: 100},
+	},
+	iptables.FilterTableName: {
+		iptables.INPUTChainName:  {hook: "input", prio: 0},
+		"FORWARD":                {hook: "forward", prio: 0},
+		iptables.OUTPUTChainName: {hook: "output", prio: 0},
+	},
+}
+
+// *** the nft JSON schema, see libnftables-json(5) *** //
+
+type nftTable struct {
+	Family string `json:"family"`
+	Name   string `json:"name"`
+}
+
+type nftChain struct {
+	Family string `json:"family"`
+	Table  string `json:"table"`
+	Name   string `json:"name"`
+	Type   string `json:"type,omitempty"`
+	Hook   string `json:"hook,omitempty"`
+	Prio   *int   `json:"prio,omitempty"`
+	Policy string `json:"policy,omitempty"`
+}
+
+type nftRule struct {
+	Family  string            `json:"family"`
+	Table   string            `json:"table"`
+	Chain   string            `json:"chain"`
+	Handle  int               `json:"handle,omitempty"`
+	Comment string            `json:"comment,omitempty"`
+	Expr    []json.RawMessage `json:"expr,omitempty"`
+}
+
+type nftObject struct {
+	Table *nftTable `json:"table,omitempty"`
+	Chain *nftChain `json:"chain,omitempty"`
+	Rule  *nftRule  `json:"rule,omitempty"`
+}
+
+type nftRuleset struct {
+	Nftables []map[string]json.RawMessage `json:"nftables"`
+}
+
+// NFTables
+// the firewall by nft JSON mode, all the rules are in the vulcanus_* tables,
+// every operation is applied in one nft transaction
+type NFTables struct {
+	lock sync.Mutex
+	host command.Interface
+	// ip or ip6
+	family string
+
+	timeout time.Duration
+}
+
+var _ Interface = &NFTables{}
+
+func NewNFTables(h command.Interface, family Family) *NFTables {
+
+	f := "ip"
+	if family == IPv6 {
+		f = "ip6"
+	}
+	return &NFTables{
+		host:    h,
+		family:  f,
+		timeout: iptables.DefaultTimeout,
+	}
+}
+
+func (n *NFTables) Close() error {
+	return n.host.Close()
+}
+
+// SetTimeout
+// set the max time of every nft command
+func (n *NFTables) SetTimeout(timeout time.Duration) {
+
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	n.timeout = timeout
+}
+
+func (n *NFTables) tableName(table string) string {
+	return NFTTablePrefix + table
+}
+
+func (n *NFTables) table(table string) *nftTable {
+	return &nftTable{Family: n.family, Name: n.tableName(table)}
+}
+
+// execute
+// run nft with the input, the stderr will be attached to the err
+func (n *NFTables) execute(input []byte, args ...string) (*command.Result, error) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), n.timeout)
+	defer cancel()
+
+	r, err := n.host.ExecContext(ctx, NFTCommand, args, bytes.NewReader(input))
+	if err != nil {
+		if stderr := strings.TrimSpace(string(r.Stderr)); len(stderr) != 0 {
+			return r, errors.Annotate(err, stderr)
+		}
+		return r, err
+	}
+	return r, nil
+}
+
+// apply
+// run the commands in one transaction, eg: {"add": {"chain": ...}}
+func (n *NFTables) apply(cmds ...map[string]nftObject) error {
+
+	body, err := json.Marshal(map[string]interface{}{"nftables": cmds})
+	if err != nil {
+		return errors.Annotate(err, "marshal nft commands")
+	}
+
+	_, err = n.execute(body, "-j", "-f", "-")
+	return err
+}
+
+// nftListing
+// the chains and rules of a table
+type nftListing struct {
+	chains map[string]bool
+	rules  []*nftRule
+}
+
+// list
+// the chains and rules in the table, the table not exist is treated as empty
+func (n *NFTables) list(table string) (*nftListing, error) {
+
+	out := &nftListing{chains: map[string]bool{}}
+
+	r, err := n.execute(nil, "-j", "list", "table", n.family, n.tableName(table))
+	if err != nil {
+		if command.ExitCode(errors.Cause(err)) == 1 && strings.Contains(string(r.Stderr), "No such file or directory") {
+			return out, nil
+		}
+		return nil, errors.Annotatef(err, "list table %s", n.tableName(table))
+	}
+
+	rs := &nftRuleset{}
+	if err := json.Unmarshal(r.Stdout, rs); err != nil {
+		return nil, errors.Annotate(err, "unmarshal nft ruleset")
+	}
+
+	for _, obj := range rs.Nftables {
+		if raw, ok := obj["chain"]; ok {
+			c := &nftChain{}
+			if err := json.Unmarshal(raw, c); err != nil {
+				return nil, errors.Annotate(err, "unmarshal nft chain")
+			}
+			out.chains[c.Name] = true
+			continue
+		}
+
+		raw, ok := obj["rule"]
+		if !ok {
+			continue
+		}
+		rule := &nftRule{}
+		if err := json.Unmarshal(raw, rule); err != nil {
+			return nil, errors.Annotate(err, "unmarshal nft rule")
+		}
+		out.rules = append(out.rules, rule)
+	}
+	return out, nil
+}
+
+// exists
+// the rule with the same chain, comment and expressions is already in the table
+func (l *nftListing) exists(rule *nftRule) bool {
+
+	for _, r := range l.rules {
+		if r.Chain == rule.Chain && r.Comment == rule.Comment && sameExpr(r.Expr, rule.Expr) {
+			return true
+		}
+	}
+	return false
+}
+
+// sameExpr
+// compare the expressions by the decoded JSON, the formatting of nft is ignored
+func sameExpr(a, b []json.RawMessage) bool {
+
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		var x, y interface{}
+		if json.Unmarshal(a[i], &x) != nil || json.Unmarshal(b[i], &y) != nil || !reflect.DeepEqual(x, y) {
+			return false
+		}
+	}
+	return true
+}
+
+// ensureRule
+// add the rule if not exist, the rule is compared with the listed table like `iptables -C`
+func (n *NFTables) ensureRule(table string, rule *nftRule, prepend ...map[string]nftObject) error {
+
+	l, err := n.list(table)
+	if err != nil {
+		return err
+	}
+	if l.exists(rule) {
+		return nil
+	}
+	return n.apply(append(prepend, map[string]nftObject{"add": {Rule: rule}})...)
+}
+
+// chain
+// the chain object, the built-in chain is the base chain with the hook
+func (n *NFTables) chain(table string, name string) (*nftChain, error) {
+
+	hooks, ok := nftHooks[table]
+	if !ok {
+		return nil, errors.Errorf("table %s not supported by nftables backend", table)
+	}
+
+	c := &nftChain{Family: n.family, Table: n.tableName(table), Name: name}
+	if h, ok := hooks[name]; ok {
+		prio := h.prio
+		// the nft chain types are same as the table names
+		c.Type = table
+		c.Hook = h.hook
+		c.Prio = &prio
+		c.Policy = "accept"
+	}
+	return c, nil
+}
+
+func expr(v interface{}) json.RawMessage {
+
+	b, _ := json.Marshal(v)
+	return b
+}
+
+func (n *NFTables) CreateChainForTable(table string, chain string) error {
+
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	c, err := n.chain(table, chain)
+	if err != nil {
+		return err
+	}
+
+	err = n.apply(
+		map[string]nftObject{"add": {Table: n.table(table)}},
+		map[string]nftObject{"add": {Chain: c}},
+	)
+	if err != nil {
+		return errors.Annotatef(err, "nft create chain (%s) in table (%s)", chain, table)
+	}
+	return nil
+}
+
+func (n *NFTables) AppendChainToParentChain(table string, parent string, chain string, comment string) error {
+
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	p, err := n.chain(table, parent)
+	if err != nil {
+		return err
+	}
+	comment = iptables.Tag(comment)
+
+	err = n.ensureRule(table,
+		&nftRule{
+			Family:  n.family,
+			Table:   n.tableName(table),
+			Chain:   parent,
+			Comment: comment,
+			Expr: []json.RawMessage{
+				expr(map[string]interface{}{"jump": map[string]string{"target": chain}}),
+			},
+		},
+		map[string]nftObject{"add": {Table: n.table(table)}},
+		// the base chain of the built-in chain created on demand
+		map[string]nftObject{"add": {Chain: p}},
+	)
+	if err != nil {
+		return errors.Annotatef(err, "nft append chain (%s) to parent (%s) in table (%s)", chain, parent, table)
+	}
+	return nil
+}
+
+// portValue
+// the port or range in nft JSON
+func portValue(p iptables.PortRange) interface{} {
+
+	if p.To != 0 && p.To != p.From {
+		return map[string]interface{}{"range": []uint16{p.From, p.To}}
+	}
+	return p.From
+}
+
+// splitDestination
+// split the ip[:port[-port]], the ipv6 with port should be in brackets, eg: [fd00::1]:80
+func splitDestination(d string) (string, *iptables.PortRange, error) {
+
+	host, port := d, ""
+	if strings.HasPrefix(d, "[") {
+		i := strings.Index(d, "]")
+		if i < 0 {
+			return "", nil, errors.Errorf("invalid destination %q", d)
+		}
+		host = d[1:i]
+		port = strings.TrimPrefix(d[i+1:], ":")
+	} else if strings.Count(d, ":") == 1 {
+		i := strings.Index(d, ":")
+		host, port = d[:i], d[i+1:]
+	}
+
+	if net.ParseIP(host) == nil {
+		return "", nil, errors.Errorf("invalid destination %q", d)
+	}
+	if len(port) == 0 {
+		return host, nil, nil
+	}
+
+	p, err := iptables.ParsePortRange(port)
+	if err != nil {
+		return "", nil, errors.Annotatef(err, "invalid destination %q", d)
+	}
+	return host, &p, nil
+}
+
+func (n *NFTables) AppendDNATRuleToChain(chain string, protocol string, dport string, toDestination string, comment string) error {
+
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	ports, err := iptables.ParsePortRange(dport)
+	if err != nil {
+		return errors.Annotatef(err, "nft create dnat rule to chain %s", chain)
+	}
+	addr, toPort, err := splitDestination(toDestination)
+	if err != nil {
+		return errors.Annotatef(err, "nft create dnat rule to chain %s", chain)
+	}
+	comment = iptables.Tag(comment)
+
+	dnat := map[string]interface{}{"addr": addr}
+	if toPort != nil {
+		dnat["port"] = portValue(*toPort)
+	}
+
+	err = n.ensureRule(iptables.NATTableName, &nftRule{
+		Family:  n.family,
+		Table:   n.tableName(iptables.NATTableName),
+		Chain:   chain,
+		Comment: comment,
+		Expr: []json.RawMessage{
+			expr(map[string]interface{}{"match": map[string]interface{}{
+				"op":    "==",
+				"left":  map[string]interface{}{"payload": map[string]string{"protocol": strings.ToLower(protocol), "field": "dport"}},
+				"right": portValue(ports),
+			}}),
+			expr(map[string]interface{}{"dnat": dnat}),
+		},
+	})
+	if err != nil {
+		return errors.Annotatef(err,
+			"nft create dnat rule (protocol %s dport %s to-destination %s comment %s) to chain %s",
+			protocol,
+			dport,
+			toDestination,
+			comment,
+			chain,
+		)
+	}
+	return nil
+}
+
+// addrValue
+// the ip or cidr in nft JSON
+func addrValue(d string) (interface{}, error) {
+
+	if ip := net.ParseIP(d); ip != nil {
+		return ip.String(), nil
+	}
+
+	_, ipNet, err := net.ParseCIDR(d)
+	if err != nil {
+		return nil, errors.Errorf("invalid address %q", d)
+	}
+	ones, _ := ipNet.Mask.Size()
+	return map[string]interface{}{"prefix": map[string]interface{}{"addr": ipNet.IP.String(), "len": ones}}, nil
+}
+
+func (n *NFTables) AppendSNATRuleToChain(chain string, d string, comment string) error {
+
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	addr, err := addrValue(d)
+	if err != nil {
+		return errors.Annotatef(err, "nft create snat rule to chain %s", chain)
+	}
+	comment = iptables.Tag(comment)
+
+	err = n.ensureRule(iptables.NATTableName, &nftRule{
+		Family:  n.family,
+		Table:   n.tableName(iptables.NATTableName),
+		Chain:   chain,
+		Comment: comment,
+		Expr: []json.RawMessage{
+			expr(map[string]interface{}{"match": map[string]interface{}{
+				"op":    "==",
+				"left":  map[string]interface{}{"payload": map[string]string{"protocol": n.family, "field": "daddr"}},
+				"right": addr,
+			}}),
+			expr(map[string]interface{}{"masquerade": nil}),
+		},
+	})
+	if err != nil {
+		return errors.Annotatef(err,
+			"nft create snat rule (destination %s comment %s) to chain %s",
+			d,
+			comment,
+			chain,
+		)
+	}
+	return nil
+}
+
+// jumpTarget
+// the target of the jump rule, empty if the rule is not a jump
+func jumpTarget(r *nftRule) string {
+
+	for _, e := range r.Expr {
+		var v struct {
+			Jump *struct {
+				Target string `json:"target"`
+			} `json:"jump"`
+		}
+		if json.Unmarshal(e, &v) == nil && v.Jump != nil {
+			return v.Jump.Target
+		}
+	}
+	return ""
+}
+
+// DeleteChain
+// remove the jump from the parent, and delete the chain,
+// the jump or chain already removed is ignored, so it is safe to call again
+func (n *NFTables) DeleteChain(table string, parent string, chain string, comment string) error {
+
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	// the jump created before the comment is tagged is removed too
+	legacy := comment
+	if len(legacy) == 0 {
+		legacy = iptables.DefaultComment
+	}
+	comments := map[string]bool{iptables.Tag(comment): true, legacy: true}
+
+	l, err := n.list(table)
+	if err != nil {
+		return err
+	}
+
+	var cmds []map[string]nftObject
+	for _, r := range l.rules {
+		if r.Chain == parent && comments[r.Comment] && jumpTarget(r) == chain {
+			cmds = append(cmds, map[string]nftObject{"delete": {Rule: &nftRule{
+				Family: n.family,
+				Table:  n.tableName(table),
+				Chain:  parent,
+				Handle: r.Handle,
+			}}})
+		}
+	}
+
+	if l.chains[chain] {
+		c := &nftChain{Family: n.family, Table: n.tableName(table), Name: chain}
+		cmds = append(cmds,
+			map[string]nftObject{"flush": {Chain: c}},
+			map[string]nftObject{"delete": {Chain: c}},
+		)
+	}
+
+	if len(cmds) == 0 {
+		return nil
+	}
+	if err := n.apply(cmds...); err != nil {
+		return errors.Annotatef(err, "nft remove chain (%s) from parent (%s) in table (%s)", chain, parent, table)
+	}
+	return nil
+}
+
+// Reset
+// delete the vulcanus_* tables, the tables of others are never touched
+func (n *NFTables) Reset() error {
+
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	var cmds []map[string]nftObject
+	for _, table := range []string{iptables.NATTableName, iptables.FilterTableName} {
+		// add before delete, so the delete will not fail if the table not exist
+		cmds = append(cmds,
+			map[string]nftObject{"add": {Table: n.table(table)}},
+			map[string]nftObject{"delete": {Table: n.table(table)}},
+		)
+	}
+
+	if err := n.apply(cmds...); err != nil {
+		return errors.Annotate(err, "nft reset")
+	}
+	return nil
+}
@@ -1,13 +1,16 @@
 package iptables
 
-import (
-	"fmt"
-)
-
 // root command
 const (
 	IptablesCommand     = "iptables"
 	IptablesSaveCommand = "iptables-save"
+	// apply the rules atomically
+	IptablesRestoreCommand = "iptables-restore"
+
+	// the commands of ipv6
+	Ip6tablesCommand        = "ip6tables"
+	Ip6tablesSaveCommand    = "ip6tables-save"
+	Ip6tablesRestoreCommand = "ip6tables-restore"
 )
 
 // tables name
@@ -76,6 +79,17 @@ func (m *ArgsManager) FlushChain(table string, chain string) []string {
 	)
 }
 
+// ListChain
+// list the rules of a chain in spec table, fail if the chain not exist
+func (m *ArgsManager) ListChain(table string, chain string) []string {
+
+	return append(
+		[]string{},
+		"-t", table,
+		"-S", chain,
+	)
+}
+
 // InsertToParent
 // insert a chain to parent chain in spec table
 // with comment
@@ -95,15 +109,11 @@ func (m *ArgsManager) AppendChainToParent(
 		"-t", table,
 		"-A", parent,
 		"-m", "comment",
-		"--comment", m.wrapComment(comment),
+		"--comment", comment,
 		"-j", chain,
 	)
 }
 
-func (m *ArgsManager) wrapComment(comment string) string {
-	return fmt.Sprintf("\"%s\"", comment)
-}
-
 // RemoveChainFromParent
 // remove the chain from parent chain in spec table
 func (m *ArgsManager) RemoveChainFromParent(
@@ -121,13 +131,15 @@ func (m *ArgsManager) RemoveChainFromParent(
 		"-t", table,
 		"-D", parent,
 		"-m", "comment",
-		"--comment", m.wrapComment(comment),
+		"--comment", comment,
 		"-j", chain,
 	)
 }
 
 // CheckRule
 // check the iptables  rule exist
+//
+// Deprecated: use RuleBuilder.CheckArgs
 func (m *ArgsManager) CheckRule(table string, chain string, args ...string) []string {
 
 	return append(
@@ -141,6 +153,8 @@ func (m *ArgsManager) CheckRule(table string, chain string, args ...string) []st
 
 // AppendDNATRuleToChain
 // append a dnat rule for a chain in spec table
+//
+// Deprecated: use RuleBuilder
 func (m *ArgsManager) AppendDNATRuleToChain(
 	table string,
 	chain string,
@@ -163,7 +177,7 @@ func (m *ArgsManager) AppendDNATRuleToChain(
 		"-p", protocol,
 		"--dport", dport,
 		"-m", "comment",
-		"--comment", m.wrapComment(comment),
+		"--comment", comment,
 		"-j", DNAT,
 		"--to-destination", toDestination,
 	)
@@ -171,6 +185,8 @@ func (m *ArgsManager) AppendDNATRuleToChain(
 
 // AppendMASQUERADERuleToChain
 // append a snat rule for a chain in spec table
+//
+// Deprecated: use RuleBuilder
 func (m *ArgsManager) AppendMASQUERADERuleToChain(
 	table string,
 	chain string,
@@ -188,7 +204,7 @@ func (m *ArgsManager) AppendMASQUERADERuleToChain(
 		"-A", chain,
 		"-d", d,
 		"-m", "comment",
-		"--comment", m.wrapComment(comment),
+		"--comment", comment,
 		"-j", MASQUERADE,
 	)
 }
@@ -1,62 +1,180 @@
 package iptables
 
 import (
+	"bytes"
+	"context"
+	"io"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/juju/errors"
 	"github.com/sxllwx/vulcanus/pkg/command"
 )
 
+// the max time of a iptables command, avoid the hung command block the lock forever
+const DefaultTimeout = 30 * time.Second
+
 // the remote or local iptables-mananger
 type Manager struct {
 	lock sync.Mutex
 	// the shell env for spec command
 	host command.Interface
 	am   *ArgsManager
+
+	timeout time.Duration
+
+	commands commands
+
+	// the forwarded services by name, see Forward
+	services map[string]*Service
+	// the services created by the previous process are loaded from the host, see loadServices
+	servicesLoaded bool
+	// the services state is applied by the manager, the empty services state is kept after the last Unforward
+	servicesManaged bool
+
+	// the desired state re-applied by Resync, see resync.go
+	// the states last reconciled of every table
+	states map[string][]*TableState
+	// the chains created by CreateChainForTable
+	chains []ensuredChain
+	// the rules appended by EnsureRule and the Append*
+	rules []ensuredRule
 }
 
+// commands
+// the iptables commands of the ip family
+type commands struct {
+	iptables string
+	save     string
+	restore  string
+}
+
+var (
+	ipv4Commands = commands{
+		iptables: IptablesCommand,
+		save:     IptablesSaveCommand,
+		restore:  IptablesRestoreCommand,
+	}
+	ipv6Commands = commands{
+		iptables: Ip6tablesCommand,
+		save:     Ip6tablesSaveCommand,
+		restore:  Ip6tablesRestoreCommand,
+	}
+)
+
 func (m *Manager) Close() error {
 	return m.host.Close()
 }
 
 func NewManager(h command.Interface) *Manager {
 	return &Manager{
-		host: h,
-		am:   &ArgsManager{},
+		host:     h,
+		am:       &ArgsManager{},
+		timeout:  DefaultTimeout,
+		commands: ipv4Commands,
 	}
 }
 
-func (m *Manager) CreateChainForTable(table string, chain string) error {
+// NewIP6Manager
+// the manager of ip6tables, the rules should use the ipv6 address
+func NewIP6Manager(h command.Interface) *Manager {
+
+	m := NewManager(h)
+	m.commands = ipv6Commands
+	return m
+}
+
+// SetTimeout
+// set the max time of every iptables command
+func (m *Manager) SetTimeout(timeout time.Duration) {
 
 	m.lock.Lock()
 	defer m.lock.Unlock()
 
-	rootCommand := IptablesCommand
-	args := m.am.NewChain(table, chain)
+	m.timeout = timeout
+}
+
+// execute
+// run the command with timeout, the stderr will be attached to the err
+func (m *Manager) execute(cmd string, args ...string) (*command.Result, error) {
+	return m.executeWithInput(nil, cmd, args...)
+}
+
+// executeWithInput
+// like execute, the input is sent to the stdin of the command
+func (m *Manager) executeWithInput(input []byte, cmd string, args ...string) (*command.Result, error) {
 
-	_, err := m.host.Execute(rootCommand, args...)
+	ctx, cancel := context.WithTimeout(context.Background(), m.timeout)
+	defer cancel()
+
+	var in io.Reader
+	if input != nil {
+		in = bytes.NewReader(input)
+	}
+
+	r, err := m.host.ExecContext(ctx, cmd, args, in)
 	if err != nil {
-		return errors.Annotatef(err, "iptables create chain (%s) in table (%s)", chain, table)
+		if stderr := strings.TrimSpace(string(r.Stderr)); len(stderr) != 0 {
+			return r, errors.Annotate(err, stderr)
+		}
+		return r, err
 	}
-	return nil
+	return r, nil
 }
 
-func (m *Manager) AppendChainToParentChain(table string, parent string, chain string, comment string) error {
+// CreateChainForTable
+// new the chain in the table, the existing chain is kept
+func (m *Manager) CreateChainForTable(table string, chain string) error {
 
 	m.lock.Lock()
 	defer m.lock.Unlock()
 
-	rootCommand := IptablesCommand
-	args := m.am.AppendChainToParent(table, parent, chain, comment)
+	if _, err := m.createChain(table, chain); err != nil {
+		return err
+	}
+	m.registerChain(table, chain)
+	return nil
+}
+
+// createChain
+// the CreateChainForTable without the lock, true if the chain is created
+func (m *Manager) createChain(table string, chain string) (bool, error) {
 
-	_, err := m.host.Execute(rootCommand, args...)
+	ok, err := m.exists(m.am.ListChain(table, chain))
 	if err != nil {
-		return errors.Annotatef(err, "iptables create chain (%s) in table (%s)", chain, table)
+		return false, errors.Annotatef(err, "iptables check chain (%s) in table (%s)", chain, table)
+	}
+	if ok {
+		return false, nil
+	}
+
+	_, err = m.execute(m.commands.iptables, m.am.NewChain(table, chain)...)
+	if err != nil {
+		return false, errors.Annotatef(err, "iptables create chain (%s) in table (%s)", chain, table)
+	}
+	return true, nil
+}
+
+// AppendChainToParentChain
+// jump from the parent to the chain, the comment is tagged by the DefaultComment,
+// nothing is appended if the jump already exists
+func (m *Manager) AppendChainToParentChain(table string, parent string, chain string, comment string) error {
+
+	err := m.EnsureRule(jumpRule(table, parent, chain, comment))
+	if err != nil {
+		return errors.Annotatef(err, "iptables append chain (%s) to parent (%s) in table (%s)", chain, parent, table)
 	}
 
 	return nil
 }
 
+// jumpRule
+// the jump from the parent to the chain
+func jumpRule(table string, parent string, chain string, comment string) *RuleBuilder {
+	return NewRule(table, parent).Comment(Tag(comment)).Jump(JumpTo(chain))
+}
+
 func (m *Manager) AppendDNATRuleToChain(
 	chain string,
 	protocol string,
@@ -67,21 +185,18 @@ func (m *Manager) AppendDNATRuleToChain(
 	comment string,
 ) error {
 
-	m.lock.Lock()
-	defer m.lock.Unlock()
-
-	rootCommand := IptablesCommand
-	args := m.am.AppendDNATRuleToChain(
-		NATTableName,
-		chain,
-		protocol,
-		dport,
-		toDestination,
-		comment,
-	)
+	ports, err := ParsePortRange(dport)
+	if err != nil {
+		return errors.Annotatef(err, "iptables create dnat rule to chain %s", chain)
+	}
 
-	_, err := m.host.Execute(rootCommand, args...)
+	comment = Tag(comment)
 
+	err = m.EnsureRule(NewRule(NATTableName, chain).
+		Protocol(protocol).
+		DestinationPort(ports).
+		Comment(comment).
+		Jump(DNATTo(toDestination)))
 	if err != nil {
 		return errors.Annotatef(err,
 			"iptables create dnat rule (protocol %s dport %s to-destination %s comment %s) to chain %s",
@@ -102,18 +217,12 @@ func (m *Manager) AppendSNATRuleToChain(
 	comment string,
 ) error {
 
-	m.lock.Lock()
-	defer m.lock.Unlock()
-
-	rootCommand := IptablesCommand
-	args := m.am.AppendMASQUERADERuleToChain(
-		NATTableName,
-		chain,
-		d,
-		comment,
-	)
+	comment = Tag(comment)
 
-	_, err := m.host.Execute(rootCommand, args...)
+	err := m.EnsureRule(NewRule(NATTableName, chain).
+		Destination(d).
+		Comment(comment).
+		Jump(Masquerade()))
 	if err != nil {
 		return errors.Annotatef(err,
 			"iptables create snat rule (destination %s comment %s) to chain %s",
@@ -126,73 +235,268 @@ func (m *Manager) AppendSNATRuleToChain(
 	return nil
 }
 
-func (m *Manager) DeleteChain(table string, parent string, chain string, comment string) error {
+// AppendRule
+// append the rule to the end of its chain
+func (m *Manager) AppendRule(b *RuleBuilder) error {
+
+	args, err := b.AppendArgs()
+	if err != nil {
+		return err
+	}
+	return m.run(args)
+}
+
+// EnsureRule
+// append the rule if it not exist in its chain, checked by iptables -C,
+// the rule is kept for Resync until deleted by DeleteRule or DeleteChain
+func (m *Manager) EnsureRule(b *RuleBuilder) error {
+
+	r, err := newEnsuredRule(b)
+	if err != nil {
+		return err
+	}
 
 	m.lock.Lock()
 	defer m.lock.Unlock()
 
-	rootCommand := IptablesCommand
-	args := m.am.RemoveChainFromParent(NATTableName, parent, chain, comment)
+	if _, err := m.ensureRule(r); err != nil {
+		return err
+	}
+	m.registerRule(r)
+	return nil
+}
+
+// ensureRule
+// the EnsureRule without the lock, true if the rule is appended
+func (m *Manager) ensureRule(r ensuredRule) (bool, error) {
 
-	_, err := m.host.Execute(rootCommand, args...)
-	if err != nil {
-		return errors.Annotatef(err, "iptables remove chain (%s) from parent (%s) in table (%s)", chain, parent, table)
+	ok, err := m.exists(r.check)
+	if err != nil || ok {
+		return false, err
 	}
 
-	args = m.am.FlushChain(NATTableName, chain)
-	_, err = m.host.Execute(rootCommand, args...)
+	if _, err := m.execute(m.commands.iptables, r.append...); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// InsertRule
+// insert the rule at the position of its chain, the first is 1
+func (m *Manager) InsertRule(b *RuleBuilder, pos int) error {
+
+	args, err := b.InsertArgs(pos)
 	if err != nil {
-		return errors.Annotatef(err, "iptables flush chain (%s)  in table (%s)", chain, table)
+		return err
 	}
+	return m.run(args)
+}
+
+// DeleteRule
+// delete the rule from its chain, the rule ensured before is not restored by Resync any more
+func (m *Manager) DeleteRule(b *RuleBuilder) error {
 
-	args = m.am.DeleteChain(NATTableName, chain)
-	_, err = m.host.Execute(rootCommand, args...)
+	args, err := b.DeleteArgs()
 	if err != nil {
-		return errors.Annotatef(err, "iptables delete chain (%s)  in table (%s)", chain, table)
+		return err
+	}
+	r, err := b.Rule()
+	if err != nil {
+		return err
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if _, err := m.execute(m.commands.iptables, args...); err != nil {
+		return err
 	}
+	m.unregisterRules(func(e ensuredRule) bool {
+		return e.table == b.table && e.rule.Chain == r.Chain && sameArgs(e.rule.Args, r.Args)
+	})
 	return nil
 }
 
-func (m *Manager) checkRule(table string, chain string, args ...string) error {
+// RuleExists
+// check the rule in its chain by iptables -C
+func (m *Manager) RuleExists(b *RuleBuilder) (bool, error) {
 
-	rootCommand := IptablesCommand
-	realArgs := m.am.CheckRule(table, chain, args...)
-	_, err := m.host.Execute(rootCommand, realArgs...)
+	args, err := b.CheckArgs()
 	if err != nil {
-		return err
+		return false, err
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	return m.exists(args)
+}
+
+// exists
+// the -C exit with 1 if the rule or chain not exist
+func (m *Manager) exists(args []string) (bool, error) {
+
+	_, err := m.execute(m.commands.iptables, args...)
+	if err == nil {
+		return true, nil
+	}
+	if command.ExitCode(errors.Cause(err)) == 1 {
+		return false, nil
+	}
+	return false, err
+}
+
+func (m *Manager) run(args []string) error {
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	_, err := m.execute(m.commands.iptables, args...)
+	return err
+}
+
+// DeleteChain
+// remove the jump from the parent, then flush and delete the chain,
+// the steps are applied in one iptables-restore transaction, if any of them fails, nothing is changed;
+// the missing jump or chain is skipped, so deleting again is safe
+func (m *Manager) DeleteChain(table string, parent string, chain string, comment string) error {
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	current, err := m.save()
+	if err != nil {
+		return errors.Annotatef(err, "iptables delete chain (%s) in table (%s)", chain, table)
+	}
+
+	// the chain is not restored by Resync any more
+	m.unregisterChain(table, chain)
+
+	t := current.Table(table)
+	if t == nil {
+		return nil
 	}
 
+	c := &Changes{Table: table}
+
+	// the jump created before the comment is tagged is removed too
+	legacy := comment
+	if len(legacy) == 0 {
+		legacy = DefaultComment
+	}
+
+	var jumps [][]string
+	for _, cm := range []string{Tag(comment), legacy} {
+		args, err := NewRule(table, parent).Comment(cm).Jump(JumpTo(chain)).Args()
+		if err != nil {
+			return err
+		}
+		jumps = append(jumps, args)
+	}
+
+	for _, r := range t.RulesOf(parent) {
+		if args := r.Args(); containsArgs(jumps, args) {
+			c.DeletedRules = append(c.DeletedRules, Rule{Chain: parent, Args: args})
+		}
+	}
+	if t.Chain(chain) != nil {
+		c.DeletedChains = append(c.DeletedChains, chain)
+	}
+
+	if c.Empty() {
+		return nil
+	}
+
+	input := &bytes.Buffer{}
+	(&TableState{Table: table}).restoreInput(c, input)
+	if err := m.restore(input.Bytes()); err != nil {
+		return errors.Annotatef(err, "iptables delete chain (%s) from parent (%s) in table (%s)", chain, parent, table)
+	}
 	return nil
 }
 
+// Reset
+// remove the chains and rules owned by vulcanus in the nat and filter table,
+// the others (eg: docker) are kept, see ownedChains
 func (m *Manager) Reset() error {
 
 	m.lock.Lock()
 	defer m.lock.Unlock()
 
-	rootCommand := IptablesCommand
-	tables := []string{NATTableName, FilterTableName}
+	current, err := m.save()
+	if err != nil {
+		return errors.Annotate(err, "iptables reset")
+	}
 
-	for _, table := range tables {
+	input := &bytes.Buffer{}
+	for _, table := range []string{NATTableName, FilterTableName} {
 
-		args := m.am.FlushAllChain(table)
-		_, err := m.host.Execute(rootCommand, args...)
-		if err != nil {
-			return errors.Annotatef(err, "iptables flush all chain  in table (%s)", table)
+		t := current.Table(table)
+		if t == nil {
+			continue
 		}
 
-		args = m.am.ZeroAllChain(table)
-		_, err = m.host.Execute(rootCommand, args...)
-		if err != nil {
-			return errors.Annotatef(err, "iptables zero all chain  in table (%s)", table)
+		c := &Changes{Table: table, DeletedChains: ownedChains(t)}
+
+		owned := map[string]bool{}
+		for _, name := range c.DeletedChains {
+			owned[name] = true
+		}
+		for _, r := range t.Managed() {
+			if !owned[r.Chain] {
+				c.DeletedRules = append(c.DeletedRules, Rule{Chain: r.Chain, Args: r.Args()})
+			}
 		}
 
-		args = m.am.DeleteAllChain(table)
-		_, err = m.host.Execute(rootCommand, args...)
-		if err != nil {
-			return errors.Annotatef(err, "iptables delete all chain  in table (%s)", table)
+		if !c.Empty() {
+			(&TableState{Table: table}).restoreInput(c, input)
+		}
+	}
+
+	if input.Len() != 0 {
+		if err := m.restore(input.Bytes()); err != nil {
+			return errors.Annotate(err, "iptables reset")
 		}
 	}
 
+	// the services and the desired state are removed from the host
+	m.services = map[string]*Service{}
+	m.servicesLoaded = true
+	m.servicesManaged = false
+	m.states = nil
+	m.chains = nil
+	m.rules = nil
 	return nil
 }
+
+// ownedChains
+// the user defined chains jumped only by the rules of vulcanus, and the stale service chains
+func ownedChains(t *Table) []string {
+
+	owned := map[string]bool{}
+	for _, r := range t.Managed() {
+		if r.Target != nil && !builtinChains[r.Target.Name] && t.Chain(r.Target.Name) != nil {
+			owned[r.Target.Name] = true
+		}
+	}
+	for _, c := range t.Chains {
+		if strings.HasPrefix(c.Name, ServiceChainPrefix) {
+			owned[c.Name] = true
+		}
+	}
+
+	// the chain shared with others is kept
+	for _, r := range t.Rules {
+		if r.Target != nil && !r.Managed() && !owned[r.Chain] {
+			delete(owned, r.Target.Name)
+		}
+	}
+
+	var out []string
+	for _, c := range t.Chains {
+		if owned[c.Name] {
+			out = append(out, c.Name)
+		}
+	}
+	return out
+}
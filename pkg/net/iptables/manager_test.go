@@ -1,38 +1,39 @@
 package iptables
 
 import (
-	"log"
-	"os"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/juju/errors"
 	"github.com/sxllwx/vulcanus/pkg/command"
+	"github.com/sxllwx/vulcanus/pkg/command/fake"
 	"github.com/sxllwx/vulcanus/pkg/command/local"
 	"github.com/sxllwx/vulcanus/pkg/command/remote"
 )
 
-var l = log.New(os.Stdout, "test ", log.Lshortfile|log.Ltime)
-
 func newSSHHost() (command.Interface, error) {
 
 	return remote.NewClient(&remote.Config{
 		Remote:         "192.168.240.101:22",
 		User:           "root",
 		PrivateKeyFile: "/home/scott/.remote/id_rsa",
-	}, l)
+	})
 
 }
 
 func newLocalHost() (command.Interface, error) {
 
-	return local.NewClient(&local.Config{}, l), nil
+	return local.NewTTY(), nil
 
 }
 
-func newManager() *Manager {
+func newManager(t *testing.T) *Manager {
 
 	h, err := newSSHHost()
 	if err != nil {
-		panic(err)
+		t.Skipf("the test host not available: %v", err)
 	}
 
 	return NewManager(h)
@@ -40,7 +41,7 @@ func newManager() *Manager {
 
 func TestCreateChain(t *testing.T) {
 
-	m := newManager()
+	m := newManager(t)
 
 	const (
 		MainChainName = "DESKTOP-SERVICES"
@@ -78,9 +79,229 @@ func TestCreateChain(t *testing.T) {
 
 func TestManager_CheckRule(t *testing.T) {
 
-	//m := newManager()
+	//m := newManager(t)
 
-	//if err := m.checkRule(NATTableName, PREROUTINGChainName, "-m", "comment","--comment", m.am.wrapComment("desktop services por//tal") ,"-j", "DESKTOP-SERVICES"); err != nil {
+	//if err := m.checkRule(NATTableName, PREROUTINGChainName, "-m", "comment","--comment", "desktop services portal" ,"-j", "DESKTOP-SERVICES"); err != nil {
 	//	t.Fatal(err)
 	//}
 }
+
+// the nat table with the DESKTOP-A chain, the jump created before the comment is tagged
+const testDesktopSave = `*nat
+:PREROUTING ACCEPT [0:0]
+:INPUT ACCEPT [0:0]
+:OUTPUT ACCEPT [0:0]
+:POSTROUTING ACCEPT [0:0]
+:DESKTOP-A - [0:0]
+-A PREROUTING -m comment --comment "desktop a" -j DESKTOP-A
+-A DESKTOP-A -p tcp -m tcp --dport 3000 -m comment --comment "generated by vulcanus" -j DNAT --to-destination 192.168.240.98:3000
+COMMIT
+`
+
+func TestManagerCommands(t *testing.T) {
+
+	h := fake.NewHost()
+	// neither the chain nor the rules exist
+	h.OnMatch(IptablesCommand, fake.Exact("-t"), fake.Any(), fake.Regexp("^-[SC]$"), fake.Rest()).Exit(1)
+	h.OnMatch(IptablesCommand, fake.Rest())
+	h.On(IptablesSaveCommand).Stdout(testDesktopSave)
+	h.On(IptablesRestoreCommand, "--noflush")
+
+	m := NewManager(h)
+
+	const chain = "DESKTOP-A"
+
+	if err := m.CreateChainForTable(NATTableName, chain); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.AppendChainToParentChain(NATTableName, PREROUTINGChainName, chain, "desktop a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.AppendDNATRuleToChain(chain, "tcp", "3000", "192.168.240.98:3000", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.DeleteChain(NATTableName, PREROUTINGChainName, chain, "desktop a"); err != nil {
+		t.Fatal(err)
+	}
+
+	expect := []string{
+		"iptables -t nat -S DESKTOP-A",
+		"iptables -t nat -N DESKTOP-A",
+		"iptables -t nat -C PREROUTING -m comment --comment 'generated by vulcanus: desktop a' -j DESKTOP-A",
+		"iptables -t nat -A PREROUTING -m comment --comment 'generated by vulcanus: desktop a' -j DESKTOP-A",
+		"iptables -t nat -C DESKTOP-A -p tcp -m tcp --dport 3000 -m comment --comment 'generated by vulcanus' -j DNAT --to-destination 192.168.240.98:3000",
+		"iptables -t nat -A DESKTOP-A -p tcp -m tcp --dport 3000 -m comment --comment 'generated by vulcanus' -j DNAT --to-destination 192.168.240.98:3000",
+		"iptables-save",
+		"iptables-restore --noflush",
+	}
+	if lines := h.CommandLines(); !reflect.DeepEqual(lines, expect) {
+		t.Fatalf("expect\n%s\ngot\n%s", strings.Join(expect, "\n"), strings.Join(lines, "\n"))
+	}
+
+	expectInput := `*nat
+:DESKTOP-A - [0:0]
+-D PREROUTING -m comment --comment "desktop a" -j DESKTOP-A
+-X DESKTOP-A
+COMMIT
+`
+	if input := string(h.Calls()[7].Stdin); input != expectInput {
+		t.Fatalf("expect restore input\n%s\ngot\n%s", expectInput, input)
+	}
+}
+
+func TestManagerEnsure(t *testing.T) {
+
+	h := fake.NewHost()
+	// the chain and rules already exist
+	h.OnMatch(IptablesCommand, fake.Exact("-t"), fake.Any(), fake.Regexp("^-[SC]$"), fake.Rest())
+
+	m := NewManager(h)
+
+	const chain = "DESKTOP-A"
+
+	for i := 0; i < 2; i++ {
+		if err := m.CreateChainForTable(NATTableName, chain); err != nil {
+			t.Fatal(err)
+		}
+		if err := m.AppendChainToParentChain(NATTableName, PREROUTINGChainName, chain, "desktop a"); err != nil {
+			t.Fatal(err)
+		}
+		if err := m.AppendDNATRuleToChain(chain, "tcp", "3000", "192.168.240.98:3000", ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// only the checks, the other commands have no scripted response
+	if n := len(h.Calls()); n != 6 {
+		t.Fatalf("unexpected calls %q", h.CommandLines())
+	}
+}
+
+func TestManagerDeleteChainFailed(t *testing.T) {
+
+	h := fake.NewHost()
+	h.On(IptablesSaveCommand).Stdout(testDesktopSave)
+	h.On(IptablesRestoreCommand, "--noflush").
+		Stderr("iptables-restore: line 4 failed\n").
+		Exit(1)
+
+	m := NewManager(h)
+
+	err := m.DeleteChain(NATTableName, PREROUTINGChainName, "DESKTOP-A", "desktop a")
+	if err == nil || !strings.Contains(err.Error(), "line 4 failed") {
+		t.Fatalf("expect the restore error, got %v", err)
+	}
+	// a single transaction, no partial step is run
+	if n := len(h.Calls()); n != 2 {
+		t.Fatalf("unexpected calls %q", h.CommandLines())
+	}
+}
+
+func TestManagerDeleteChainMissing(t *testing.T) {
+
+	h := fake.NewHost()
+	h.On(IptablesSaveCommand).Stdout(testEmptyNATSave)
+
+	m := NewManager(h)
+
+	if err := m.DeleteChain(NATTableName, PREROUTINGChainName, "DESKTOP-A", "desktop a"); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(h.Calls()); n != 1 {
+		t.Fatalf("unexpected calls %q", h.CommandLines())
+	}
+}
+
+const testResetSave = `*nat
+:PREROUTING ACCEPT [0:0]
+:INPUT ACCEPT [0:0]
+:OUTPUT ACCEPT [0:0]
+:POSTROUTING ACCEPT [0:0]
+:DOCKER - [0:0]
+:DESKTOP-A - [0:0]
+:SHARED - [0:0]
+-A PREROUTING -m addrtype --dst-type LOCAL -j DOCKER
+-A PREROUTING -m comment --comment "generated by vulcanus: desktop a" -j DESKTOP-A
+-A PREROUTING -m comment --comment "generated by vulcanus" -j SHARED
+-A OUTPUT -j SHARED
+-A POSTROUTING -s 172.17.0.0/16 ! -o docker0 -j MASQUERADE
+-A POSTROUTING -m comment --comment "generated by vulcanus" -j MASQUERADE
+-A DOCKER -i docker0 -j RETURN
+-A DESKTOP-A -p tcp -m tcp --dport 3000 -m comment --comment "generated by vulcanus" -j DNAT --to-destination 192.168.240.98:3000
+COMMIT
+*filter
+:INPUT ACCEPT [0:0]
+:FORWARD DROP [0:0]
+:OUTPUT ACCEPT [0:0]
+:DOCKER - [0:0]
+-A FORWARD -o docker0 -j DOCKER
+COMMIT
+`
+
+func TestManagerReset(t *testing.T) {
+
+	h := fake.NewHost()
+	h.On(IptablesSaveCommand).Stdout(testResetSave)
+	h.On(IptablesRestoreCommand, "--noflush")
+
+	m := NewManager(h)
+	if err := m.Reset(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the docker rules and the chain shared with others are kept
+	expect := `*nat
+:DESKTOP-A - [0:0]
+-D PREROUTING -m comment --comment "generated by vulcanus: desktop a" -j DESKTOP-A
+-D PREROUTING -m comment --comment "generated by vulcanus" -j SHARED
+-D POSTROUTING -m comment --comment "generated by vulcanus" -j MASQUERADE
+-X DESKTOP-A
+COMMIT
+`
+	calls := h.Calls()
+	if len(calls) != 2 {
+		t.Fatalf("unexpected calls %q", h.CommandLines())
+	}
+	if input := string(calls[1].Stdin); input != expect {
+		t.Fatalf("expect restore input\n%s\ngot\n%s", expect, input)
+	}
+}
+
+func TestManagerError(t *testing.T) {
+
+	h := fake.NewHost()
+	h.On(IptablesCommand, "-t", NATTableName, "-S", "EXIST").Exit(1)
+	h.On(IptablesCommand, "-t", NATTableName, "-N", "EXIST").
+		Stderr("iptables: Chain already exists.\n").
+		Exit(1)
+
+	m := NewManager(h)
+
+	err := m.CreateChainForTable(NATTableName, "EXIST")
+	if command.ExitCode(errors.Cause(err)) != 1 {
+		t.Fatalf("expect exit 1, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "Chain already exists") {
+		t.Fatalf("expect the stderr in err, got %v", err)
+	}
+}
+
+func TestManagerTimeout(t *testing.T) {
+
+	h := fake.NewHost()
+	h.OnMatch(IptablesSaveCommand, fake.Rest()).Delay(time.Second)
+
+	m := NewManager(h)
+	m.SetTimeout(50 * time.Millisecond)
+
+	start := time.Now()
+	if err := m.Reset(); err == nil {
+		t.Fatal("expect timeout")
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Fatalf("the timeout not respected, took %s", d)
+	}
+	if n := len(h.Calls()); n != 1 {
+		t.Fatalf("expect stop after the first timeout, got %d calls", n)
+	}
+}
@@ -0,0 +1,415 @@
+package iptables
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/juju/errors"
+)
+
+// the built-in chains can not be owned
+var builtinChains = map[string]bool{
+	PREROUTINGChainName:  true,
+	INPUTChainName:       true,
+	"FORWARD":            true,
+	OUTPUTChainName:      true,
+	POSTROUTINGChainName: true,
+}
+
+// TableState
+// the desired state of a table
+type TableState struct {
+	// eg: nat, filter
+	Table string
+
+	// the chains owned by vulcanus, their rules are replaced entirely
+	Chains []Chain
+
+	// the rules in the chains not owned, eg: the jump from PREROUTING,
+	// only the rules tagged by the DefaultComment are managed, the others are kept
+	Rules []Rule
+
+	// the existing chains with the prefix but not in Chains are deleted,
+	// empty means never delete the chain
+	ChainPrefix string
+}
+
+// Chain
+// the owned chain
+type Chain struct {
+	Name string
+	// the args of every rule after "-A chain"
+	Rules [][]string
+}
+
+// Rule
+// the rule in the chain not owned
+type Rule struct {
+	Chain string
+	// the args after "-A chain"
+	Args []string
+}
+
+func (r Rule) String() string {
+	return "-A " + r.Chain + " " + joinRule(r.Args)
+}
+
+// Changes
+// the difference applied to a table
+type Changes struct {
+	Table string
+	// the owned chains created or rewritten
+	UpdatedChains []string
+	// the stale owned chains deleted
+	DeletedChains []string
+	// the managed rules in the chains not owned
+	AddedRules   []Rule
+	DeletedRules []Rule
+}
+
+// Empty
+// the table already in the desired state
+func (c *Changes) Empty() bool {
+	return len(c.UpdatedChains)+len(c.DeletedChains)+len(c.AddedRules)+len(c.DeletedRules) == 0
+}
+
+// tagComment
+// make sure the rule tagged by the DefaultComment, the comment of the rule is kept after the tag
+// eg: --comment "desktop a" -> --comment "generated by vulcanus: desktop a"
+func tagComment(args []string) []string {
+
+	out := append([]string{}, args...)
+	for i := 0; i < len(out)-1; i++ {
+		if out[i] != "--comment" {
+			continue
+		}
+		out[i+1] = Tag(out[i+1])
+		return out
+	}
+	return append([]string{"-m", "comment", "--comment", DefaultComment}, out...)
+}
+
+// Tag
+// the comment tagged by the DefaultComment, the empty comment is the DefaultComment itself,
+// so the rules of vulcanus can be found by Reset
+func Tag(comment string) string {
+
+	switch {
+	case len(comment) == 0:
+		return DefaultComment
+	case isTagged(comment):
+		return comment
+	default:
+		return DefaultComment + ": " + comment
+	}
+}
+
+func isTagged(comment string) bool {
+	return comment == DefaultComment || strings.HasPrefix(comment, DefaultComment+": ")
+}
+
+func sameArgs(a, b []string) bool {
+
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func sameRules(a, b [][]string) bool {
+
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !sameArgs(a[i], b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func containsArgs(rules [][]string, args []string) bool {
+
+	for _, r := range rules {
+		if sameArgs(r, args) {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate
+// check the desired state
+func (s *TableState) Validate() error {
+
+	if len(s.Table) == 0 {
+		return errors.New("empty table")
+	}
+
+	owned := map[string]bool{}
+	for _, c := range s.Chains {
+		if len(c.Name) == 0 {
+			return errors.Errorf("empty chain name in table %s", s.Table)
+		}
+		if builtinChains[c.Name] {
+			return errors.Errorf("the built-in chain %s can not be owned", c.Name)
+		}
+		if owned[c.Name] {
+			return errors.Errorf("duplicate chain %s in table %s", c.Name, s.Table)
+		}
+		owned[c.Name] = true
+	}
+
+	for _, r := range s.Rules {
+		if owned[r.Chain] {
+			return errors.Errorf("the rule (%s) should be in the Rules of owned chain %s", r, r.Chain)
+		}
+	}
+	return nil
+}
+
+// ruleArgs
+// the args of the rules in the chain
+func ruleArgs(t *Table, chain string) [][]string {
+
+	var out [][]string
+	for _, r := range t.RulesOf(chain) {
+		out = append(out, r.Args())
+	}
+	return out
+}
+
+// diff
+// the changes from current to desired, the current may be nil if the table is not loaded,
+// the chains and rules of the shared states (the others desired in the same table) are kept
+func (s *TableState) diff(current *Table, shared ...*TableState) *Changes {
+
+	if current == nil {
+		current = &Table{Name: s.Table}
+	}
+
+	out := &Changes{Table: s.Table}
+
+	desired := map[string]bool{}
+	for _, c := range s.Chains {
+		desired[c.Name] = true
+		if current.Chain(c.Name) == nil || !sameRules(ruleArgs(current, c.Name), c.Rules) {
+			out.UpdatedChains = append(out.UpdatedChains, c.Name)
+		}
+	}
+
+	// the managed rules in the chains not owned
+	want := map[string][][]string{}
+	for _, r := range s.Rules {
+		want[r.Chain] = append(want[r.Chain], tagComment(r.Args))
+	}
+
+	kept := map[string]bool{}
+	for _, o := range shared {
+		for _, c := range o.Chains {
+			kept[c.Name] = true
+		}
+		for _, r := range o.Rules {
+			want[r.Chain] = append(want[r.Chain], tagComment(r.Args))
+		}
+	}
+
+	deleted := map[string]bool{}
+	if len(s.ChainPrefix) != 0 {
+		for _, c := range current.Chains {
+			if strings.HasPrefix(c.Name, s.ChainPrefix) && !desired[c.Name] && !kept[c.Name] {
+				out.DeletedChains = append(out.DeletedChains, c.Name)
+				deleted[c.Name] = true
+			}
+		}
+	}
+
+	for _, r := range current.Rules {
+		if desired[r.Chain] || kept[r.Chain] || deleted[r.Chain] || !r.Managed() {
+			continue
+		}
+		if args := r.Args(); !containsArgs(want[r.Chain], args) {
+			out.DeletedRules = append(out.DeletedRules, Rule{Chain: r.Chain, Args: args})
+		}
+	}
+
+	for _, r := range s.Rules {
+		args := tagComment(r.Args)
+		if !containsArgs(ruleArgs(current, r.Chain), args) {
+			out.AddedRules = append(out.AddedRules, Rule{Chain: r.Chain, Args: args})
+		}
+	}
+	return out
+}
+
+// restoreInput
+// the iptables-restore input of the changes
+// the order is: declare (flush) the chains, delete the stale rules, fill the chains, add the rules, delete the stale chains
+func (s *TableState) restoreInput(c *Changes, w *bytes.Buffer) {
+
+	fmt.Fprintf(w, "*%s\n", s.Table)
+
+	for _, name := range c.UpdatedChains {
+		fmt.Fprintf(w, ":%s - [0:0]\n", name)
+	}
+	for _, name := range c.DeletedChains {
+		fmt.Fprintf(w, ":%s - [0:0]\n", name)
+	}
+
+	for _, r := range c.DeletedRules {
+		fmt.Fprintf(w, "-D %s %s\n", r.Chain, joinRule(r.Args))
+	}
+
+	updated := map[string]bool{}
+	for _, name := range c.UpdatedChains {
+		updated[name] = true
+	}
+	for _, chain := range s.Chains {
+		if !updated[chain.Name] {
+			continue
+		}
+		for _, args := range chain.Rules {
+			fmt.Fprintf(w, "-A %s %s\n", chain.Name, joinRule(args))
+		}
+	}
+
+	for _, r := range c.AddedRules {
+		fmt.Fprintf(w, "%s\n", r)
+	}
+
+	for _, name := range c.DeletedChains {
+		fmt.Fprintf(w, "-X %s\n", name)
+	}
+
+	w.WriteString("COMMIT\n")
+}
+
+// Save
+// the current rules of all the tables on the host
+func (m *Manager) Save() (*Ruleset, error) {
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	return m.save()
+}
+
+func (m *Manager) save() (*Ruleset, error) {
+
+	r, err := m.execute(m.commands.save)
+	if err != nil {
+		return nil, errors.Annotate(err, m.commands.save)
+	}
+
+	rs, err := ParseSave(bytes.NewReader(r.Stdout))
+	if err != nil {
+		return nil, errors.Annotate(err, "parse iptables-save output")
+	}
+	return rs, nil
+}
+
+// Reconcile
+// make the tables in the desired state, the current state is read by iptables-save,
+// and the difference is applied by iptables-restore --noflush, atomically per table,
+// the rules and chains not managed by vulcanus are never touched
+//
+// the rules are compared with the iptables-save output, write them in the same form
+// (eg: -p tcp -m tcp --dport 80, -d 10.0.0.1/32), or they will be rewritten every time
+//
+// the states replace the ones reconciled before for the same table, and they are kept for Resync,
+// so it should not be changed after; the forwarded services and the rules ensured in the table are kept
+func (m *Manager) Reconcile(desired ...*TableState) ([]*Changes, error) {
+
+	for _, s := range desired {
+		if err := s.Validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.states == nil {
+		m.states = map[string][]*TableState{}
+	}
+	old := map[string][]*TableState{}
+	var tables []string
+	for _, s := range desired {
+		if _, ok := old[s.Table]; !ok {
+			old[s.Table] = m.states[s.Table]
+			m.states[s.Table] = nil
+			tables = append(tables, s.Table)
+		}
+		m.states[s.Table] = append(m.states[s.Table], s)
+	}
+
+	changes, err := m.sync(tables...)
+	if err != nil {
+		// keep the desired state same as the host
+		for table, states := range old {
+			if states == nil {
+				delete(m.states, table)
+			} else {
+				m.states[table] = states
+			}
+		}
+		return nil, err
+	}
+	return changes, nil
+}
+
+// reconcile
+// apply the difference from the current to the desired states without the lock,
+// the states of the same table keep the chains and rules of each other, and the rules ensured in the table are kept too
+func (m *Manager) reconcile(current *Ruleset, desired ...*TableState) ([]*Changes, error) {
+
+	var (
+		out   []*Changes
+		input = &bytes.Buffer{}
+	)
+	for i, s := range desired {
+		var shared []*TableState
+		for j, o := range desired {
+			if j != i && o.Table == s.Table {
+				shared = append(shared, o)
+			}
+		}
+		if e := m.ensuredState(s.Table); e != nil {
+			shared = append(shared, e)
+		}
+
+		c := s.diff(current.Table(s.Table), shared...)
+		out = append(out, c)
+		if !c.Empty() {
+			s.restoreInput(c, input)
+		}
+	}
+
+	if input.Len() == 0 {
+		return out, nil
+	}
+
+	if err := m.restore(input.Bytes()); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// restore
+// apply the input by iptables-restore --noflush, every table is committed atomically by its COMMIT,
+// but the tables are committed one by one, if the input of many tables failed (eg: Reset),
+// the tables before the failed one are already applied
+func (m *Manager) restore(input []byte) error {
+
+	if _, err := m.executeWithInput(input, m.commands.restore, "--noflush"); err != nil {
+		return errors.Annotatef(err, "%s\n%s", m.commands.restore, input)
+	}
+	return nil
+}
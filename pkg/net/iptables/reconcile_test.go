@@ -0,0 +1,138 @@
+package iptables
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/sxllwx/vulcanus/pkg/command/fake"
+)
+
+const testSave = `# Generated by iptables-save v1.8.4 on Mon Jan  6 10:00:00 2020
+*nat
+:PREROUTING ACCEPT [10:600]
+:INPUT ACCEPT [0:0]
+:OUTPUT ACCEPT [0:0]
+:POSTROUTING ACCEPT [0:0]
+:DOCKER - [0:0]
+:VULCANUS-A - [0:0]
+:VULCANUS-STALE - [0:0]
+-A PREROUTING -m addrtype --dst-type LOCAL -j DOCKER
+-A PREROUTING -m comment --comment "generated by vulcanus: desktop a" -j VULCANUS-A
+-A PREROUTING -m comment --comment "generated by vulcanus" -j VULCANUS-STALE
+-A VULCANUS-A -p tcp -m tcp --dport 3000 -j DNAT --to-destination 192.168.240.98:3000
+-A VULCANUS-STALE -m comment --comment "generated by vulcanus" -j RETURN
+COMMIT
+`
+
+func TestReconcile(t *testing.T) {
+
+	h := fake.NewHost()
+	h.On(IptablesSaveCommand).Stdout(testSave)
+	h.On(IptablesRestoreCommand, "--noflush")
+
+	m := NewManager(h)
+
+	desired := &TableState{
+		Table: NATTableName,
+		Chains: []Chain{
+			{Name: "VULCANUS-A", Rules: [][]string{
+				{"-p", "tcp", "-m", "tcp", "--dport", "3000", "-j", DNAT, "--to-destination", "192.168.240.98:3000"},
+			}},
+			{Name: "VULCANUS-B", Rules: [][]string{
+				{"-p", "tcp", "-m", "tcp", "--dport", "4000", "-j", DNAT, "--to-destination", "192.168.240.99:4000"},
+			}},
+		},
+		Rules: []Rule{
+			{Chain: PREROUTINGChainName, Args: []string{"-m", "comment", "--comment", "desktop a", "-j", "VULCANUS-A"}},
+			{Chain: PREROUTINGChainName, Args: []string{"-j", "VULCANUS-B"}},
+		},
+		ChainPrefix: "VULCANUS-",
+	}
+
+	changes, err := m.Reconcile(desired)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := changes[0]
+	if strings.Join(c.UpdatedChains, ",") != "VULCANUS-B" ||
+		strings.Join(c.DeletedChains, ",") != "VULCANUS-STALE" ||
+		len(c.AddedRules) != 1 || len(c.DeletedRules) != 1 {
+		t.Fatalf("unexpected changes %+v", c)
+	}
+
+	calls := h.Calls()
+	if len(calls) != 2 {
+		t.Fatalf("unexpected calls %q", h.CommandLines())
+	}
+
+	expect := `*nat
+:VULCANUS-B - [0:0]
+:VULCANUS-STALE - [0:0]
+-D PREROUTING -m comment --comment "generated by vulcanus" -j VULCANUS-STALE
+-A VULCANUS-B -p tcp -m tcp --dport 4000 -j DNAT --to-destination 192.168.240.99:4000
+-A PREROUTING -m comment --comment "generated by vulcanus" -j VULCANUS-B
+-X VULCANUS-STALE
+COMMIT
+`
+	if a := string(calls[1].Stdin); a != expect {
+		t.Fatalf("expect restore input\n%s\ngot\n%s", expect, a)
+	}
+}
+
+func TestReconcileNoChange(t *testing.T) {
+
+	h := fake.NewHost()
+	h.On(IptablesSaveCommand).Stdout(testSave)
+
+	m := NewManager(h)
+
+	changes, err := m.Reconcile(&TableState{
+		Table: NATTableName,
+		Chains: []Chain{
+			{Name: "VULCANUS-A", Rules: [][]string{
+				{"-p", "tcp", "-m", "tcp", "--dport", "3000", "-j", DNAT, "--to-destination", "192.168.240.98:3000"},
+			}},
+			{Name: "VULCANUS-STALE", Rules: [][]string{
+				{"-m", "comment", "--comment", DefaultComment, "-j", "RETURN"},
+			}},
+		},
+		Rules: []Rule{
+			{Chain: PREROUTINGChainName, Args: []string{"-m", "comment", "--comment", "desktop a", "-j", "VULCANUS-A"}},
+			{Chain: PREROUTINGChainName, Args: []string{"-j", "VULCANUS-STALE"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !changes[0].Empty() {
+		t.Fatalf("expect no change, got %+v", changes[0])
+	}
+	// the docker rules are untouched, and no restore
+	if len(h.Calls()) != 1 {
+		t.Fatalf("unexpected calls %q", h.CommandLines())
+	}
+}
+
+func TestReconcileValidate(t *testing.T) {
+
+	m := NewManager(fake.NewHost())
+
+	if _, err := m.Reconcile(&TableState{Table: NATTableName, Chains: []Chain{{Name: PREROUTINGChainName}}}); err == nil {
+		t.Fatal("expect the built-in chain rejected")
+	}
+}
+
+func TestSplitRuleLine(t *testing.T) {
+
+	args, err := splitRuleLine(`-A X -m comment --comment "say \"hi\" to vulcanus" -j RETURN`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(args) != 8 || args[5] != `say "hi" to vulcanus` {
+		t.Fatalf("unexpected args %q", args)
+	}
+	if joinRule(args) != `-A X -m comment --comment "say \"hi\" to vulcanus" -j RETURN` {
+		t.Fatalf("unexpected line %s", joinRule(args))
+	}
+}
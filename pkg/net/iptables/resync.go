@@ -0,0 +1,366 @@
+package iptables
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/sxllwx/vulcanus/pkg/log"
+	"github.com/sxllwx/vulcanus/pkg/watch"
+)
+
+// ResyncConfig
+// the drift detection of the desired state registered to the manager
+type ResyncConfig struct {
+	// compare the host with the desired state every interval
+	Interval time.Duration
+
+	// the backoff of the failed resync, doubled every failure until MaxBackoff,
+	// the Interval is restored after a success
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+
+	// the drift is sent as the watch.Update event with the *Drift, nil means log only
+	Broadcaster watch.SynchronizedBroadCaster
+}
+
+// Complete
+// set default value for ResyncConfig
+func (c *ResyncConfig) Complete() {
+
+	if c.Interval == 0 {
+		c.Interval = time.Minute
+	}
+	if c.InitialBackoff == 0 {
+		c.InitialBackoff = time.Second
+	}
+	if c.MaxBackoff == 0 {
+		c.MaxBackoff = 5 * time.Minute
+	}
+}
+
+// Drift
+// the difference found on the host and re-applied,
+// the Err is not nil if the re-apply failed, the drift may still exist
+type Drift struct {
+	Time    time.Time
+	Changes []*Changes
+	Err     error
+}
+
+// String
+// the summary of the drift, eg: nat: 1 chains updated, 2 rules added
+func (d *Drift) String() string {
+
+	var out []string
+	for _, c := range d.Changes {
+		if c.Empty() {
+			continue
+		}
+
+		var parts []string
+		if n := len(c.UpdatedChains); n != 0 {
+			parts = append(parts, plural(n, "chain")+" updated")
+		}
+		if n := len(c.DeletedChains); n != 0 {
+			parts = append(parts, plural(n, "chain")+" deleted")
+		}
+		if n := len(c.AddedRules); n != 0 {
+			parts = append(parts, plural(n, "rule")+" added")
+		}
+		if n := len(c.DeletedRules); n != 0 {
+			parts = append(parts, plural(n, "rule")+" deleted")
+		}
+		out = append(out, c.Table+": "+strings.Join(parts, ", "))
+	}
+
+	if d.Err != nil {
+		out = append(out, "error: "+d.Err.Error())
+	}
+	return strings.Join(out, "; ")
+}
+
+func plural(n int, s string) string {
+
+	if n == 1 {
+		return "1 " + s
+	}
+	return strconv.Itoa(n) + " " + s + "s"
+}
+
+// Resync
+// compare the desired state registered to the manager with the host, and re-apply the missing part,
+// the desired state is: the chains created by CreateChainForTable, the states of Reconcile,
+// the services of Forward (loaded from the host by the fresh process) and the rules ensured by EnsureRule and the Append*,
+// the changes are empty if the host is in the desired state
+func (m *Manager) Resync() ([]*Changes, error) {
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if err := m.loadServices(); err != nil {
+		return nil, errors.Annotate(err, "iptables resync")
+	}
+
+	var out []*Changes
+
+	// the chains first, the states and the rules may jump to them
+	for _, c := range m.chains {
+		created, err := m.createChain(c.table, c.chain)
+		if err != nil {
+			return out, errors.Annotate(err, "iptables resync")
+		}
+		if created {
+			changes := changesOf(&out, c.table)
+			changes.UpdatedChains = append(changes.UpdatedChains, c.chain)
+		}
+	}
+
+	if tables := m.desiredTables(); len(tables) != 0 {
+		changes, err := m.sync(tables...)
+		if err != nil {
+			return out, errors.Annotate(err, "iptables resync")
+		}
+		for _, c := range changes {
+			merged := changesOf(&out, c.Table)
+			merged.UpdatedChains = append(merged.UpdatedChains, c.UpdatedChains...)
+			merged.DeletedChains = append(merged.DeletedChains, c.DeletedChains...)
+			merged.AddedRules = append(merged.AddedRules, c.AddedRules...)
+			merged.DeletedRules = append(merged.DeletedRules, c.DeletedRules...)
+		}
+	}
+
+	for _, r := range m.rules {
+		added, err := m.ensureRule(r)
+		if err != nil {
+			return out, errors.Annotatef(err, "iptables resync rule (%s) in table (%s)", r.rule, r.table)
+		}
+		if added {
+			changes := changesOf(&out, r.table)
+			changes.AddedRules = append(changes.AddedRules, r.rule)
+		}
+	}
+	return out, nil
+}
+
+// changesOf
+// the changes of the table in the list, appended if not found
+func changesOf(list *[]*Changes, table string) *Changes {
+
+	for _, c := range *list {
+		if c.Table == table {
+			return c
+		}
+	}
+	c := &Changes{Table: table}
+	*list = append(*list, c)
+	return c
+}
+
+// ensuredChain
+// the chain created by CreateChainForTable
+type ensuredChain struct {
+	table string
+	chain string
+}
+
+// ensuredRule
+// the rule appended by EnsureRule
+type ensuredRule struct {
+	table string
+	rule  Rule
+	// the argv of iptables -C and -A
+	check  []string
+	append []string
+}
+
+func newEnsuredRule(b *RuleBuilder) (ensuredRule, error) {
+
+	r := ensuredRule{table: b.table}
+
+	var err error
+	if r.rule, err = b.Rule(); err != nil {
+		return r, err
+	}
+	if r.check, err = b.CheckArgs(); err != nil {
+		return r, err
+	}
+	if r.append, err = b.AppendArgs(); err != nil {
+		return r, err
+	}
+	return r, nil
+}
+
+// registerChain
+// keep the chain for Resync, the lock should be held
+func (m *Manager) registerChain(table string, chain string) {
+
+	for _, c := range m.chains {
+		if c.table == table && c.chain == chain {
+			return
+		}
+	}
+	m.chains = append(m.chains, ensuredChain{table: table, chain: chain})
+}
+
+// registerRule
+// keep the rule for Resync, the lock should be held
+func (m *Manager) registerRule(r ensuredRule) {
+
+	for _, e := range m.rules {
+		if sameArgs(e.append, r.append) {
+			return
+		}
+	}
+	m.rules = append(m.rules, r)
+}
+
+// unregisterRules
+// forget the rules matched, the lock should be held
+func (m *Manager) unregisterRules(match func(ensuredRule) bool) {
+
+	kept := m.rules[:0]
+	for _, r := range m.rules {
+		if !match(r) {
+			kept = append(kept, r)
+		}
+	}
+	m.rules = kept
+}
+
+// unregisterChain
+// forget the chain, the rules in it and the jumps to it, the lock should be held
+func (m *Manager) unregisterChain(table string, chain string) {
+
+	kept := m.chains[:0]
+	for _, c := range m.chains {
+		if c.table != table || c.chain != chain {
+			kept = append(kept, c)
+		}
+	}
+	m.chains = kept
+
+	m.unregisterRules(func(r ensuredRule) bool {
+		if r.table != table {
+			return false
+		}
+		args := r.rule.Args
+		jump := len(args) >= 2 && args[len(args)-2] == "-j" && args[len(args)-1] == chain
+		return r.rule.Chain == chain || jump
+	})
+}
+
+// ensuredState
+// the rules ensured in the table, they are kept by reconcile, nil if none
+func (m *Manager) ensuredState(table string) *TableState {
+
+	var rules []Rule
+	for _, r := range m.rules {
+		if r.table == table {
+			rules = append(rules, r.rule)
+		}
+	}
+	if len(rules) == 0 {
+		return nil
+	}
+	return &TableState{Table: table, Rules: rules}
+}
+
+// desiredTables
+// the tables of the registered states sorted
+func (m *Manager) desiredTables() []string {
+
+	var tables []string
+	for table := range m.states {
+		tables = append(tables, table)
+	}
+	if _, ok := m.states[NATTableName]; m.servicesManaged && !ok {
+		tables = append(tables, NATTableName)
+	}
+	sort.Strings(tables)
+	return tables
+}
+
+// sync
+// apply all the registered states of the tables in one iptables-save and iptables-restore,
+// the services are loaded from the saved rules if not yet, the lock should be held
+func (m *Manager) sync(tables ...string) ([]*Changes, error) {
+
+	current, err := m.save()
+	if err != nil {
+		return nil, err
+	}
+	m.loadServicesFrom(current)
+
+	var desired []*TableState
+	for _, table := range tables {
+		desired = append(desired, m.states[table]...)
+		if table == NATTableName && m.servicesManaged {
+			s, err := m.servicesState()
+			if err != nil {
+				return nil, err
+			}
+			desired = append(desired, s)
+		}
+	}
+	return m.reconcile(current, desired...)
+}
+
+// RunResync
+// resync the manager periodically until the ctx done, the drift is logged and broadcast,
+// the failed resync is retried with backoff
+func (m *Manager) RunResync(ctx context.Context, cfg ResyncConfig) {
+
+	cfg.Complete()
+
+	var (
+		wait    = cfg.Interval
+		backoff = cfg.InitialBackoff
+	)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+
+		changes, err := m.Resync()
+
+		d := &Drift{Time: time.Now(), Changes: changes, Err: err}
+		drifted := false
+		for _, c := range changes {
+			if !c.Empty() {
+				drifted = true
+			}
+		}
+
+		switch {
+		case err != nil:
+			log.Errorf("iptables resync failed, retry after %s: %v", backoff, err)
+		case drifted:
+			log.Warnf("iptables drift repaired: %s", d)
+		}
+
+		if (err != nil || drifted) && cfg.Broadcaster != nil {
+			if err := cfg.Broadcaster.Action(watch.Update, d); err != nil {
+				log.Warnf("broadcast iptables drift: %v", err)
+			}
+		}
+
+		if err == nil {
+			wait = cfg.Interval
+			backoff = cfg.InitialBackoff
+			continue
+		}
+
+		wait = backoff
+		backoff *= 2
+		if backoff > cfg.MaxBackoff {
+			backoff = cfg.MaxBackoff
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package iptables
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sxllwx/vulcanus/pkg/command/fake"
+	"github.com/sxllwx/vulcanus/pkg/watch"
+)
+
+func TestResync(t *testing.T) {
+
+	h := fake.NewHost()
+	h.On(IptablesSaveCommand).Stdout(testServiceSave).Once()
+	// the rules flushed by others
+	h.On(IptablesSaveCommand).Stdout(testEmptyNATSave)
+	h.On(IptablesRestoreCommand, "--noflush")
+
+	m := NewManager(h)
+	if err := m.Forward("web", "tcp", 8080, testWebBackends); err != nil {
+		t.Fatal(err)
+	}
+
+	changes, err := m.Resync()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 1 || len(changes[0].UpdatedChains) != 3 || len(changes[0].AddedRules) != 3 {
+		t.Fatalf("unexpected changes %+v", changes)
+	}
+
+	d := &Drift{Changes: changes}
+	if d.String() != "nat: 3 chains updated, 3 rules added" {
+		t.Fatalf("unexpected drift %s", d)
+	}
+}
+
+func TestResyncEnsuredRule(t *testing.T) {
+
+	h := fake.NewHost()
+	h.On(IptablesSaveCommand).Stdout(testEmptyNATSave)
+	// the rule not exist when ensured, then deleted by others before the first resync
+	h.OnMatch(IptablesCommand, fake.Exact("-t"), fake.Any(), fake.Exact("-C"), fake.Rest()).Exit(1).Once()
+	h.OnMatch(IptablesCommand, fake.Exact("-t"), fake.Any(), fake.Exact("-C"), fake.Rest()).Exit(1).Once()
+	h.OnMatch(IptablesCommand, fake.Rest())
+
+	m := NewManager(h)
+	ssh := NewRule(FilterTableName, INPUTChainName).
+		Protocol("tcp").
+		DestinationPort(Port(22)).
+		Comment(Tag("ssh")).
+		Jump(Accept())
+	if err := m.EnsureRule(ssh); err != nil {
+		t.Fatal(err)
+	}
+
+	changes, err := m.Resync()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := (&Drift{Changes: changes}); d.String() != "filter: 1 rule added" {
+		t.Fatalf("unexpected drift %s", d)
+	}
+
+	append, _ := ssh.AppendArgs()
+	calls := h.Calls()
+	if last := calls[len(calls)-1]; !sameArgs(last.Args, append) {
+		t.Fatalf("expect the rule restored by %q, got %q", append, last.Args)
+	}
+
+	// the rule exists now
+	changes, err = m.Resync()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := (&Drift{Changes: changes}); len(d.String()) != 0 {
+		t.Fatalf("unexpected drift %s", d)
+	}
+
+	// the deleted rule is not restored
+	if err := m.DeleteRule(ssh); err != nil {
+		t.Fatal(err)
+	}
+	n := len(h.Calls())
+	if _, err := m.Resync(); err != nil {
+		t.Fatal(err)
+	}
+	if len(h.Calls()) != n {
+		t.Fatalf("unexpected calls %q", h.CommandLines()[n:])
+	}
+}
+
+func TestResyncLoadServices(t *testing.T) {
+
+	h := fake.NewHost()
+	// the services forwarded by the previous process, then flushed by others
+	h.On(IptablesSaveCommand).Stdout(testServiceSave).Once()
+	h.On(IptablesSaveCommand).Stdout(testEmptyNATSave)
+	h.On(IptablesRestoreCommand, "--noflush")
+
+	m := NewManager(h)
+	changes, err := m.Resync()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := (&Drift{Changes: changes}); d.String() != "nat: 3 chains updated, 3 rules added" {
+		t.Fatalf("unexpected drift %s", d)
+	}
+}
+
+func TestResyncAfterUnforward(t *testing.T) {
+
+	h := fake.NewHost()
+	// the service chain is still on the host, re-created by others after the Unforward
+	h.On(IptablesSaveCommand).Stdout(testServiceSave)
+	h.On(IptablesRestoreCommand, "--noflush")
+
+	m := NewManager(h)
+	if err := m.Unforward("web"); err != nil {
+		t.Fatal(err)
+	}
+
+	changes, err := m.Resync()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 1 || len(changes[0].DeletedChains) != 1 || changes[0].DeletedChains[0] != "VULCANUS-SVC-4B5E57F6EB2F" {
+		t.Fatalf("unexpected changes %+v", changes)
+	}
+}
+
+func TestRunResync(t *testing.T) {
+
+	h := fake.NewHost()
+	h.On(IptablesSaveCommand).Stdout(testEmptyNATSave)
+	h.On(IptablesRestoreCommand, "--noflush").Once()
+	h.On(IptablesRestoreCommand, "--noflush").Stderr("iptables-restore: line 2 failed").Exit(1).Once()
+	h.On(IptablesRestoreCommand, "--noflush")
+
+	m := NewManager(h)
+	if err := m.Forward("web", "tcp", 8080, testWebBackends); err != nil {
+		t.Fatal(err)
+	}
+
+	b := watch.New(10, watch.DropIfChannelFull)
+	defer b.Shutdown()
+
+	w, err := b.Watch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Stop()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go m.RunResync(ctx, ResyncConfig{
+		Interval:       10 * time.Millisecond,
+		InitialBackoff: time.Millisecond,
+		Broadcaster:    b,
+	})
+
+	// the failed resync, then repaired after the backoff
+	for i, expectErr := range []bool{true, false} {
+		select {
+		case e := <-w.ResultChan():
+			d := e.Object.(*Drift)
+			if e.Type != watch.Update || (d.Err != nil) != expectErr {
+				t.Fatalf("unexpected event %d: %v %s", i, e.Type, d)
+			}
+			if !expectErr && !strings.HasPrefix(d.String(), "nat: ") {
+				t.Fatalf("unexpected drift %s", d)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("expect the drift event %d", i)
+		}
+	}
+}
@@ -0,0 +1,648 @@
+package iptables
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/juju/errors"
+)
+
+// more actions
+const (
+	RETURN   = "RETURN"
+	REJECT   = "REJECT"
+	LOG      = "LOG"
+	REDIRECT = "REDIRECT"
+	MARK     = "MARK"
+)
+
+// conntrack states
+const (
+	StateNew         = "NEW"
+	StateEstablished = "ESTABLISHED"
+	StateRelated     = "RELATED"
+	StateInvalid     = "INVALID"
+	StateUntracked   = "UNTRACKED"
+)
+
+var validStates = map[string]bool{
+	StateNew:         true,
+	StateEstablished: true,
+	StateRelated:     true,
+	StateInvalid:     true,
+	StateUntracked:   true,
+	"SNAT":           true,
+	"DNAT":           true,
+}
+
+// the protocols support the port match
+var portProtocols = map[string]bool{
+	"tcp":     true,
+	"udp":     true,
+	"udplite": true,
+	"sctp":    true,
+	"dccp":    true,
+}
+
+// the max ports of the multiport match, the range count as 2
+const maxMultiports = 15
+
+// the max length of the LOG prefix
+const maxLogPrefix = 29
+
+var (
+	limitRate     = regexp.MustCompile(`^[0-9]+/(second|sec|s|minute|min|m|hour|h|day|d)$`)
+	interfaceName = regexp.MustCompile(`^[a-zA-Z0-9_.:@-]{1,15}\+?$`)
+)
+
+// PortRange
+// the port or port range, the To is 0 for a single port
+type PortRange struct {
+	From uint16
+	To   uint16
+}
+
+// Port
+// a single port
+func Port(p uint16) PortRange {
+	return PortRange{From: p}
+}
+
+// ParsePortRange
+// parse the port "80" or range "1000:2000" (or "1000-2000")
+func ParsePortRange(s string) (PortRange, error) {
+
+	parts := strings.FieldsFunc(s, func(r rune) bool { return r == ':' || r == '-' })
+	if len(parts) == 0 || len(parts) > 2 {
+		return PortRange{}, errors.Errorf("invalid port range %q", s)
+	}
+
+	var out PortRange
+	for i, p := range parts {
+		v, err := strconv.ParseUint(p, 10, 16)
+		if err != nil {
+			return PortRange{}, errors.Errorf("invalid port range %q", s)
+		}
+		if i == 0 {
+			out.From = uint16(v)
+		} else {
+			out.To = uint16(v)
+		}
+	}
+	return out, out.validate()
+}
+
+func (p PortRange) validate() error {
+
+	if p.From == 0 {
+		return errors.Errorf("invalid port %d", p.From)
+	}
+	if p.To != 0 && p.To < p.From {
+		return errors.Errorf("invalid port range %d:%d", p.From, p.To)
+	}
+	return nil
+}
+
+func (p PortRange) isRange() bool {
+	return p.To != 0 && p.To != p.From
+}
+
+// String
+// the iptables form, eg: 80, 1000:2000
+func (p PortRange) String() string {
+
+	if p.isRange() {
+		return fmt.Sprintf("%d:%d", p.From, p.To)
+	}
+	return strconv.Itoa(int(p.From))
+}
+
+// RuleBuilder
+// build the rule by the typed matches and target, the invalid input is reported by Args,
+// the args are in the form of iptables-save, so they can be compared with the saved rules
+//
+//	NewRule(NATTableName, "DESKTOP-A").
+//		Protocol("tcp").
+//		DestinationPort(Port(3000)).
+//		Comment("desktop a").
+//		Jump(DNATTo("192.168.240.98:3000"))
+type RuleBuilder struct {
+	table string
+	chain string
+
+	// the negation of the next match
+	not bool
+
+	generic  []string
+	protocol string
+	modules  []Match
+	target   *Target
+
+	errs []error
+}
+
+// NewRule
+// new a rule in the chain of the table
+func NewRule(table string, chain string) *RuleBuilder {
+	return &RuleBuilder{table: table, chain: chain}
+}
+
+func (b *RuleBuilder) errorf(format string, args ...interface{}) *RuleBuilder {
+	b.errs = append(b.errs, errors.Errorf(format, args...))
+	return b
+}
+
+// negation
+// the "!" before the option if Not called
+func (b *RuleBuilder) negation() []string {
+
+	if !b.not {
+		return nil
+	}
+	b.not = false
+	return []string{"!"}
+}
+
+// module
+// the options of the match module, the options of the same module are merged
+func (b *RuleBuilder) module(name string, args ...string) *RuleBuilder {
+
+	for i := range b.modules {
+		if b.modules[i].Module == name {
+			b.modules[i].Args = append(b.modules[i].Args, args...)
+			return b
+		}
+	}
+	b.modules = append(b.modules, Match{Module: name, Args: args})
+	return b
+}
+
+// Not
+// negate the next match, eg: Not().Source("10.0.0.0/8") -> ! -s 10.0.0.0/8
+func (b *RuleBuilder) Not() *RuleBuilder {
+	b.not = true
+	return b
+}
+
+// canonicalAddress
+// the ip or cidr in the iptables-save form, eg: 10.0.0.1 -> 10.0.0.1/32, 10.1.2.3/8 -> 10.0.0.0/8
+func canonicalAddress(s string) (string, error) {
+
+	if ip := net.ParseIP(s); ip != nil {
+		if ip.To4() != nil {
+			return ip.String() + "/32", nil
+		}
+		return ip.String() + "/128", nil
+	}
+
+	_, ipNet, err := net.ParseCIDR(s)
+	if err != nil {
+		return "", errors.Errorf("invalid address %q", s)
+	}
+	return ipNet.String(), nil
+}
+
+func (b *RuleBuilder) address(flag string, s string) *RuleBuilder {
+
+	not := b.negation()
+	addr, err := canonicalAddress(s)
+	if err != nil {
+		return b.errorf("%s: %v", flag, err)
+	}
+	b.generic = append(b.generic, append(not, flag, addr)...)
+	return b
+}
+
+// Source
+// match the source ip or cidr
+func (b *RuleBuilder) Source(cidr string) *RuleBuilder {
+	return b.address("-s", cidr)
+}
+
+// Destination
+// match the destination ip or cidr
+func (b *RuleBuilder) Destination(cidr string) *RuleBuilder {
+	return b.address("-d", cidr)
+}
+
+func (b *RuleBuilder) iface(flag string, name string) *RuleBuilder {
+
+	not := b.negation()
+	if !interfaceName.MatchString(name) {
+		return b.errorf("%s: invalid interface %q", flag, name)
+	}
+	b.generic = append(b.generic, append(not, flag, name)...)
+	return b
+}
+
+// InInterface
+// match the input interface, the "+" suffix match the prefix, eg: eth+
+func (b *RuleBuilder) InInterface(name string) *RuleBuilder {
+	return b.iface("-i", name)
+}
+
+// OutInterface
+// match the output interface, the "+" suffix match the prefix
+func (b *RuleBuilder) OutInterface(name string) *RuleBuilder {
+	return b.iface("-o", name)
+}
+
+// Protocol
+// match the protocol, eg: tcp, udp, icmp
+func (b *RuleBuilder) Protocol(p string) *RuleBuilder {
+
+	not := b.negation()
+	p = strings.ToLower(p)
+	if len(p) == 0 || strings.ContainsAny(p, " \t") {
+		return b.errorf("invalid protocol %q", p)
+	}
+	if len(b.protocol) != 0 {
+		return b.errorf("protocol already set to %s", b.protocol)
+	}
+	if len(not) == 0 {
+		b.protocol = p
+	}
+	b.generic = append(b.generic, append(not, "-p", p)...)
+	return b
+}
+
+func (b *RuleBuilder) ports(single string, multi string, ports []PortRange) *RuleBuilder {
+
+	not := b.negation()
+
+	if !portProtocols[b.protocol] {
+		return b.errorf("the port match need the protocol tcp, udp or sctp, got %q", b.protocol)
+	}
+	if len(ports) == 0 {
+		return b.errorf("%s: no port", single)
+	}
+
+	count := 0
+	values := make([]string, 0, len(ports))
+	for _, p := range ports {
+		if err := p.validate(); err != nil {
+			return b.errorf("%s: %v", single, err)
+		}
+		values = append(values, p.String())
+		count++
+		if p.isRange() {
+			count++
+		}
+	}
+
+	if len(ports) == 1 {
+		return b.module(b.protocol, append(not, single, values[0])...)
+	}
+	if count > maxMultiports {
+		return b.errorf("%s: too many ports, max %d", multi, maxMultiports)
+	}
+	return b.module("multiport", append(not, multi, strings.Join(values, ","))...)
+}
+
+// SourcePort
+// match the source ports, the multiport is used for more than one port
+func (b *RuleBuilder) SourcePort(ports ...PortRange) *RuleBuilder {
+	return b.ports("--sport", "--sports", ports)
+}
+
+// DestinationPort
+// match the destination ports, the multiport is used for more than one port
+func (b *RuleBuilder) DestinationPort(ports ...PortRange) *RuleBuilder {
+	return b.ports("--dport", "--dports", ports)
+}
+
+// State
+// match the conntrack state, eg: State(StateRelated, StateEstablished)
+func (b *RuleBuilder) State(states ...string) *RuleBuilder {
+
+	not := b.negation()
+	if len(states) == 0 {
+		return b.errorf("--ctstate: no state")
+	}
+	for _, s := range states {
+		if !validStates[s] {
+			return b.errorf("--ctstate: invalid state %q", s)
+		}
+	}
+	return b.module("conntrack", append(not, "--ctstate", strings.Join(states, ","))...)
+}
+
+// Mark
+// match the fwmark, the mask 0 means the full mask
+func (b *RuleBuilder) Mark(value uint32, mask uint32) *RuleBuilder {
+
+	not := b.negation()
+	v := fmt.Sprintf("0x%x", value)
+	if mask != 0 && mask != ^uint32(0) {
+		v += fmt.Sprintf("/0x%x", mask)
+	}
+	return b.module("mark", append(not, "--mark", v)...)
+}
+
+// Limit
+// match at the limited rate, eg: Limit("10/sec", 20), the burst 0 means the default 5
+func (b *RuleBuilder) Limit(rate string, burst int) *RuleBuilder {
+
+	if b.not {
+		b.not = false
+		return b.errorf("the limit match can not be negated")
+	}
+	if !limitRate.MatchString(rate) {
+		return b.errorf("--limit: invalid rate %q", rate)
+	}
+	if burst < 0 {
+		return b.errorf("--limit-burst: invalid burst %d", burst)
+	}
+
+	args := []string{"--limit", rate}
+	if burst != 0 {
+		args = append(args, "--limit-burst", strconv.Itoa(burst))
+	}
+	return b.module("limit", args...)
+}
+
+// Probability
+// match the packet randomly by the statistic module, the probability is in (0, 1),
+// it is rounded as the kernel does, so the args are same as the iptables-save output
+func (b *RuleBuilder) Probability(p float64) *RuleBuilder {
+
+	not := b.negation()
+	if p <= 0 || p >= 1 {
+		return b.errorf("--probability: invalid probability %v", p)
+	}
+
+	// the kernel stores the probability as the fraction of 2^31
+	v := math.Round(0x80000000*p) / 0x80000000
+	return b.module("statistic", append(not, "--mode", "random", "--probability", fmt.Sprintf("%.11f", v))...)
+}
+
+// Module
+// match by the module not covered by the builder, eg: Module("addrtype", "--dst-type", "LOCAL")
+func (b *RuleBuilder) Module(name string, args ...string) *RuleBuilder {
+
+	if len(name) == 0 || strings.ContainsAny(name, " \t") {
+		return b.errorf("invalid module %q", name)
+	}
+	return b.module(name, append(b.negation(), args...)...)
+}
+
+// Comment
+// the comment of the rule, max 256 chars
+func (b *RuleBuilder) Comment(c string) *RuleBuilder {
+
+	if len(c) == 0 || len(c) > 256 {
+		return b.errorf("--comment: invalid length %d", len(c))
+	}
+	return b.module("comment", "--comment", c)
+}
+
+// Jump
+// the target of the rule
+func (b *RuleBuilder) Jump(t Target) *RuleBuilder {
+
+	if b.target != nil {
+		return b.errorf("target already set to %s", b.target.Name)
+	}
+	if len(t.Name) == 0 {
+		return b.errorf("empty target")
+	}
+	b.target = &t
+	return b
+}
+
+// Accept
+// the ACCEPT target
+func Accept() Target { return Target{Name: ACCEPT} }
+
+// Drop
+// the DROP target
+func Drop() Target { return Target{Name: DROP} }
+
+// Return
+// the RETURN target, back to the calling chain
+func Return() Target { return Target{Name: RETURN} }
+
+// JumpTo
+// jump to the user defined chain
+func JumpTo(chain string) Target { return Target{Name: chain} }
+
+// GotoChain
+// goto the user defined chain, it will not return to the current chain
+func GotoChain(chain string) Target { return Target{Name: chain, Goto: true} }
+
+// Reject
+// the REJECT target, the empty with means the default icmp-port-unreachable
+func Reject(with string) Target {
+
+	t := Target{Name: REJECT}
+	if len(with) != 0 {
+		t.Args = []string{"--reject-with", with}
+	}
+	return t
+}
+
+// Log
+// the LOG target, the level is the syslog level 0-7, negative means the default
+func Log(prefix string, level int) Target {
+
+	t := Target{Name: LOG}
+	if len(prefix) != 0 {
+		t.Args = append(t.Args, "--log-prefix", prefix)
+	}
+	if level >= 0 {
+		t.Args = append(t.Args, "--log-level", strconv.Itoa(level))
+	}
+	return t
+}
+
+// Redirect
+// the REDIRECT target, redirect to the local port
+func Redirect(ports PortRange) Target {
+	return Target{Name: REDIRECT, Args: []string{"--to-ports", strings.Replace(ports.String(), ":", "-", 1)}}
+}
+
+// SNATTo
+// the SNAT target, eg: 192.168.1.1, 192.168.1.1:1000-2000
+func SNATTo(to string) Target {
+	return Target{Name: SNAT, Args: []string{"--to-source", to}}
+}
+
+// DNATTo
+// the DNAT target, eg: 192.168.240.101:3000, 192.168.240.101:1000-2000
+func DNATTo(to string) Target {
+	return Target{Name: DNAT, Args: []string{"--to-destination", to}}
+}
+
+// SetMark
+// the MARK target, set the bits of mask to the value
+func SetMark(value uint32, mask uint32) Target {
+	return Target{Name: MARK, Args: []string{"--set-xmark", fmt.Sprintf("0x%x/0x%x", value, mask)}}
+}
+
+// Masquerade
+// the MASQUERADE target
+func Masquerade() Target {
+	return Target{Name: MASQUERADE}
+}
+
+// the targets only valid in nat table
+var natTargets = map[string]bool{
+	DNAT:       true,
+	SNAT:       true,
+	MASQUERADE: true,
+	REDIRECT:   true,
+}
+
+// validateTarget
+// check the target args
+func (b *RuleBuilder) validateTarget() error {
+
+	t := b.target
+	if t == nil {
+		return nil
+	}
+
+	if natTargets[t.Name] && b.table != NATTableName {
+		return errors.Errorf("the %s target only valid in nat table", t.Name)
+	}
+
+	switch t.Name {
+	case REDIRECT:
+		if !portProtocols[b.protocol] {
+			return errors.Errorf("the %s target need the protocol tcp or udp", t.Name)
+		}
+	case LOG:
+		for i := 0; i < len(t.Args)-1; i++ {
+			switch t.Args[i] {
+			case "--log-prefix":
+				if len(t.Args[i+1]) > maxLogPrefix {
+					return errors.Errorf("--log-prefix: max %d chars", maxLogPrefix)
+				}
+			case "--log-level":
+				if l, _ := strconv.Atoi(t.Args[i+1]); l > 7 {
+					return errors.Errorf("--log-level: invalid level %s", t.Args[i+1])
+				}
+			}
+		}
+	case DNAT, SNAT:
+		if len(t.Args) != 2 || len(t.Args[1]) == 0 {
+			return errors.Errorf("the %s target need the address", t.Name)
+		}
+		// the port in the address need the protocol
+		if strings.Contains(t.Args[1], ":") && net.ParseIP(t.Args[1]) == nil && !portProtocols[b.protocol] {
+			return errors.Errorf("the %s target with port need the protocol tcp or udp", t.Name)
+		}
+	}
+	return nil
+}
+
+// Validate
+// the errors of the input
+func (b *RuleBuilder) Validate() error {
+
+	if len(b.table) == 0 {
+		return errors.New("empty table")
+	}
+	if len(b.chain) == 0 {
+		return errors.New("empty chain")
+	}
+	if len(b.errs) != 0 {
+		msgs := make([]string, 0, len(b.errs))
+		for _, e := range b.errs {
+			msgs = append(msgs, e.Error())
+		}
+		return errors.Errorf("invalid rule in %s/%s: %s", b.table, b.chain, strings.Join(msgs, "; "))
+	}
+	if b.not {
+		return errors.New("the Not is not followed by a match")
+	}
+	return b.validateTarget()
+}
+
+// Args
+// the args after "-A chain", in the iptables-save order:
+// the generic options, the match modules (comment last), then the target
+func (b *RuleBuilder) Args() ([]string, error) {
+
+	if err := b.Validate(); err != nil {
+		return nil, err
+	}
+
+	r := b.parsed()
+	return r.Args(), nil
+}
+
+func (b *RuleBuilder) parsed() *ParsedRule {
+
+	r := &ParsedRule{Chain: b.chain, Target: b.target}
+	if len(b.generic) != 0 {
+		r.Matches = append(r.Matches, Match{Args: b.generic})
+	}
+
+	var comment *Match
+	for i := range b.modules {
+		if b.modules[i].Module == "comment" {
+			comment = &b.modules[i]
+			continue
+		}
+		r.Matches = append(r.Matches, b.modules[i])
+	}
+	if comment != nil {
+		r.Matches = append(r.Matches, *comment)
+	}
+	return r
+}
+
+// Rule
+// the rule for the TableState
+func (b *RuleBuilder) Rule() (Rule, error) {
+
+	args, err := b.Args()
+	if err != nil {
+		return Rule{}, err
+	}
+	return Rule{Chain: b.chain, Args: args}, nil
+}
+
+func (b *RuleBuilder) command(op string, pos ...string) ([]string, error) {
+
+	args, err := b.Args()
+	if err != nil {
+		return nil, err
+	}
+
+	out := append([]string{"-t", b.table, op, b.chain}, pos...)
+	return append(out, args...), nil
+}
+
+// AppendArgs
+// the argv of iptables to append the rule, eg: -t nat -A chain ...
+func (b *RuleBuilder) AppendArgs() ([]string, error) {
+	return b.command("-A")
+}
+
+// InsertArgs
+// the argv of iptables to insert the rule at the position, the first is 1
+func (b *RuleBuilder) InsertArgs(pos int) ([]string, error) {
+
+	if pos < 1 {
+		return nil, errors.Errorf("invalid position %d", pos)
+	}
+	return b.command("-I", strconv.Itoa(pos))
+}
+
+// CheckArgs
+// the argv of iptables to check the rule exist
+func (b *RuleBuilder) CheckArgs() ([]string, error) {
+	return b.command("-C")
+}
+
+// DeleteArgs
+// the argv of iptables to delete the rule
+func (b *RuleBuilder) DeleteArgs() ([]string, error) {
+	return b.command("-D")
+}
@@ -0,0 +1,135 @@
+package iptables
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/sxllwx/vulcanus/pkg/command/fake"
+)
+
+func TestRuleBuilder(t *testing.T) {
+
+	cases := []struct {
+		rule   *RuleBuilder
+		expect string
+	}{
+		{
+			rule: NewRule(NATTableName, "DESKTOP-A").
+				Protocol("tcp").
+				DestinationPort(Port(3000)).
+				Comment("desktop a").
+				Jump(DNATTo("192.168.240.98:3000")),
+			expect: `-t nat -A DESKTOP-A -p tcp -m tcp --dport 3000 -m comment --comment desktop a -j DNAT --to-destination 192.168.240.98:3000`,
+		},
+		{
+			rule: NewRule(FilterTableName, INPUTChainName).
+				Comment("web").
+				Source("10.1.2.3/8").
+				Not().InInterface("lo").
+				Protocol("TCP").
+				DestinationPort(Port(80), Port(443), PortRange{From: 8000, To: 8080}).
+				State(StateNew).
+				Jump(Accept()),
+			expect: `-t filter -A INPUT -s 10.0.0.0/8 ! -i lo -p tcp -m multiport --dports 80,443,8000:8080 -m conntrack --ctstate NEW -m comment --comment web -j ACCEPT`,
+		},
+		{
+			rule: NewRule(FilterTableName, INPUTChainName).
+				Protocol("icmp").
+				Limit("10/sec", 20).
+				Jump(Log("icmp: ", 4)),
+			expect: `-t filter -A INPUT -p icmp -m limit --limit 10/sec --limit-burst 20 -j LOG --log-prefix icmp:  --log-level 4`,
+		},
+		{
+			rule: NewRule(NATTableName, OUTPUTChainName).
+				Destination("10.0.0.1").
+				Mark(0x4000, 0x4000).
+				Protocol("udp").
+				Jump(Redirect(PortRange{From: 5353})),
+			expect: `-t nat -A OUTPUT -d 10.0.0.1/32 -p udp -m mark --mark 0x4000/0x4000 -j REDIRECT --to-ports 5353`,
+		},
+		{
+			rule:   NewRule(FilterTableName, "FORWARD").OutInterface("docker+").Jump(Reject("icmp-host-prohibited")),
+			expect: `-t filter -A FORWARD -o docker+ -j REJECT --reject-with icmp-host-prohibited`,
+		},
+	}
+
+	for _, c := range cases {
+		args, err := c.rule.AppendArgs()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if a := strings.Join(args, " "); a != c.expect {
+			t.Fatalf("expect\n%s\ngot\n%s", c.expect, a)
+		}
+	}
+}
+
+func TestRuleBuilderParsed(t *testing.T) {
+
+	// the args can be compared with the iptables-save output
+	args, err := NewRule(NATTableName, "DESKTOP-A").
+		Protocol("tcp").
+		DestinationPort(Port(3000)).
+		Comment("desktop a").
+		Jump(DNATTo("192.168.240.98:3000")).
+		Args()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := ParseRule(`-A DESKTOP-A -p tcp -m tcp --dport 3000 -m comment --comment "desktop a" -j DNAT --to-destination 192.168.240.98:3000`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sameArgs(args, r.Args()) {
+		t.Fatalf("expect %q, got %q", r.Args(), args)
+	}
+}
+
+func TestRuleBuilderInvalid(t *testing.T) {
+
+	for _, b := range []*RuleBuilder{
+		NewRule(FilterTableName, INPUTChainName).Source("10.0.0.300"),
+		NewRule(FilterTableName, INPUTChainName).DestinationPort(Port(80)),
+		NewRule(FilterTableName, INPUTChainName).Protocol("tcp").DestinationPort(PortRange{From: 200, To: 100}),
+		NewRule(FilterTableName, INPUTChainName).InInterface("a-very-long-interface-name"),
+		NewRule(FilterTableName, INPUTChainName).State("OPEN"),
+		NewRule(FilterTableName, INPUTChainName).Limit("10/week", 0),
+		NewRule(FilterTableName, INPUTChainName).Jump(DNATTo("10.0.0.1:80")),
+		NewRule(NATTableName, OUTPUTChainName).Jump(Redirect(Port(80))),
+		NewRule(FilterTableName, INPUTChainName).Jump(Log(strings.Repeat("x", 30), 0)),
+		NewRule(FilterTableName, INPUTChainName).Jump(Accept()).Jump(Drop()),
+		NewRule(FilterTableName, INPUTChainName).Not(),
+		NewRule(FilterTableName, "").Jump(Accept()),
+	} {
+		if _, err := b.Args(); err == nil {
+			t.Fatalf("expect %+v rejected", b)
+		}
+	}
+
+	if _, err := NewRule(FilterTableName, INPUTChainName).Jump(Accept()).InsertArgs(0); err == nil {
+		t.Fatal("expect the position 0 rejected")
+	}
+}
+
+func TestManagerRuleExists(t *testing.T) {
+
+	h := fake.NewHost()
+	h.OnMatch(IptablesCommand, fake.Exact("-t"), fake.Exact(FilterTableName), fake.Exact("-C"), fake.Exact("EXIST"), fake.Rest())
+	h.OnMatch(IptablesCommand, fake.Exact("-t"), fake.Exact(FilterTableName), fake.Exact("-C"), fake.Rest()).
+		Stderr("iptables: Bad rule (does a matching rule exist in that chain?).\n").
+		Exit(1)
+	h.OnMatch(IptablesCommand, fake.Rest()).Exit(4)
+
+	m := NewManager(h)
+
+	if ok, err := m.RuleExists(NewRule(FilterTableName, "EXIST").Jump(Accept())); !ok || err != nil {
+		t.Fatalf("expect exist, got %v %v", ok, err)
+	}
+	if ok, err := m.RuleExists(NewRule(FilterTableName, "OTHER").Jump(Accept())); ok || err != nil {
+		t.Fatalf("expect not exist, got %v %v", ok, err)
+	}
+	if _, err := m.RuleExists(NewRule(NATTableName, "OTHER").Jump(Accept())); err == nil {
+		t.Fatal("expect error")
+	}
+}
@@ -0,0 +1,497 @@
+package iptables
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/juju/errors"
+)
+
+// Ruleset
+// the parsed iptables-save output
+type Ruleset struct {
+	Tables []*Table
+}
+
+// Table
+// the chains and rules of a table, in the order of iptables-save
+type Table struct {
+	Name   string
+	Chains []*ChainHeader
+	Rules  []*ParsedRule
+}
+
+// Counters
+// the packet and byte counters
+type Counters struct {
+	Packets uint64
+	Bytes   uint64
+}
+
+func (c Counters) String() string {
+	return fmt.Sprintf("[%d:%d]", c.Packets, c.Bytes)
+}
+
+// ChainHeader
+// the chain declaration, eg: ":PREROUTING ACCEPT [10:600]"
+type ChainHeader struct {
+	Name string
+	// the policy of the built-in chain, "-" for the user defined chain
+	Policy   string
+	Counters Counters
+}
+
+// Match
+// the options of a match module, eg: -m tcp --dport 80
+type Match struct {
+	// the empty module means the generic options, eg: -s -d -p -i -o
+	Module string
+	// the options of the module, the negation "!" is kept before the option
+	Args []string
+}
+
+// Target
+// the target of the rule, eg: -j DNAT --to-destination 10.0.0.1:80
+type Target struct {
+	Name string
+	// jump by -g instead of -j, the chain return to the caller of the current chain
+	Goto bool
+	Args []string
+}
+
+// ParsedRule
+// the rule in the iptables-save output
+type ParsedRule struct {
+	Chain string
+	// only exist in the output of iptables-save -c
+	Counters *Counters
+
+	Matches []Match
+	// nil if the rule has no target, only the counters are updated
+	Target *Target
+}
+
+// Comment
+// the value of -m comment --comment
+func (r *ParsedRule) Comment() string {
+
+	for _, m := range r.Matches {
+		if m.Module != "comment" {
+			continue
+		}
+		for i := 0; i < len(m.Args)-1; i++ {
+			if m.Args[i] == "--comment" {
+				return m.Args[i+1]
+			}
+		}
+	}
+	return ""
+}
+
+// Managed
+// the rule is created by vulcanus, tagged by the DefaultComment
+func (r *ParsedRule) Managed() bool {
+	return isTagged(r.Comment())
+}
+
+// Match
+// the options of the module, nil if not exist
+func (r *ParsedRule) Match(module string) *Match {
+
+	for i := range r.Matches {
+		if r.Matches[i].Module == module {
+			return &r.Matches[i]
+		}
+	}
+	return nil
+}
+
+// Args
+// the args after "-A chain"
+func (r *ParsedRule) Args() []string {
+
+	var out []string
+	for _, m := range r.Matches {
+		if len(m.Module) != 0 {
+			out = append(out, "-m", m.Module)
+		}
+		out = append(out, m.Args...)
+	}
+
+	if r.Target != nil {
+		if r.Target.Goto {
+			out = append(out, "-g", r.Target.Name)
+		} else {
+			out = append(out, "-j", r.Target.Name)
+		}
+		out = append(out, r.Target.Args...)
+	}
+	return out
+}
+
+// String
+// the rule line in the iptables-save form
+func (r *ParsedRule) String() string {
+
+	line := "-A " + r.Chain
+	if args := r.Args(); len(args) != 0 {
+		line += " " + joinRule(args)
+	}
+	if r.Counters != nil {
+		line = r.Counters.String() + " " + line
+	}
+	return line
+}
+
+// Chain
+// the chain declaration, nil if not exist
+func (t *Table) Chain(name string) *ChainHeader {
+
+	for _, c := range t.Chains {
+		if c.Name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+// RulesOf
+// the rules of the chain in order
+func (t *Table) RulesOf(chain string) []*ParsedRule {
+
+	var out []*ParsedRule
+	for _, r := range t.Rules {
+		if r.Chain == chain {
+			out = append(out, r)
+		}
+	}
+	return out
+}
+
+// Managed
+// the rules created by vulcanus
+func (t *Table) Managed() []*ParsedRule {
+
+	var out []*ParsedRule
+	for _, r := range t.Rules {
+		if r.Managed() {
+			out = append(out, r)
+		}
+	}
+	return out
+}
+
+// Table
+// the table by name, nil if not exist
+func (rs *Ruleset) Table(name string) *Table {
+
+	for _, t := range rs.Tables {
+		if t.Name == name {
+			return t
+		}
+	}
+	return nil
+}
+
+// WriteTo
+// serialize the ruleset in the iptables-save form, it can be loaded by iptables-restore
+func (rs *Ruleset) WriteTo(w io.Writer) (int64, error) {
+
+	buf := &bytes.Buffer{}
+	for _, t := range rs.Tables {
+		fmt.Fprintf(buf, "*%s\n", t.Name)
+		for _, c := range t.Chains {
+			fmt.Fprintf(buf, ":%s %s %s\n", c.Name, c.Policy, c.Counters)
+		}
+		for _, r := range t.Rules {
+			fmt.Fprintf(buf, "%s\n", r)
+		}
+		buf.WriteString("COMMIT\n")
+	}
+	return buf.WriteTo(w)
+}
+
+func (rs *Ruleset) String() string {
+
+	buf := &bytes.Buffer{}
+	rs.WriteTo(buf)
+	return buf.String()
+}
+
+// ParseSave
+// parse the iptables-save output, the comment lines are dropped
+func ParseSave(r io.Reader) (*Ruleset, error) {
+
+	var (
+		out     = &Ruleset{}
+		current *Table
+	)
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for n := 1; scanner.Scan(); n++ {
+
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		switch {
+		case strings.HasPrefix(line, "*"):
+			if current != nil {
+				return nil, errors.Errorf("line %d: table %s not committed", n, current.Name)
+			}
+			current = &Table{Name: line[1:]}
+			out.Tables = append(out.Tables, current)
+
+		case current == nil:
+			return nil, errors.Errorf("line %d: %q out of table", n, line)
+
+		case line == "COMMIT":
+			current = nil
+
+		case strings.HasPrefix(line, ":"):
+			c, err := parseChainHeader(line)
+			if err != nil {
+				return nil, errors.Annotatef(err, "line %d", n)
+			}
+			current.Chains = append(current.Chains, c)
+
+		case strings.HasPrefix(line, "-A ") || strings.HasPrefix(line, "["):
+			rule, err := ParseRule(line)
+			if err != nil {
+				return nil, errors.Annotatef(err, "line %d", n)
+			}
+			current.Rules = append(current.Rules, rule)
+
+		default:
+			return nil, errors.Errorf("line %d: unknown %q", n, line)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Annotate(err, "scan iptables-save output")
+	}
+	if current != nil {
+		return nil, errors.Errorf("table %s not committed", current.Name)
+	}
+	return out, nil
+}
+
+// parseChainHeader
+// eg: ":PREROUTING ACCEPT [10:600]"
+func parseChainHeader(line string) (*ChainHeader, error) {
+
+	fields := strings.Fields(line[1:])
+	if len(fields) == 0 {
+		return nil, errors.New("empty chain")
+	}
+
+	out := &ChainHeader{Name: fields[0], Policy: "-"}
+	if len(fields) > 1 {
+		out.Policy = fields[1]
+	}
+	if len(fields) > 2 {
+		c, err := parseCounters(fields[2])
+		if err != nil {
+			return nil, err
+		}
+		out.Counters = c
+	}
+	return out, nil
+}
+
+// parseCounters
+// eg: [10:600]
+func parseCounters(s string) (Counters, error) {
+
+	if !strings.HasPrefix(s, "[") || !strings.HasSuffix(s, "]") {
+		return Counters{}, errors.Errorf("invalid counters %q", s)
+	}
+
+	parts := strings.Split(s[1:len(s)-1], ":")
+	if len(parts) != 2 {
+		return Counters{}, errors.Errorf("invalid counters %q", s)
+	}
+
+	packets, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil {
+		return Counters{}, errors.Annotatef(err, "invalid counters %q", s)
+	}
+	bytes, err := strconv.ParseUint(parts[1], 10, 64)
+	if err != nil {
+		return Counters{}, errors.Annotatef(err, "invalid counters %q", s)
+	}
+	return Counters{Packets: packets, Bytes: bytes}, nil
+}
+
+// ParseRule
+// parse the rule line, eg: [0:0] -A PREROUTING -p tcp -m tcp --dport 80 -j DNAT --to-destination 10.0.0.1:80
+func ParseRule(line string) (*ParsedRule, error) {
+
+	args, err := splitRuleLine(line)
+	if err != nil {
+		return nil, err
+	}
+
+	out := &ParsedRule{}
+	if len(args) != 0 && strings.HasPrefix(args[0], "[") {
+		c, err := parseCounters(args[0])
+		if err != nil {
+			return nil, err
+		}
+		out.Counters = &c
+		args = args[1:]
+	}
+
+	if len(args) < 2 || args[0] != "-A" {
+		return nil, errors.Errorf("invalid rule %q", line)
+	}
+	out.Chain = args[1]
+
+	if err := out.parseArgs(args[2:]); err != nil {
+		return nil, errors.Annotatef(err, "invalid rule %q", line)
+	}
+	return out, nil
+}
+
+// parseArgs
+// split the args to the matches and target, the args are kept in order,
+// the generic options before and between the modules are grouped in the Match without Module
+func (r *ParsedRule) parseArgs(args []string) error {
+
+	var current *Match
+
+	for i := 0; i < len(args); i++ {
+
+		switch args[i] {
+		case "-m", "--match":
+			if i+1 >= len(args) {
+				return errors.New("no module after -m")
+			}
+			r.Matches = append(r.Matches, Match{Module: args[i+1]})
+			current = &r.Matches[len(r.Matches)-1]
+			i++
+
+		case "-j", "--jump", "-g", "--goto":
+			if i+1 >= len(args) {
+				return errors.Errorf("no target after %s", args[i])
+			}
+			r.Target = &Target{
+				Name: args[i+1],
+				Goto: args[i] == "-g" || args[i] == "--goto",
+				Args: append([]string(nil), args[i+2:]...),
+			}
+			return nil
+
+		default:
+			if isGenericOption(args, i) {
+				// the generic option after the module
+				if current == nil || len(current.Module) != 0 {
+					r.Matches = append(r.Matches, Match{})
+					current = &r.Matches[len(r.Matches)-1]
+				}
+			} else if current == nil {
+				return errors.Errorf("unknown option %s", args[i])
+			}
+			current.Args = append(current.Args, args[i])
+		}
+	}
+	return nil
+}
+
+// the generic options of iptables, not belong to any match module
+var genericOptions = map[string]bool{
+	"-s": true, "--source": true,
+	"-d": true, "--destination": true,
+	"-p": true, "--protocol": true,
+	"-i": true, "--in-interface": true,
+	"-o": true, "--out-interface": true,
+	"-f": true, "--fragment": true,
+}
+
+// isGenericOption
+// the args[i] is a generic option, or the negation before it
+func isGenericOption(args []string, i int) bool {
+
+	if args[i] == "!" && i+1 < len(args) {
+		return genericOptions[args[i+1]]
+	}
+	if genericOptions[args[i]] {
+		return true
+	}
+	// the value of the generic option
+	if i > 0 && genericOptions[args[i-1]] && args[i-1] != "-f" && args[i-1] != "--fragment" {
+		return true
+	}
+	return false
+}
+
+// splitRuleLine
+// split the rule line like iptables-restore, the double quoted arg may contain spaces and escaped quotes
+func splitRuleLine(line string) ([]string, error) {
+
+	var (
+		out     []string
+		arg     strings.Builder
+		inArg   bool
+		quoted  bool
+		escaped bool
+	)
+
+	for _, r := range line {
+
+		switch {
+		case escaped:
+			arg.WriteRune(r)
+			escaped = false
+		case quoted && r == '\\':
+			escaped = true
+		case r == '"':
+			quoted = !quoted
+			inArg = true
+		case !quoted && (r == ' ' || r == '\t'):
+			if inArg {
+				out = append(out, arg.String())
+				arg.Reset()
+				inArg = false
+			}
+		default:
+			arg.WriteRune(r)
+			inArg = true
+		}
+	}
+
+	if quoted {
+		return nil, errors.Errorf("unterminated quote in %q", line)
+	}
+	if inArg {
+		out = append(out, arg.String())
+	}
+	return out, nil
+}
+
+// quoteRuleArg
+// quote the arg for iptables-restore
+func quoteRuleArg(arg string) string {
+
+	if len(arg) != 0 && !strings.ContainsAny(arg, " \t\"\\'") {
+		return arg
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(arg) + `"`
+}
+
+// joinRule
+// the rule line for iptables-restore
+func joinRule(args []string) string {
+
+	out := make([]string, 0, len(args))
+	for _, a := range args {
+		out = append(out, quoteRuleArg(a))
+	}
+	return strings.Join(out, " ")
+}
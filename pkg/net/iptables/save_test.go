@@ -0,0 +1,84 @@
+package iptables
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestParseSave(t *testing.T) {
+
+	golden, err := ioutil.ReadFile("testdata/save.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rs, err := ParseSave(bytes.NewReader(golden))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// round trip
+	if e, a := string(golden), rs.String(); e != a {
+		t.Fatalf("expect\n%s\ngot\n%s", e, a)
+	}
+
+	filter := rs.Table(FilterTableName)
+	if c := filter.Chain("FORWARD"); c == nil || c.Policy != DROP {
+		t.Fatalf("unexpected chain %+v", c)
+	}
+	if c := filter.Chain(INPUTChainName); c.Counters.Packets != 120 || c.Counters.Bytes != 9600 {
+		t.Fatalf("unexpected counters %+v", c.Counters)
+	}
+
+	ssh := filter.RulesOf(INPUTChainName)[1]
+	if e, a := []string{"!", "-i", "lo", "-p", "tcp"}, ssh.Matches[0].Args; strings.Join(e, " ") != strings.Join(a, " ") {
+		t.Fatalf("expect generic options %q, got %q", e, a)
+	}
+	if m := ssh.Match("tcp"); m == nil || strings.Join(m.Args, " ") != "--dport 22" {
+		t.Fatalf("unexpected tcp match %+v", m)
+	}
+	if ssh.Comment() != "generated by vulcanus: ssh" || !ssh.Managed() {
+		t.Fatalf("unexpected comment %q", ssh.Comment())
+	}
+	if ssh.Target.Name != ACCEPT {
+		t.Fatalf("unexpected target %+v", ssh.Target)
+	}
+
+	jump := filter.RulesOf("FORWARD")[1]
+	if !jump.Target.Goto || jump.Target.Name != "DOCKER" {
+		t.Fatalf("unexpected goto %+v", jump.Target)
+	}
+
+	mark := filter.RulesOf(OUTPUTChainName)[0]
+	if mark.Target != nil {
+		t.Fatalf("expect no target, got %+v", mark.Target)
+	}
+
+	nat := rs.Table(NATTableName)
+	if len(nat.Managed()) != 2 {
+		t.Fatalf("expect 2 managed rules, got %d", len(nat.Managed()))
+	}
+	dnat := nat.RulesOf("VULCANUS-A")[0]
+	if dnat.Target.Name != DNAT || strings.Join(dnat.Target.Args, " ") != "--to-destination 192.168.240.98:3000" {
+		t.Fatalf("unexpected target %+v", dnat.Target)
+	}
+	if c := nat.Rules[0].Counters; c == nil || c.Packets != 5 {
+		t.Fatalf("unexpected rule counters %+v", c)
+	}
+}
+
+func TestParseSaveError(t *testing.T) {
+
+	for _, text := range []string{
+		"-A INPUT -j ACCEPT\n",
+		"*filter\n-A INPUT -j ACCEPT\n",
+		"*filter\n-A INPUT --unknown -j ACCEPT\nCOMMIT\n",
+		"*filter\n:INPUT ACCEPT [x:0]\nCOMMIT\n",
+	} {
+		if _, err := ParseSave(strings.NewReader(text)); err == nil {
+			t.Fatalf("expect %q rejected", text)
+		}
+	}
+}
@@ -0,0 +1,348 @@
+package iptables
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/juju/errors"
+	"github.com/sxllwx/vulcanus/pkg/log"
+)
+
+// the chains of the services, all in the nat table
+const (
+	// jumped from PREROUTING and OUTPUT, dispatch by the protocol and port
+	ServicesChainName = "VULCANUS-SERVICES"
+	// jumped from POSTROUTING, masquerade the marked packets
+	ServicesPostroutingChainName = "VULCANUS-POSTROUTING"
+	// the prefix of the per service chain
+	ServiceChainPrefix = "VULCANUS-SVC-"
+)
+
+// ServiceMasqueradeMark
+// the mark of the forwarded packets, they are masqueraded in POSTROUTING,
+// so the replies of the backends come back through the host
+const ServiceMasqueradeMark uint32 = 0x4000
+
+// Service
+// the host port forwarded to the backends
+type Service struct {
+	Name     string
+	Protocol string
+	Port     uint16
+	// the ip:port of the backends, the traffic is spread equally
+	Backends []string
+}
+
+// chainName
+// the per service chain, the name is hashed to fit the max chain name length (28)
+func (s *Service) chainName() string {
+
+	sum := sha256.Sum256([]byte(s.Name))
+	return ServiceChainPrefix + strings.ToUpper(hex.EncodeToString(sum[:])[:12])
+}
+
+func (s *Service) comment() string {
+	return DefaultComment + ": service " + s.Name
+}
+
+// Validate
+// check the service
+func (s *Service) Validate() error {
+
+	if len(s.Name) == 0 {
+		return errors.New("empty service name")
+	}
+	if !portProtocols[s.Protocol] {
+		return errors.Errorf("service %s: unsupported protocol %q", s.Name, s.Protocol)
+	}
+	if s.Port == 0 {
+		return errors.Errorf("service %s: invalid port 0", s.Name)
+	}
+
+	if len(s.Backends) == 0 {
+		return errors.Errorf("service %s: no backend, unforward it instead", s.Name)
+	}
+	for _, b := range s.Backends {
+		host, port, err := net.SplitHostPort(b)
+		if err != nil || net.ParseIP(host) == nil {
+			return errors.Errorf("service %s: invalid backend %q, should be ip:port", s.Name, b)
+		}
+		if p, err := strconv.ParseUint(port, 10, 16); err != nil || p == 0 {
+			return errors.Errorf("service %s: invalid backend port %q", s.Name, b)
+		}
+	}
+	return nil
+}
+
+// rules
+// the rules of the service chain, the i-th backend is chosen with the probability 1/(n-i),
+// so every backend get 1/n of the traffic
+func (s *Service) rules() ([][]string, error) {
+
+	// mark all the packets of the service, they are masqueraded after DNAT
+	mark, err := NewRule(NATTableName, s.chainName()).
+		Comment(s.comment()).
+		Jump(SetMark(ServiceMasqueradeMark, ServiceMasqueradeMark)).
+		Args()
+	if err != nil {
+		return nil, err
+	}
+
+	out := [][]string{mark}
+	for i, backend := range s.Backends {
+
+		b := NewRule(NATTableName, s.chainName()).Protocol(s.Protocol)
+		if rest := len(s.Backends) - i; rest > 1 {
+			b.Probability(1 / float64(rest))
+		}
+
+		args, err := b.Comment(s.comment()).Jump(DNATTo(backend)).Args()
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, args)
+	}
+	return out, nil
+}
+
+// Forward
+// forward the port of the host to the backends, the service with the same name is replaced,
+// the rules are applied by Reconcile, so calling it repeatedly is safe,
+// the services forwarded by the previous process are loaded from the host first
+func (m *Manager) Forward(name string, protocol string, port uint16, backends []string) error {
+
+	svc := &Service{
+		Name:     name,
+		Protocol: strings.ToLower(protocol),
+		Port:     port,
+		Backends: append([]string(nil), backends...),
+	}
+	if err := svc.Validate(); err != nil {
+		return err
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if err := m.loadServices(); err != nil {
+		return errors.Annotatef(err, "forward service %s", name)
+	}
+
+	old, existed := m.services[name]
+	m.services[name] = svc
+
+	if err := m.syncServices(); err != nil {
+		// keep the desired state same as the host
+		if existed {
+			m.services[name] = old
+		} else {
+			delete(m.services, name)
+		}
+		return errors.Annotatef(err, "forward service %s", name)
+	}
+	return nil
+}
+
+// Unforward
+// stop forwarding the service, the unknown service is ignored
+func (m *Manager) Unforward(name string) error {
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if err := m.loadServices(); err != nil {
+		return errors.Annotatef(err, "unforward service %s", name)
+	}
+
+	old, existed := m.services[name]
+	if !existed {
+		return nil
+	}
+	delete(m.services, name)
+
+	if err := m.syncServices(); err != nil {
+		m.services[name] = old
+		return errors.Annotatef(err, "unforward service %s", name)
+	}
+	return nil
+}
+
+// Services
+// the forwarded services sorted by name
+func (m *Manager) Services() []Service {
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	out := make([]Service, 0, len(m.services))
+	for _, s := range m.services {
+		svc := *s
+		svc.Backends = append([]string(nil), s.Backends...)
+		out = append(out, svc)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+// loadServices
+// rebuild the services from the tagged rules on the host before the first change,
+// so the service chains created by the previous process are not deleted as stale,
+// the lock should be held
+func (m *Manager) loadServices() error {
+
+	if m.servicesLoaded {
+		return nil
+	}
+
+	rs, err := m.save()
+	if err != nil {
+		return err
+	}
+	m.loadServicesFrom(rs)
+	return nil
+}
+
+// loadServicesFrom
+// the loadServices from the saved rules
+func (m *Manager) loadServicesFrom(rs *Ruleset) {
+
+	if m.servicesLoaded {
+		return
+	}
+
+	m.services = map[string]*Service{}
+	if t := rs.Table(NATTableName); t != nil {
+		// the services chain is kept even if all the services are unforwarded
+		m.servicesManaged = t.Chain(ServicesChainName) != nil
+		for _, r := range t.RulesOf(ServicesChainName) {
+			if svc := parseService(t, r); svc != nil {
+				m.services[svc.Name] = svc
+			}
+		}
+	}
+	m.servicesLoaded = true
+}
+
+// parseService
+// the service dispatched by the rule of the services chain, nil if the rule is not a valid service
+// eg: -A VULCANUS-SERVICES -p tcp -m tcp --dport 8080 -m comment --comment "generated by vulcanus: service web" -j VULCANUS-SVC-...
+func parseService(t *Table, dispatch *ParsedRule) *Service {
+
+	name := strings.TrimPrefix(dispatch.Comment(), DefaultComment+": service ")
+	if name == dispatch.Comment() || dispatch.Target == nil {
+		return nil
+	}
+
+	svc := &Service{Name: name}
+	if m := dispatch.Match(""); m != nil {
+		svc.Protocol = optionValue(m.Args, "-p")
+	}
+	if m := dispatch.Match(svc.Protocol); m != nil {
+		port, err := strconv.ParseUint(optionValue(m.Args, "--dport"), 10, 16)
+		if err != nil {
+			return nil
+		}
+		svc.Port = uint16(port)
+	}
+
+	if dispatch.Target.Name != svc.chainName() {
+		return nil
+	}
+	for _, r := range t.RulesOf(svc.chainName()) {
+		if r.Target != nil && r.Target.Name == DNAT {
+			svc.Backends = append(svc.Backends, optionValue(r.Target.Args, "--to-destination"))
+		}
+	}
+
+	if err := svc.Validate(); err != nil {
+		log.Warnf("ignore the invalid service %s on the host: %v", name, err)
+		return nil
+	}
+	return svc
+}
+
+// optionValue
+// the value after the option, eg: --dport 80
+func optionValue(args []string, option string) string {
+
+	for i := 0; i < len(args)-1; i++ {
+		if args[i] == option {
+			return args[i+1]
+		}
+	}
+	return ""
+}
+
+// servicesState
+// the desired nat table of the services
+func (m *Manager) servicesState() (*TableState, error) {
+
+	names := make([]string, 0, len(m.services))
+	for n := range m.services {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+
+	services := Chain{Name: ServicesChainName}
+	chains := []Chain{}
+
+	for _, n := range names {
+		svc := m.services[n]
+
+		dispatch, err := NewRule(NATTableName, ServicesChainName).
+			Protocol(svc.Protocol).
+			DestinationPort(Port(svc.Port)).
+			Comment(svc.comment()).
+			Jump(JumpTo(svc.chainName())).
+			Args()
+		if err != nil {
+			return nil, err
+		}
+		services.Rules = append(services.Rules, dispatch)
+
+		rules, err := svc.rules()
+		if err != nil {
+			return nil, err
+		}
+		chains = append(chains, Chain{Name: svc.chainName(), Rules: rules})
+	}
+
+	masq, err := NewRule(NATTableName, ServicesPostroutingChainName).
+		Mark(ServiceMasqueradeMark, ServiceMasqueradeMark).
+		Comment(DefaultComment).
+		Jump(Masquerade()).
+		Args()
+	if err != nil {
+		return nil, err
+	}
+
+	// only the traffic to the host is forwarded
+	local := []string{"-m", "addrtype", "--dst-type", "LOCAL", "-j", ServicesChainName}
+
+	return &TableState{
+		Table: NATTableName,
+		Chains: append([]Chain{
+			services,
+			{Name: ServicesPostroutingChainName, Rules: [][]string{masq}},
+		}, chains...),
+		Rules: []Rule{
+			{Chain: PREROUTINGChainName, Args: local},
+			{Chain: OUTPUTChainName, Args: local},
+			{Chain: POSTROUTINGChainName, Args: []string{"-j", ServicesPostroutingChainName}},
+		},
+		ChainPrefix: ServiceChainPrefix,
+	}, nil
+}
+
+// syncServices
+// apply the services to the host, the lock should be held
+func (m *Manager) syncServices() error {
+
+	m.servicesManaged = true
+	_, err := m.sync(NATTableName)
+	return err
+}
@@ -0,0 +1,220 @@
+package iptables
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/sxllwx/vulcanus/pkg/command/fake"
+)
+
+const testEmptyNATSave = `*nat
+:PREROUTING ACCEPT [0:0]
+:INPUT ACCEPT [0:0]
+:OUTPUT ACCEPT [0:0]
+:POSTROUTING ACCEPT [0:0]
+COMMIT
+`
+
+// the nat table after forwarding the web service
+const testServiceSave = `*nat
+:PREROUTING ACCEPT [0:0]
+:INPUT ACCEPT [0:0]
+:OUTPUT ACCEPT [0:0]
+:POSTROUTING ACCEPT [0:0]
+:VULCANUS-SERVICES - [0:0]
+:VULCANUS-POSTROUTING - [0:0]
+:VULCANUS-SVC-4B5E57F6EB2F - [0:0]
+-A PREROUTING -m comment --comment "generated by vulcanus" -m addrtype --dst-type LOCAL -j VULCANUS-SERVICES
+-A OUTPUT -m comment --comment "generated by vulcanus" -m addrtype --dst-type LOCAL -j VULCANUS-SERVICES
+-A POSTROUTING -m comment --comment "generated by vulcanus" -j VULCANUS-POSTROUTING
+-A VULCANUS-SERVICES -p tcp -m tcp --dport 8080 -m comment --comment "generated by vulcanus: service web" -j VULCANUS-SVC-4B5E57F6EB2F
+-A VULCANUS-POSTROUTING -m mark --mark 0x4000/0x4000 -m comment --comment "generated by vulcanus" -j MASQUERADE
+-A VULCANUS-SVC-4B5E57F6EB2F -m comment --comment "generated by vulcanus: service web" -j MARK --set-xmark 0x4000/0x4000
+-A VULCANUS-SVC-4B5E57F6EB2F -p tcp -m statistic --mode random --probability 0.33333333349 -m comment --comment "generated by vulcanus: service web" -j DNAT --to-destination 10.0.0.1:80
+-A VULCANUS-SVC-4B5E57F6EB2F -p tcp -m statistic --mode random --probability 0.50000000000 -m comment --comment "generated by vulcanus: service web" -j DNAT --to-destination 10.0.0.2:80
+-A VULCANUS-SVC-4B5E57F6EB2F -p tcp -m comment --comment "generated by vulcanus: service web" -j DNAT --to-destination 10.0.0.3:80
+COMMIT
+`
+
+var testWebBackends = []string{"10.0.0.1:80", "10.0.0.2:80", "10.0.0.3:80"}
+
+func TestForward(t *testing.T) {
+
+	h := fake.NewHost()
+	h.On(IptablesSaveCommand).Stdout(testEmptyNATSave)
+	h.On(IptablesRestoreCommand, "--noflush")
+
+	m := NewManager(h)
+	if err := m.Forward("web", "TCP", 8080, testWebBackends); err != nil {
+		t.Fatal(err)
+	}
+
+	// the services on the host are loaded before the first change
+	calls := h.Calls()
+	if len(calls) != 3 {
+		t.Fatalf("unexpected calls %q", h.CommandLines())
+	}
+
+	input := string(calls[2].Stdin)
+	for _, line := range strings.Split(strings.TrimSpace(testServiceSave), "\n") {
+		if strings.HasPrefix(line, "-A ") && !strings.Contains(input, line+"\n") {
+			t.Fatalf("expect %q in restore input\n%s", line, input)
+		}
+	}
+
+	services := m.Services()
+	if len(services) != 1 || services[0].Protocol != "tcp" || len(services[0].Backends) != 3 {
+		t.Fatalf("unexpected services %+v", services)
+	}
+}
+
+func TestForwardNoChange(t *testing.T) {
+
+	h := fake.NewHost()
+	h.On(IptablesSaveCommand).Stdout(testServiceSave)
+
+	m := NewManager(h)
+	if err := m.Forward("web", "tcp", 8080, testWebBackends); err != nil {
+		t.Fatal(err)
+	}
+	// the rules on the host are same as the desired, no restore
+	if len(h.Calls()) != 2 {
+		t.Fatalf("unexpected calls %q", h.CommandLines())
+	}
+}
+
+func TestForwardKeepEnsuredRules(t *testing.T) {
+
+	// the jump appended by AppendChainToParentChain before
+	save := strings.Replace(testServiceSave, "COMMIT\n",
+		":DESKTOP-A - [0:0]\n"+
+			`-A PREROUTING -m comment --comment "generated by vulcanus: desktop a" -j DESKTOP-A`+"\n"+
+			"COMMIT\n", 1)
+
+	h := fake.NewHost()
+	h.On(IptablesSaveCommand).Stdout(save)
+	h.On(IptablesRestoreCommand, "--noflush")
+	h.OnMatch(IptablesCommand, fake.Rest())
+
+	m := NewManager(h)
+	if err := m.AppendChainToParentChain(NATTableName, PREROUTINGChainName, "DESKTOP-A", "desktop a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Forward("web", "tcp", 8081, testWebBackends); err != nil {
+		t.Fatal(err)
+	}
+
+	calls := h.Calls()
+	input := string(calls[len(calls)-1].Stdin)
+	if strings.Contains(input, "-D PREROUTING") {
+		t.Fatalf("expect the ensured rule kept\n%s", input)
+	}
+}
+
+func TestUnforward(t *testing.T) {
+
+	h := fake.NewHost()
+	h.On(IptablesSaveCommand).Stdout(testServiceSave)
+	h.On(IptablesRestoreCommand, "--noflush")
+
+	m := NewManager(h)
+	if err := m.Forward("web", "tcp", 8080, testWebBackends); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Unforward("web"); err != nil {
+		t.Fatal(err)
+	}
+
+	calls := h.Calls()
+	if len(calls) != 4 {
+		t.Fatalf("unexpected calls %q", h.CommandLines())
+	}
+
+	input := string(calls[3].Stdin)
+	if !strings.Contains(input, "-X VULCANUS-SVC-4B5E57F6EB2F\n") ||
+		!strings.Contains(input, ":VULCANUS-SERVICES ") || strings.Contains(input, "-A VULCANUS-SERVICES ") {
+		t.Fatalf("expect the service chain deleted\n%s", input)
+	}
+	if len(m.Services()) != 0 {
+		t.Fatalf("unexpected services %+v", m.Services())
+	}
+}
+
+func TestForwardLoadServices(t *testing.T) {
+
+	// the web service created by the previous process
+	h := fake.NewHost()
+	h.On(IptablesSaveCommand).Stdout(testServiceSave)
+	h.On(IptablesRestoreCommand, "--noflush")
+
+	m := NewManager(h)
+	if err := m.Forward("api", "tcp", 9090, []string{"10.0.0.4:90"}); err != nil {
+		t.Fatal(err)
+	}
+
+	calls := h.Calls()
+	input := string(calls[len(calls)-1].Stdin)
+	if strings.Contains(input, "-X VULCANUS-SVC-4B5E57F6EB2F") || strings.Contains(input, ":VULCANUS-SVC-4B5E57F6EB2F ") {
+		t.Fatalf("expect the loaded service kept\n%s", input)
+	}
+
+	services := m.Services()
+	if len(services) != 2 || services[1].Name != "web" || services[1].Port != 8080 ||
+		strings.Join(services[1].Backends, ",") != strings.Join(testWebBackends, ",") {
+		t.Fatalf("unexpected services %+v", services)
+	}
+}
+
+func TestUnforwardLoadedService(t *testing.T) {
+
+	h := fake.NewHost()
+	h.On(IptablesSaveCommand).Stdout(testServiceSave)
+	h.On(IptablesRestoreCommand, "--noflush")
+
+	m := NewManager(h)
+	if err := m.Unforward("web"); err != nil {
+		t.Fatal(err)
+	}
+
+	calls := h.Calls()
+	if len(calls) != 3 || !strings.Contains(string(calls[2].Stdin), "-X VULCANUS-SVC-4B5E57F6EB2F\n") {
+		t.Fatalf("expect the loaded service deleted %q", h.CommandLines())
+	}
+}
+
+func TestForwardError(t *testing.T) {
+
+	h := fake.NewHost()
+	h.On(IptablesSaveCommand).Stdout(testEmptyNATSave)
+	h.On(IptablesRestoreCommand, "--noflush").Stderr("iptables-restore: line 3 failed").Exit(1)
+
+	m := NewManager(h)
+	if err := m.Forward("web", "tcp", 8080, testWebBackends); err == nil {
+		t.Fatal("expect error")
+	}
+	// the failed service is not kept
+	if len(m.Services()) != 0 {
+		t.Fatalf("unexpected services %+v", m.Services())
+	}
+}
+
+func TestServiceValidate(t *testing.T) {
+
+	for _, s := range []Service{
+		{Protocol: "tcp", Port: 80},
+		{Name: "a", Protocol: "icmp", Port: 80},
+		{Name: "a", Protocol: "tcp"},
+		{Name: "a", Protocol: "tcp", Port: 80},
+		{Name: "a", Protocol: "tcp", Port: 80, Backends: []string{"10.0.0.1"}},
+		{Name: "a", Protocol: "tcp", Port: 80, Backends: []string{"host:80"}},
+		{Name: "a", Protocol: "tcp", Port: 80, Backends: []string{"10.0.0.1:0"}},
+	} {
+		if err := s.Validate(); err == nil {
+			t.Fatalf("expect %+v invalid", s)
+		}
+	}
+
+	if len((&Service{Name: "a-very-long-service-name-more-than-28"}).chainName()) > 28 {
+		t.Fatal("the chain name is too long")
+	}
+}
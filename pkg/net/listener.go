@@ -0,0 +1,221 @@
+package net
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	vio "github.com/sxllwx/vulcanus/pkg/io"
+	"github.com/sxllwx/vulcanus/pkg/log"
+)
+
+var (
+	ErrTooManyConns      = errors.New("too many conns")
+	ErrTooManyConnsPerIP = errors.New("too many conns from the ip")
+	ErrListenerClosed    = errors.New("listener already closed")
+)
+
+// ListenerConfig
+// the limits of the accepted conns, zero means unlimited
+type ListenerConfig struct {
+	// the max conns accepted and not closed
+	MaxConns int
+	// the max conns of a remote ip
+	MaxConnsPerIP int
+
+	// the accepted conns per second, and the max conns accepted at once
+	AcceptRate  float64
+	AcceptBurst int
+
+	// wrap the conn by io.DecorateConn, the returned conn is a io.MeasurableConn
+	Measurable bool
+
+	// track the accepted conns, nil means a new tracker without idle reaping
+	Tracker *ConnTracker
+}
+
+// Complete
+// set default value for ListenerConfig
+func (c *ListenerConfig) Complete() {
+
+	if c.AcceptRate > 0 && c.AcceptBurst <= 0 {
+		c.AcceptBurst = 1
+	}
+	if c.Tracker == nil {
+		c.Tracker = NewConnTracker(0, 0)
+	}
+}
+
+// Listener
+// the net.Listener tracks every accepted conn, the conn over the limits is closed immediately
+type Listener struct {
+	net.Listener
+	cfg ListenerConfig
+
+	mu    sync.Mutex
+	total int
+	perIP map[string]int
+
+	// the token bucket of the accept rate
+	tokens float64
+	last   time.Time
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// NewListener
+// wrap the listener with the limits
+func NewListener(l net.Listener, cfg ListenerConfig) *Listener {
+
+	cfg.Complete()
+	return &Listener{
+		Listener: l,
+		cfg:      cfg,
+		perIP:    map[string]int{},
+		tokens:   float64(cfg.AcceptBurst),
+		last:     time.Now(),
+		closed:   make(chan struct{}),
+	}
+}
+
+// Listen
+// listen the address and wrap it with the limits
+func Listen(network string, address string, cfg ListenerConfig) (*Listener, error) {
+
+	l, err := net.Listen(network, address)
+	if err != nil {
+		return nil, err
+	}
+	return NewListener(l, cfg), nil
+}
+
+// Tracker
+// the tracker of the accepted conns
+func (l *Listener) Tracker() *ConnTracker {
+	return l.cfg.Tracker
+}
+
+// Accept
+// wait the accept rate, then accept the conn within the limits
+func (l *Listener) Accept() (net.Conn, error) {
+
+	for {
+		if err := l.waitRate(); err != nil {
+			return nil, err
+		}
+
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		release, err := l.acquire(conn.RemoteAddr())
+		if err != nil {
+			log.Warnf("reject conn from %s: %v", conn.RemoteAddr(), err)
+			conn.Close()
+			continue
+		}
+
+		sc, err := l.cfg.Tracker.track(conn, release)
+		if err != nil {
+			return nil, err
+		}
+
+		if l.cfg.Measurable {
+			return vio.DecorateConn(sc), nil
+		}
+		return sc, nil
+	}
+}
+
+// Close
+// stop accepting, the accepted conns are kept
+func (l *Listener) Close() error {
+
+	l.closeOnce.Do(func() {
+		close(l.closed)
+	})
+	return l.Listener.Close()
+}
+
+// Shutdown
+// stop accepting, and drain the accepted conns, the remaining conns are closed when the ctx done
+func (l *Listener) Shutdown(ctx context.Context) error {
+
+	if err := l.Close(); err != nil {
+		log.Warnf("close listener %v", err)
+	}
+	return l.cfg.Tracker.Drain(ctx)
+}
+
+// acquire
+// count the conn in the limits, the release should be called after the conn closed
+func (l *Listener) acquire(addr net.Addr) (func(), error) {
+
+	ip := addr.String()
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.cfg.MaxConns > 0 && l.total >= l.cfg.MaxConns {
+		return nil, ErrTooManyConns
+	}
+	if l.cfg.MaxConnsPerIP > 0 && l.perIP[ip] >= l.cfg.MaxConnsPerIP {
+		return nil, ErrTooManyConnsPerIP
+	}
+
+	l.total++
+	l.perIP[ip]++
+
+	return func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+
+		l.total--
+		if l.perIP[ip]--; l.perIP[ip] <= 0 {
+			delete(l.perIP, ip)
+		}
+	}, nil
+}
+
+// waitRate
+// take a token of the accept rate, wait if no token left
+func (l *Listener) waitRate() error {
+
+	if l.cfg.AcceptRate <= 0 {
+		return nil
+	}
+
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.cfg.AcceptRate
+	if max := float64(l.cfg.AcceptBurst); l.tokens > max {
+		l.tokens = max
+	}
+	l.last = now
+
+	// the token is taken in advance, the next waiter wait longer
+	l.tokens--
+	wait := time.Duration(-l.tokens / l.cfg.AcceptRate * float64(time.Second))
+	l.mu.Unlock()
+
+	if wait <= 0 {
+		return nil
+	}
+
+	t := time.NewTimer(wait)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return nil
+	case <-l.closed:
+		return ErrListenerClosed
+	}
+}
@@ -0,0 +1,140 @@
+package net
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	vio "github.com/sxllwx/vulcanus/pkg/io"
+)
+
+func TestListenerLimits(t *testing.T) {
+
+	l, err := Listen("tcp", "127.0.0.1:0", ListenerConfig{MaxConns: 2, MaxConnsPerIP: 1, Measurable: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	accepted := make(chan net.Conn, 4)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				close(accepted)
+				return
+			}
+			accepted <- c
+		}
+	}()
+
+	first, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+
+	var server net.Conn
+	select {
+	case server = <-accepted:
+	case <-time.After(time.Second):
+		t.Fatal("expect the first conn accepted")
+	}
+	if _, ok := server.(vio.MeasurableConn); !ok {
+		t.Fatalf("expect measurable conn, got %T", server)
+	}
+
+	// the second conn from the same ip is rejected
+	second, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+
+	second.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := second.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expect the rejected conn closed, got %v", err)
+	}
+	if n := l.Tracker().Len(); n != 1 {
+		t.Fatalf("expect 1 tracked conn, got %d", n)
+	}
+
+	// the limit is released after closed
+	server.Close()
+
+	third, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer third.Close()
+
+	select {
+	case c := <-accepted:
+		defer c.Close()
+	case <-time.After(time.Second):
+		t.Fatal("expect the third conn accepted")
+	}
+}
+
+func TestListenerAcceptRate(t *testing.T) {
+
+	l, err := Listen("tcp", "127.0.0.1:0", ListenerConfig{AcceptRate: 20, AcceptBurst: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	for i := 0; i < 3; i++ {
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+	}
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		c, err := l.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+	}
+	// the first by the burst, the next two wait 50ms each
+	if d := time.Since(start); d < 90*time.Millisecond {
+		t.Fatalf("expect the accept rate limited, took %s", d)
+	}
+}
+
+func TestListenerShutdown(t *testing.T) {
+
+	l, err := Listen("tcp", "127.0.0.1:0", ListenerConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if _, err := l.Accept(); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	if err := l.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("expect deadline exceeded, got %v", err)
+	}
+	if l.Tracker().Len() != 0 {
+		t.Fatal("expect the accepted conn closed")
+	}
+	if _, err := l.Accept(); err == nil {
+		t.Fatal("expect accept failed after shutdown")
+	}
+}
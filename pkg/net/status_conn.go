@@ -3,28 +3,51 @@ package net
 import (
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 // statusConn
 type statusConn struct {
+	// *** status, keep the 64-bit fields first for the atomic on 32-bit platform ***//
+	// the unix nano of the latest read or write
+	latestRWTime int64
+	readBytes    uint64
+	writtenBytes uint64
+	// *** status ***//
+
 	net.Conn // underlay conn
 
-	// *** timesetting ***//
-	mu           sync.RWMutex
-	latestRWTime time.Time
-	// *** timesetting ***//
+	id       uint64
+	openedAt time.Time
+
+	closeOnce sync.Once
+	closeErr  error
+	// run once after the conn closed, eg: release the limit of the listener
+	release func()
 
 	tracker *ConnTracker
 }
 
+func newStatusConn(conn net.Conn, id uint64, tracker *ConnTracker, release func()) *statusConn {
+
+	now := time.Now()
+	return &statusConn{
+		latestRWTime: now.UnixNano(),
+		Conn:         conn,
+		id:           id,
+		openedAt:     now,
+		tracker:      tracker,
+		release:      release,
+	}
+}
+
 func (c *statusConn) Read(b []byte) (int, error) {
 
 	n, err := c.Conn.Read(b)
 
-	c.mu.Lock()
-	c.latestRWTime = time.Now()
-	c.mu.Unlock()
+	atomic.AddUint64(&c.readBytes, uint64(n))
+	atomic.StoreInt64(&c.latestRWTime, time.Now().UnixNano())
 	return n, err
 }
 
@@ -32,13 +55,43 @@ func (c *statusConn) Write(b []byte) (int, error) {
 
 	n, err := c.Conn.Write(b)
 
-	c.mu.Lock()
-	c.latestRWTime = time.Now()
-	c.mu.Unlock()
+	atomic.AddUint64(&c.writtenBytes, uint64(n))
+	atomic.StoreInt64(&c.latestRWTime, time.Now().UnixNano())
 	return n, err
 }
 
-func (c *statusConn) Close() (err error) {
-	c.tracker.unTrack(c)
-	return c.Conn.Close()
+// Close
+// close the underlay conn once, and untrack it
+func (c *statusConn) Close() error {
+
+	c.closeOnce.Do(func() {
+		c.closeErr = c.Conn.Close()
+		c.tracker.unTrack(c)
+		if c.release != nil {
+			c.release()
+		}
+	})
+	return c.closeErr
+}
+
+// idle
+// the time since the latest read or write
+func (c *statusConn) idle(now time.Time) time.Duration {
+	return now.Sub(time.Unix(0, atomic.LoadInt64(&c.latestRWTime)))
+}
+
+// info
+// the snapshot of the conn
+func (c *statusConn) info(now time.Time) ConnInfo {
+
+	return ConnInfo{
+		ID:           c.id,
+		LocalAddr:    c.LocalAddr(),
+		RemoteAddr:   c.RemoteAddr(),
+		OpenedAt:     c.openedAt,
+		Age:          now.Sub(c.openedAt),
+		Idle:         c.idle(now),
+		ReadBytes:    atomic.LoadUint64(&c.readBytes),
+		WrittenBytes: atomic.LoadUint64(&c.writtenBytes),
+	}
 }
@@ -1,105 +1,306 @@
 package net
 
 import (
+	"context"
 	"net"
+	"sort"
 	"sync"
 	"time"
 
+	"github.com/pkg/errors"
 	"github.com/sxllwx/vulcanus/pkg/log"
 )
 
+var ErrTrackerClosed = errors.New("conn tracker already closed")
+
+// ConnInfo
+// the snapshot of a tracked conn
+type ConnInfo struct {
+	ID         uint64
+	LocalAddr  net.Addr
+	RemoteAddr net.Addr
+
+	OpenedAt time.Time
+	Age      time.Duration
+	// the time since the latest read or write
+	Idle time.Duration
+
+	ReadBytes    uint64
+	WrittenBytes uint64
+}
+
+// ConnTracker
+// track the conns, close the conn idle longer than the timeout
 type ConnTracker struct {
 
 	// config
-	rwTimeout time.Duration
-	ticker    *time.Ticker
+	cleanInterval time.Duration
+	idleTimeout   time.Duration
+
+	// callbacks
+	onOpen  func(ConnInfo)
+	onClose func(ConnInfo)
 
 	// tracked conn
-	mu      sync.RWMutex
+	mu      sync.Mutex
+	nextID  uint64
 	connMap map[*statusConn]struct{}
+	// no more conn is tracked after Drain or Stop
+	closed bool
+	// closed when the connMap become empty during drain
+	drained chan struct{}
+
+	stopOnce sync.Once
+	stop     chan struct{}
 }
 
-func NewConnTracker(cleanInterval time.Duration, rwTimeout time.Duration) *ConnTracker {
+// NewConnTracker
+// the conn idle (no read or write) longer than idleTimeout is closed, checked every cleanInterval,
+// the non-positive idleTimeout means never close the idle conn
+func NewConnTracker(cleanInterval time.Duration, idleTimeout time.Duration) *ConnTracker {
 
 	return &ConnTracker{
-		rwTimeout: rwTimeout,
-		ticker:    time.NewTicker(cleanInterval),
-		connMap:   make(map[*statusConn]struct{}, 8),
+		cleanInterval: cleanInterval,
+		idleTimeout:   idleTimeout,
+		connMap:       make(map[*statusConn]struct{}, 8),
+		stop:          make(chan struct{}),
 	}
 }
 
-// track conn
-func (c *ConnTracker) track(conn *statusConn) {
+// OnOpen
+// the callback after a conn tracked, should be set before any conn tracked
+func (c *ConnTracker) OnOpen(f func(ConnInfo)) {
 
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	_, ok := c.connMap[conn]
-	if ok {
-		return
+	c.onOpen = f
+}
+
+// OnClose
+// the callback after a tracked conn closed, by the user, the idle reaper or CloseAll,
+// should be set before any conn tracked
+func (c *ConnTracker) OnClose(f func(ConnInfo)) {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.onClose = f
+}
+
+// track conn
+// the conn is closed if the tracker already closed,
+// the release is called once after the conn closed, even the conn is not tracked
+func (c *ConnTracker) track(conn net.Conn, release func()) (*statusConn, error) {
+
+	c.mu.Lock()
+
+	if c.closed {
+		c.mu.Unlock()
+		conn.Close()
+		if release != nil {
+			release()
+		}
+		return nil, ErrTrackerClosed
 	}
 
-	c.connMap[conn] = struct{}{}
+	c.nextID++
+	sc := newStatusConn(conn, c.nextID, c, release)
+	c.connMap[sc] = struct{}{}
+	onOpen := c.onOpen
+
+	c.mu.Unlock()
+
+	if onOpen != nil {
+		onOpen(sc.info(time.Now()))
+	}
+	return sc, nil
 }
 
 // untracked conn
 func (c *ConnTracker) unTrack(conn *statusConn) {
 
 	c.mu.Lock()
-	defer c.mu.Unlock()
 
 	_, ok := c.connMap[conn]
 	if !ok {
+		c.mu.Unlock()
 		return
 	}
 	delete(c.connMap, conn)
+
+	if len(c.connMap) == 0 && c.drained != nil {
+		close(c.drained)
+		c.drained = nil
+	}
+	onClose := c.onClose
+
+	c.mu.Unlock()
+
+	if onClose != nil {
+		onClose(conn.info(time.Now()))
+	}
 }
 
+// Dial
+// dial by the dialFunc and track the conn
+//
+// Deprecated: use Dialer with TrackLayer
 func (c *ConnTracker) Dial(network string, addr string, dialFunc func(string, string) (net.Conn, error)) (net.Conn, error) {
 	conn, err := dialFunc(network, addr)
 	if err != nil {
 		return nil, err
 	}
-	return c.trackNetConn(conn), nil
+	return c.Track(conn)
 }
 
-func (c *ConnTracker) trackNetConn(conn net.Conn) *statusConn {
+// Track
+// track the conn, the conn is closed and ErrTrackerClosed returned after Drain or Stop
+func (c *ConnTracker) Track(conn net.Conn) (net.Conn, error) {
 
-	sc := &statusConn{
-		Conn:    conn,
-		tracker: c,
+	sc, err := c.track(conn, nil)
+	if err != nil {
+		// the nil *statusConn is not a nil net.Conn
+		return nil, err
 	}
-	c.track(sc)
-	return sc
-}
-
-func (c *ConnTracker) Track(conn net.Conn) net.Conn {
-	return c.trackNetConn(conn)
+	return sc, nil
 }
 
+// Start
+// close the idle conns every cleanInterval, block until Stop
 func (c *ConnTracker) Start() {
 
+	if c.idleTimeout <= 0 || c.cleanInterval <= 0 {
+		<-c.stop
+		return
+	}
+
+	ticker := time.NewTicker(c.cleanInterval)
+	defer ticker.Stop()
+
 	for {
-		_, ok := <-c.ticker.C
-		if !ok {
-			// already stopped
+		select {
+		case <-c.stop:
 			return
+		case <-ticker.C:
+			c.reapIdle()
 		}
-		c.resetDeadline()
 	}
-
 }
 
+// Stop
+// stop the reaper loop, and close all the tracked conns
 func (c *ConnTracker) Stop() {
-	c.ticker.Stop()
+
+	c.stopOnce.Do(func() {
+		close(c.stop)
+	})
+
+	c.mu.Lock()
+	c.closed = true
+	c.mu.Unlock()
+
+	if err := c.CloseAll(); err != nil {
+		log.Warnf("close tracked conns %v", err)
+	}
 }
 
-func (c *ConnTracker) resetDeadline() {
-	c.mu.RLock()
-	defer c.mu.RUnlock()
+// reapIdle
+// close the conns idle longer than the idleTimeout
+func (c *ConnTracker) reapIdle() {
+
+	now := time.Now()
+
+	var idle []*statusConn
+	c.mu.Lock()
 	for conn := range c.connMap {
-		if err := conn.SetDeadline(conn.latestRWTime.Add(c.rwTimeout)); err != nil {
-			log.Warnf("set conn deadline %v", err)
+		if conn.idle(now) > c.idleTimeout {
+			idle = append(idle, conn)
+		}
+	}
+	c.mu.Unlock()
+
+	for _, conn := range idle {
+		if err := conn.Close(); err != nil {
+			log.Warnf("close idle conn (%s) %v", conn.RemoteAddr(), err)
+		}
+	}
+}
+
+// conns
+// the tracked conns
+func (c *ConnTracker) conns() []*statusConn {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	out := make([]*statusConn, 0, len(c.connMap))
+	for conn := range c.connMap {
+		out = append(out, conn)
+	}
+	return out
+}
+
+// CloseAll
+// close all the tracked conns, the first error is returned
+func (c *ConnTracker) CloseAll() error {
+
+	var first error
+	for _, conn := range c.conns() {
+		if err := conn.Close(); err != nil && first == nil {
+			first = err
 		}
 	}
+	return first
+}
+
+// Drain
+// stop tracking new conns, and wait the tracked conns closed by the users,
+// the remaining conns are closed when the ctx done
+func (c *ConnTracker) Drain(ctx context.Context) error {
+
+	c.mu.Lock()
+	c.closed = true
+	if len(c.connMap) == 0 {
+		c.mu.Unlock()
+		return nil
+	}
+	if c.drained == nil {
+		c.drained = make(chan struct{})
+	}
+	drained := c.drained
+	c.mu.Unlock()
+
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+		c.CloseAll()
+		return ctx.Err()
+	}
+}
+
+// Len
+// the number of the tracked conns
+func (c *ConnTracker) Len() int {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return len(c.connMap)
+}
+
+// Snapshot
+// the tracked conns in the tracked order
+func (c *ConnTracker) Snapshot() []ConnInfo {
+
+	now := time.Now()
+
+	conns := c.conns()
+	out := make([]ConnInfo, 0, len(conns))
+	for _, conn := range conns {
+		out = append(out, conn.info(now))
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out
 }
@@ -0,0 +1,136 @@
+package net
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestConnTrackerReapIdle(t *testing.T) {
+
+	tracker := NewConnTracker(10*time.Millisecond, 50*time.Millisecond)
+	go tracker.Start()
+	defer tracker.Stop()
+
+	var (
+		mu     sync.Mutex
+		opened []ConnInfo
+		closed = make(chan ConnInfo, 1)
+	)
+	tracker.OnOpen(func(i ConnInfo) {
+		mu.Lock()
+		opened = append(opened, i)
+		mu.Unlock()
+	})
+	tracker.OnClose(func(i ConnInfo) { closed <- i })
+
+	client, server := net.Pipe()
+	defer server.Close()
+
+	conn, err := tracker.Track(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go io.Copy(ioutil.Discard, server)
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	snapshot := tracker.Snapshot()
+	if len(snapshot) != 1 || snapshot[0].WrittenBytes != 5 || snapshot[0].ID != 1 {
+		t.Fatalf("unexpected snapshot %+v", snapshot)
+	}
+
+	select {
+	case i := <-closed:
+		if i.Idle < 50*time.Millisecond || i.WrittenBytes != 5 {
+			t.Fatalf("unexpected closed conn %+v", i)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expect the idle conn closed")
+	}
+
+	if _, err := conn.Write([]byte("x")); err == nil {
+		t.Fatal("expect write on the closed conn failed")
+	}
+	if tracker.Len() != 0 {
+		t.Fatalf("expect untracked, got %d", tracker.Len())
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(opened) != 1 {
+		t.Fatalf("expect the open callback, got %+v", opened)
+	}
+}
+
+func TestConnTrackerDrain(t *testing.T) {
+
+	tracker := NewConnTracker(time.Second, 0)
+
+	a, _ := net.Pipe()
+	b, _ := net.Pipe()
+
+	ca, err := tracker.Track(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tracker.Track(b); err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		ca.Close()
+	}()
+
+	// the b is never closed by the user
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	if err := tracker.Drain(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("expect deadline exceeded, got %v", err)
+	}
+	if tracker.Len() != 0 {
+		t.Fatalf("expect all closed, got %d", tracker.Len())
+	}
+
+	c, _ := net.Pipe()
+	if conn, err := tracker.Track(c); err != ErrTrackerClosed || conn != nil {
+		t.Fatalf("expect tracker closed, got %v %v", conn, err)
+	}
+	if err := tracker.Drain(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConnTrackerStop(t *testing.T) {
+
+	tracker := NewConnTracker(time.Millisecond, time.Hour)
+
+	done := make(chan struct{})
+	go func() {
+		tracker.Start()
+		close(done)
+	}()
+
+	a, _ := net.Pipe()
+	if _, err := tracker.Track(a); err != nil {
+		t.Fatal(err)
+	}
+
+	tracker.Stop()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("expect the loop ended")
+	}
+	if tracker.Len() != 0 {
+		t.Fatalf("expect all closed, got %d", tracker.Len())
+	}
+}
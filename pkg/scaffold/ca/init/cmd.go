@@ -20,6 +20,8 @@ import (
 const (
 	eCPrivateKeyBlockType = "EC PRIVATE KEY"
 	certBlockType         = "CERTIFICATE"
+
+	duration365d = time.Hour * 24 * 365
 )
 
 type option struct {
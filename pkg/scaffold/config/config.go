@@ -0,0 +1,142 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	// the project-level config file name
+	FileName = ".vulcanus.yaml"
+
+	// the env prefix, eg: VULCANUS_AUTHOR, VULCANUS_CA_CERT_FILE
+	EnvPrefix = "VULCANUS_"
+)
+
+// Config
+// the defaults for every vulcanus command,
+// priority: flag > env > config file > the flag default value
+type Config struct {
+	Author   string   `yaml:"author"`
+	Email    string   `yaml:"email"`
+	URL      string   `yaml:"url"`
+	Package  string   `yaml:"package"`
+	Versions []string `yaml:"versions"`
+	CA       CA       `yaml:"ca"`
+}
+
+// CA
+// the defaults for the ca commands
+type CA struct {
+	PrivateKeyFile string `yaml:"privateKeyFile"`
+	CertFile       string `yaml:"certFile"`
+	CommonName     string `yaml:"commonName"`
+	Organization   string `yaml:"organization"`
+}
+
+// Load
+// read the config file, the empty path means find the FileName
+// from the current dir to the root dir, no config file is fine
+func Load(path string) (*Config, error) {
+
+	if len(path) == 0 {
+		path = Find()
+		if len(path) == 0 {
+			return &Config{}, nil
+		}
+	}
+
+	body, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.WithMessagef(err, "read config file %s", path)
+	}
+
+	cfg := &Config{}
+	if err := yaml.UnmarshalStrict(body, cfg); err != nil {
+		return nil, errors.WithMessagef(err, "unmarshal config file %s", path)
+	}
+	return cfg, nil
+}
+
+// Find
+// find the FileName from the current dir to the root dir
+func Find() string {
+
+	dir, err := os.Getwd()
+	if err != nil {
+		return ""
+	}
+
+	for {
+		path := filepath.Join(dir, FileName)
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return ""
+		}
+		dir = parent
+	}
+}
+
+// values
+// the flag name -> the default value in config file
+func (c *Config) values() map[string]string {
+
+	return map[string]string{
+		"author":              c.Author,
+		"email":               c.Email,
+		"url":                 c.URL,
+		"package":             c.Package,
+		"versions":            strings.Join(c.Versions, ","),
+		"private-key-file":    c.CA.PrivateKeyFile,
+		"cert-file":           c.CA.CertFile,
+		"ca-private-key-file": c.CA.PrivateKeyFile,
+		"ca-cert-file":        c.CA.CertFile,
+		"common-name":         c.CA.CommonName,
+		"organization":        c.CA.Organization,
+	}
+}
+
+// EnvName
+// the env name of the flag, eg: ca-cert-file -> VULCANUS_CA_CERT_FILE
+func EnvName(flag string) string {
+	return EnvPrefix + strings.ToUpper(strings.Replace(flag, "-", "_", -1))
+}
+
+// Apply
+// set the flags not spec in command line from the env and the config file
+func (c *Config) Apply(cmd *cobra.Command) error {
+
+	values := c.values()
+
+	var err error
+	cmd.Flags().VisitAll(func(f *pflag.Flag) {
+
+		if err != nil || f.Changed {
+			return
+		}
+
+		v, ok := os.LookupEnv(EnvName(f.Name))
+		if !ok {
+			v = values[f.Name]
+		}
+		if len(v) == 0 {
+			return
+		}
+
+		if e := cmd.Flags().Set(f.Name, v); e != nil {
+			err = errors.WithMessagef(e, "set flag %s", f.Name)
+		}
+	})
+	return err
+}
@@ -0,0 +1,75 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/cobra"
+)
+
+const testConfig = `
+author: scott
+package: api
+versions: [v1, v2]
+ca:
+  certFile: /tmp/ca-cert.pem
+`
+
+func TestApply(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "vulcanus-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, FileName)
+	if err := ioutil.WriteFile(path, []byte(testConfig), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		author, email, pkg, certFile string
+		versions                     []string
+	)
+	cmd := &cobra.Command{Use: "test"}
+	cmd.Flags().StringVarP(&author, "author", "a", "", "")
+	cmd.Flags().StringVarP(&email, "email", "e", "", "")
+	cmd.Flags().StringVarP(&pkg, "package", "p", "", "")
+	cmd.Flags().StringVarP(&certFile, "ca-cert-file", "c", "ca-cert.pem", "")
+	cmd.Flags().StringSliceVarP(&versions, "versions", "v", nil, "")
+
+	if err := cmd.ParseFlags([]string{"-p", "main"}); err != nil {
+		t.Fatal(err)
+	}
+
+	os.Setenv(EnvName("email"), "scott@example.com")
+	defer os.Unsetenv(EnvName("email"))
+
+	if err := cfg.Apply(cmd); err != nil {
+		t.Fatal(err)
+	}
+
+	if author != "scott" {
+		t.Fatalf("author from config file, got %s", author)
+	}
+	if email != "scott@example.com" {
+		t.Fatalf("email from env, got %s", email)
+	}
+	if pkg != "main" {
+		t.Fatalf("flag should override config file, got %s", pkg)
+	}
+	if certFile != "/tmp/ca-cert.pem" {
+		t.Fatalf("ca cert file from config file, got %s", certFile)
+	}
+	if len(versions) != 2 || versions[1] != "v2" {
+		t.Fatalf("versions from config file, got %v", versions)
+	}
+}
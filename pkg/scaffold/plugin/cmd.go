@@ -0,0 +1,86 @@
+package plugin
+
+import (
+	"os"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"github.com/sxllwx/vulcanus/pkg/scaffold"
+	"github.com/sxllwx/vulcanus/pkg/scaffold/rest"
+)
+
+type option struct {
+
+	// src-code package name
+	pkg string
+
+	// webservice manage which kind of resource
+	kind string
+
+	author string
+	email  string
+	url    string
+}
+
+func (o *option) run(cmd *cobra.Command, args []string) error {
+
+	if len(args) == 0 {
+		return errors.Errorf("please spec the generators, registered: %v", Generators())
+	}
+
+	cfg := NewConfig(o.pkg, o.kind, rest.NewAuthor(o.author, o.email, o.url))
+
+	externals := make(map[string]External)
+	for _, e := range Discover(os.Getenv("PATH")) {
+		externals[e.Name] = e
+	}
+
+	var builtin []string
+	for _, name := range args {
+		e, ok := externals[name]
+		if !ok || contains(Generators(), name) {
+			builtin = append(builtin, name)
+			continue
+		}
+		// the external plugin got the same config
+		if err := e.Run(cfg, nil); err != nil {
+			return err
+		}
+	}
+
+	gList, err := NewGenerators(cfg, builtin...)
+	if err != nil {
+		return err
+	}
+	return scaffold.Generate(gList...)
+}
+
+func contains(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
+
+// GenerateCommand
+// run the registered or external generators with one shared config
+func GenerateCommand() *cobra.Command {
+
+	o := &option{}
+	cmd := &cobra.Command{
+		Use:   "gen [generator...]",
+		Short: "run the generators with the shared config",
+		RunE:  o.run,
+	}
+
+	cmd.Flags().StringVarP(&o.kind, "kind", "k", "", "your awesome webservice manage the kind of resource")
+	cmd.MarkFlagRequired("kind")
+	cmd.Flags().StringVarP(&o.pkg, "package", "p", "", "your awesome package")
+	cmd.MarkFlagRequired("package")
+	cmd.Flags().StringVarP(&o.author, "author", "a", "", "author's name")
+	cmd.Flags().StringVarP(&o.email, "email", "e", "", "author's email")
+	cmd.Flags().StringVarP(&o.url, "url", "u", "", "author's github url")
+	return cmd
+}
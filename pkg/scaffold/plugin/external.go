@@ -0,0 +1,154 @@
+package plugin
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+const (
+	// the external plugin executable name prefix, eg: vulcanus-grpc
+	Prefix = "vulcanus-"
+
+	// the env hold the json encoded shared config for the external plugin
+	ConfigEnv = "VULCANUS_PLUGIN_CONFIG"
+)
+
+// External
+// the external plugin executable found on PATH
+type External struct {
+	Name string
+	Path string
+}
+
+// Discover
+// find the external plugins in the path list (like $PATH),
+// the first one wins when the same name appear in more than one dir
+func Discover(pathList string) []External {
+
+	var (
+		out  []External
+		seen = make(map[string]struct{})
+	)
+
+	for _, dir := range filepath.SplitList(pathList) {
+
+		if len(dir) == 0 {
+			continue
+		}
+
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			// the dir in path not exist is fine
+			continue
+		}
+
+		for _, f := range files {
+
+			if !strings.HasPrefix(f.Name(), Prefix) || f.IsDir() {
+				continue
+			}
+
+			// must be executable
+			if f.Mode()&0111 == 0 {
+				continue
+			}
+
+			name := strings.TrimPrefix(f.Name(), Prefix)
+			if len(name) == 0 {
+				continue
+			}
+
+			if _, ok := seen[name]; ok {
+				continue
+			}
+			seen[name] = struct{}{}
+
+			out = append(out, External{
+				Name: name,
+				Path: filepath.Join(dir, f.Name()),
+			})
+		}
+	}
+	return out
+}
+
+// Run
+// exec the external plugin with args, the shared config will be passed by env
+func (e External) Run(cfg *Config, args []string) error {
+
+	c := exec.Command(e.Path, args...)
+	c.Stdin = os.Stdin
+	c.Stdout = os.Stdout
+	c.Stderr = os.Stderr
+	c.Env = os.Environ()
+
+	if cfg != nil {
+		body, err := json.Marshal(cfg)
+		if err != nil {
+			return errors.WithMessage(err, "marshal shared config")
+		}
+		c.Env = append(c.Env, ConfigEnv+"="+string(body))
+	}
+
+	if err := c.Run(); err != nil {
+		return errors.WithMessagef(err, "run plugin %s", e.Path)
+	}
+	return nil
+}
+
+// Command
+// the cobra command proxy all the args to the external plugin
+func (e External) Command() *cobra.Command {
+
+	return &cobra.Command{
+		Use:                e.Name,
+		Short:              "the external plugin " + e.Path,
+		DisableFlagParsing: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return e.Run(nil, args)
+		},
+	}
+}
+
+// ExternalCommands
+// commands for the external plugins in the path list,
+// the plugin can't override the exist commands
+func ExternalCommands(pathList string, exist ...*cobra.Command) []*cobra.Command {
+
+	names := make(map[string]struct{})
+	for _, c := range exist {
+		names[c.Name()] = struct{}{}
+	}
+
+	var out []*cobra.Command
+	for _, e := range Discover(pathList) {
+		if _, ok := names[e.Name]; ok {
+			continue
+		}
+		out = append(out, e.Command())
+	}
+	return out
+}
+
+// ReadConfig
+// used by the external plugin, read the shared config passed by vulcanus
+func ReadConfig() (*Config, error) {
+
+	body, ok := os.LookupEnv(ConfigEnv)
+	if !ok {
+		return nil, errors.Errorf("env %s not set", ConfigEnv)
+	}
+
+	cfg := &Config{}
+	if err := json.Unmarshal([]byte(body), cfg); err != nil {
+		return nil, errors.WithMessage(err, "unmarshal shared config")
+	}
+	return cfg, nil
+}
@@ -0,0 +1,98 @@
+package plugin
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sxllwx/vulcanus/pkg/scaffold"
+	"github.com/sxllwx/vulcanus/pkg/scaffold/rest"
+)
+
+type fakeGenerator struct {
+	*bytes.Buffer
+	cfg *Config
+}
+
+func (g *fakeGenerator) Generate() error {
+	g.WriteString("package " + g.cfg.Package.Name + "\n")
+	return nil
+}
+
+func (g *fakeGenerator) SuggestFileName() string {
+	return "fake.go"
+}
+
+func TestRegister(t *testing.T) {
+
+	f := func(cfg *Config) (scaffold.Generator, error) {
+		return &fakeGenerator{Buffer: &bytes.Buffer{}, cfg: cfg}, nil
+	}
+
+	if err := Register("fake", f); err != nil {
+		t.Fatal(err)
+	}
+	if err := Register("fake", f); err == nil {
+		t.Fatal("register the same name twice should fail")
+	}
+
+	cfg := NewConfig("main", "book", rest.NewAuthor("", "", ""))
+	gList, err := NewGenerators(cfg, "fake")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := gList[0].Generate(); err != nil {
+		t.Fatal(err)
+	}
+	r, err := ioutil.ReadAll(gList[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(r) != "package main\n" {
+		t.Fatalf("generator not got the shared config: %s", r)
+	}
+
+	if _, err := NewGenerators(cfg, "not-exist"); err == nil {
+		t.Fatal("new not registered generator should fail")
+	}
+}
+
+func TestDiscover(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "vulcanus-plugin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	out := filepath.Join(dir, "out")
+	script := "#!/bin/sh\necho \"$VULCANUS_PLUGIN_CONFIG\" > " + out + "\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, Prefix+"foo"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	// not executable
+	if err := ioutil.WriteFile(filepath.Join(dir, Prefix+"bar"), []byte(script), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	plugins := Discover(dir + string(os.PathListSeparator) + "/not-exist")
+	if len(plugins) != 1 || plugins[0].Name != "foo" {
+		t.Fatalf("unexpected plugins %v", plugins)
+	}
+
+	cfg := NewConfig("main", "book", rest.NewAuthor("", "", ""))
+	if err := plugins[0].Run(cfg, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	body, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(body), `"Kind":"book"`) {
+		t.Fatalf("plugin not got the shared config: %s", body)
+	}
+}
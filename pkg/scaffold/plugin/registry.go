@@ -0,0 +1,127 @@
+package plugin
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"github.com/sxllwx/vulcanus/pkg/scaffold"
+	"github.com/sxllwx/vulcanus/pkg/scaffold/rest"
+)
+
+// Config
+// the shared config exchanged between all the generators
+type Config struct {
+	Package rest.Package
+	Service rest.Service
+	Model   rest.Model
+	Author  rest.Author
+}
+
+// NewConfig
+// complete the shared config from the package name and resource kind
+func NewConfig(pkg string, kind string, author rest.Author) *Config {
+
+	return &Config{
+		Package: rest.NewPackage(pkg),
+		Service: rest.NewService(kind),
+		Model:   rest.NewModel(rest.UpperKind(kind)),
+		Author:  author,
+	}
+}
+
+// Factory
+// build a generator from the shared config
+type Factory func(cfg *Config) (scaffold.Generator, error)
+
+type registry struct {
+	mu        sync.RWMutex
+	factories map[string]Factory
+	commands  []*cobra.Command
+}
+
+var defaultRegistry = &registry{
+	factories: make(map[string]Factory),
+}
+
+// Register
+// register a generator factory with the unique name
+func Register(name string, f Factory) error {
+
+	defaultRegistry.mu.Lock()
+	defer defaultRegistry.mu.Unlock()
+
+	if _, ok := defaultRegistry.factories[name]; ok {
+		return errors.Errorf("generator %s already registered", name)
+	}
+	defaultRegistry.factories[name] = f
+	return nil
+}
+
+// MustRegister
+// like Register, but panic if the name already registered
+func MustRegister(name string, f Factory) {
+	if err := Register(name, f); err != nil {
+		panic(err)
+	}
+}
+
+// RegisterCommand
+// register the commands which will be added to the vulcanus root command
+func RegisterCommand(cmds ...*cobra.Command) {
+
+	defaultRegistry.mu.Lock()
+	defer defaultRegistry.mu.Unlock()
+
+	defaultRegistry.commands = append(defaultRegistry.commands, cmds...)
+}
+
+// Commands
+// all the registered commands
+func Commands() []*cobra.Command {
+
+	defaultRegistry.mu.RLock()
+	defer defaultRegistry.mu.RUnlock()
+
+	return append([]*cobra.Command{}, defaultRegistry.commands...)
+}
+
+// Generators
+// the sorted names of all the registered generators
+func Generators() []string {
+
+	defaultRegistry.mu.RLock()
+	defer defaultRegistry.mu.RUnlock()
+
+	out := make([]string, 0, len(defaultRegistry.factories))
+	for name := range defaultRegistry.factories {
+		out = append(out, name)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// NewGenerators
+// build the spec generators with the shared config
+func NewGenerators(cfg *Config, names ...string) ([]scaffold.Generator, error) {
+
+	defaultRegistry.mu.RLock()
+	defer defaultRegistry.mu.RUnlock()
+
+	out := make([]scaffold.Generator, 0, len(names))
+	for _, name := range names {
+
+		f, ok := defaultRegistry.factories[name]
+		if !ok {
+			return nil, errors.Errorf("generator %s not registered", name)
+		}
+
+		g, err := f(cfg)
+		if err != nil {
+			return nil, errors.WithMessagef(err, "new generator %s", name)
+		}
+		out = append(out, g)
+	}
+	return out, nil
+}
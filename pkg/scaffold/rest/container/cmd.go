@@ -7,6 +7,7 @@ import (
 	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
 	"github.com/sxllwx/vulcanus/pkg/scaffold"
+	"github.com/sxllwx/vulcanus/pkg/scaffold/plugin"
 	"github.com/sxllwx/vulcanus/pkg/scaffold/rest"
 )
 
@@ -21,14 +22,21 @@ type option struct {
 	author string
 	email  string
 	url    string
+
+	// the api versions of the kind, eg: v1,v2
+	versions []string
 }
 
 func (o *option) run(cmd *cobra.Command, args []string) error {
 
-	s := rest.NewService(o.kind)
 	a := rest.NewAuthor(o.author, o.email, o.url)
 	p := rest.NewPackage(o.pkg)
-	return scaffold.Generate(NewContainer(p, s, a))
+
+	if len(o.versions) == 0 {
+		s := rest.NewService(o.kind)
+		return scaffold.Generate(NewContainer(p, s, a))
+	}
+	return scaffold.Generate(NewVersionedContainer(p, a, rest.NewVersionedServices(o.kind, o.versions...)...))
 }
 
 func Command() *cobra.Command {
@@ -47,6 +55,7 @@ func Command() *cobra.Command {
 	cmd.Flags().StringVarP(&o.author, "author", "a", "", "author's name")
 	cmd.Flags().StringVarP(&o.email, "email", "e", "", "author's email")
 	cmd.Flags().StringVarP(&o.url, "url", "u", "", "author's github url")
+	cmd.Flags().StringSliceVarP(&o.versions, "versions", "v", nil, "api versions of the resource, eg: v1,v2")
 	return cmd
 }
 
@@ -95,3 +104,9 @@ func Generate(gList ...Generator) error {
 	}
 	return nil
 }
+
+func init() {
+	plugin.MustRegister("container", func(cfg *plugin.Config) (scaffold.Generator, error) {
+		return NewContainer(cfg.Package, cfg.Service, cfg.Author), nil
+	})
+}
@@ -15,6 +15,8 @@ const (
 type containerGenerator struct {
 	*bytes.Buffer
 	config *containerConfig
+	// the Service is the latest of the Services
+	versioned bool
 }
 
 func NewContainer(p rest.Package, s rest.Service, a rest.Author) Generator {
@@ -22,21 +24,48 @@ func NewContainer(p rest.Package, s rest.Service, a rest.Author) Generator {
 	return &containerGenerator{
 		Buffer: &bytes.Buffer{},
 		config: &containerConfig{
-			Package: p,
-			Service: s,
-			Author:  a,
+			Package:  p,
+			Service:  s,
+			Services: []rest.Service{s},
+			Author:   a,
 		},
 	}
 }
 
+// NewVersionedContainer
+// every version of the service will be registered as its own web-service,
+// the latest version (the last one) describe the open-api doc,
+// the Generate fails if no service or the versions duplicate
+func NewVersionedContainer(p rest.Package, a rest.Author, services ...rest.Service) Generator {
+
+	return &containerGenerator{
+		Buffer: &bytes.Buffer{},
+		config: &containerConfig{
+			Package:  p,
+			Services: services,
+			Author:   a,
+		},
+		versioned: true,
+	}
+}
+
 type containerConfig struct {
 	Package rest.Package
 	Service rest.Service
-	Author  rest.Author
+	// all the versions of the service
+	Services []rest.Service
+	Author   rest.Author
 }
 
 func (g *containerGenerator) Generate() error {
 
+	if g.versioned {
+		if err := rest.ValidateVersions(g.config.Services); err != nil {
+			return errors.WithMessage(err, "validate versions")
+		}
+		g.config.Service = g.config.Services[len(g.config.Services)-1]
+	}
+
 	if err := g.generateContainerConstructorFunc(); err != nil {
 		return errors.WithMessage(err, "generate container constructor func")
 	}
@@ -70,6 +99,14 @@ func NewContainer()*restful.Container{
 	return c
 }
 
+// RegisterWebServices
+// register every version of the web-service to the container
+func RegisterWebServices(c *restful.Container){
+{{range .Services}}
+	c.Add(New{{.Type}}().WebService())
+{{- end}}
+}
+
 // RegisterOpenAPI
 // start the open-api docs in container
 func RegisterOpenAPI(c *restful.Container){
@@ -2,6 +2,7 @@ package container
 
 import (
 	"io/ioutil"
+	"strings"
 	"testing"
 
 	"github.com/sxllwx/vulcanus/pkg/scaffold/rest"
@@ -23,3 +24,41 @@ func TestContainer(t *testing.T) {
 	}
 	t.Logf("%s", r)
 }
+
+func TestVersionedContainer(t *testing.T) {
+
+	p := rest.NewPackage("main")
+	a := rest.NewAuthor("", "", "")
+	og := NewVersionedContainer(p, a, rest.NewVersionedServices("books", "v1", "v2")...)
+
+	if err := og.Generate(); err != nil {
+		t.Fatal(err)
+	}
+	r, err := ioutil.ReadAll(og)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, s := range []string{"NewbooksManagerV1().WebService()", "NewbooksManagerV2().WebService()"} {
+		if !strings.Contains(string(r), s) {
+			t.Fatalf("%s not registered", s)
+		}
+	}
+	t.Logf("%s", r)
+}
+
+func TestVersionedContainerInvalid(t *testing.T) {
+
+	p := rest.NewPackage("main")
+	a := rest.NewAuthor("", "", "")
+
+	for name, services := range map[string][]rest.Service{
+		"empty":     nil,
+		"duplicate": rest.NewVersionedServices("books", "v1", "v2", "v1"),
+		"same id":   rest.NewVersionedServices("books", "v1.0", "v1_0"),
+	} {
+		if err := NewVersionedContainer(p, a, services...).Generate(); err == nil {
+			t.Fatalf("%s: expect the versions rejected", name)
+		}
+	}
+}
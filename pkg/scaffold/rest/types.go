@@ -4,10 +4,16 @@ import (
 	"fmt"
 	"path"
 	"strings"
+
+	"github.com/pkg/errors"
 )
 
 const resourceTypeSuffix = "Manager"
 
+// DefaultVersion
+// the api version used by the un-versioned service
+const DefaultVersion = "v1.0"
+
 type Package struct {
 	Name string
 }
@@ -38,6 +44,11 @@ type Service struct {
 	Description string
 	Version     string
 	Tag         *Tag
+
+	// the identifier of Version, used as suffix of the generated go types
+	// eg: v1 -> V1, v2beta1 -> V2beta1
+	// empty for the un-versioned service
+	VersionID string
 }
 
 func NewService(kind string) Service {
@@ -49,14 +60,60 @@ func NewService(kind string) Service {
 	return s
 }
 
+// NewVersionedService
+// new a service which serve the spec api version of the kind
+func NewVersionedService(kind string, version string) Service {
+	s := Service{
+		Kind:      kind,
+		Version:   version,
+		VersionID: VersionIdentifier(version),
+	}
+
+	s.Complete()
+	return s
+}
+
+// NewVersionedServices
+// new services for every api version of the kind
+func NewVersionedServices(kind string, versions ...string) []Service {
+
+	out := make([]Service, 0, len(versions))
+	for _, v := range versions {
+		out = append(out, NewVersionedService(kind, v))
+	}
+	return out
+}
+
+// ValidateVersions
+// the versioned services of a kind should not be empty, and every version should be distinct,
+// otherwise the generated types and conversion funcs conflict, eg: v1.0 and v1_0 are both V1_0
+func ValidateVersions(services []Service) error {
+
+	if len(services) == 0 {
+		return errors.New("no versioned service")
+	}
+
+	seen := map[string]string{}
+	for _, s := range services {
+		if v, ok := seen[s.VersionID]; ok {
+			return errors.Errorf("duplicate version %s and %s of %s", v, s.Version, s.Kind)
+		}
+		seen[s.VersionID] = s.Version
+	}
+	return nil
+}
+
 // Complete
 // set default value for Service
 func (s *Service) Complete() {
 
-	s.Type = fmt.Sprintf("%s%s", s.Kind, resourceTypeSuffix)
+	if len(s.Version) == 0 {
+		s.Version = DefaultVersion
+	}
+
+	s.Type = fmt.Sprintf("%s%s%s", s.Kind, resourceTypeSuffix, s.VersionID)
 	s.Title = fmt.Sprintf("%sService", UpperKind(s.Type))
 	s.Description = fmt.Sprintf("resource for managing %s", s.Kind)
-	s.Version = "v1.0"
 
 	// best practice is /apis/{apiversion}/{kind}
 	s.RootURLPrefix = path.Join("/api", s.Version, fmt.Sprintf("%ss", s.Kind))
@@ -103,7 +160,37 @@ func NewModel(name string) Model {
 	}
 }
 
+// NewVersionedModel
+// the external model of the spec api version
+// eg: Book + v1 -> BookV1
+func NewVersionedModel(name string, version string) Model {
+
+	return Model{
+		Name: name + VersionIdentifier(version),
+	}
+}
+
 func UpperKind(kind string) string {
 	exportPrefix := strings.ToUpper(string(kind[0]))
 	return exportPrefix + string(kind[1:])
 }
+
+// VersionIdentifier
+// convert the api version to a valid go identifier
+// eg: v1 -> V1, v1.0 -> V1_0, v2beta1 -> V2beta1
+func VersionIdentifier(version string) string {
+
+	if len(version) == 0 {
+		return ""
+	}
+
+	id := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		default:
+			return '_'
+		}
+	}, version)
+	return UpperKind(id)
+}
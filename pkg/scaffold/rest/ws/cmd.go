@@ -3,6 +3,7 @@ package ws
 import (
 	"github.com/spf13/cobra"
 	"github.com/sxllwx/vulcanus/pkg/scaffold"
+	"github.com/sxllwx/vulcanus/pkg/scaffold/plugin"
 	"github.com/sxllwx/vulcanus/pkg/scaffold/rest"
 )
 
@@ -13,14 +14,40 @@ type option struct {
 
 	// webservice manage which kind of resource
 	kind string
+
+	// the api versions of the kind, eg: v1,v2
+	versions []string
 }
 
 func (o *option) run(cmd *cobra.Command, args []string) error {
 
-	s := rest.NewService(o.kind)
 	p := rest.NewPackage(o.pkg)
-	m := rest.NewModel(rest.UpperKind(o.kind))
-	return scaffold.Generate(NewWebService(p, s, m))
+
+	if len(o.versions) == 0 {
+		s := rest.NewService(o.kind)
+		m := rest.NewModel(rest.UpperKind(o.kind))
+		return scaffold.Generate(NewWebService(p, s, m))
+	}
+
+	// every version has own web-service and external model,
+	// and they convert with each other through the internal hub
+	services := rest.NewVersionedServices(o.kind, o.versions...)
+	if err := rest.ValidateVersions(services); err != nil {
+		return err
+	}
+
+	var (
+		gList  []scaffold.Generator
+		models []rest.Model
+	)
+	for _, s := range services {
+		m := rest.NewVersionedModel(rest.UpperKind(o.kind), s.Version)
+		models = append(models, m)
+		gList = append(gList, NewWebService(p, s, m))
+	}
+	gList = append(gList, NewConversion(p, rest.NewModel(rest.UpperKind(o.kind)), models...))
+
+	return scaffold.Generate(gList...)
 }
 
 func Command() *cobra.Command {
@@ -36,5 +63,12 @@ func Command() *cobra.Command {
 	cmd.MarkFlagRequired("kind")
 	cmd.Flags().StringVarP(&o.pkg, "package", "p", "", "package name")
 	cmd.MarkFlagRequired("package")
+	cmd.Flags().StringSliceVarP(&o.versions, "versions", "v", nil, "api versions of the resource, eg: v1,v2")
 	return cmd
 }
+
+func init() {
+	plugin.MustRegister("ws", func(cfg *plugin.Config) (scaffold.Generator, error) {
+		return NewWebService(cfg.Package, cfg.Service, cfg.Model), nil
+	})
+}
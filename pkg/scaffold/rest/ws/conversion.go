@@ -0,0 +1,91 @@
+package ws
+
+import (
+	"bytes"
+	"text/template"
+
+	"github.com/pkg/errors"
+	"github.com/sxllwx/vulcanus/pkg/scaffold"
+	"github.com/sxllwx/vulcanus/pkg/scaffold/rest"
+)
+
+const conversionSuggestName = "conversion.go"
+
+type conversionGenerator struct {
+	*bytes.Buffer
+	config *conversionConfig
+}
+
+type conversionConfig struct {
+	Package rest.Package
+	// the internal hub type, every external version convert to/from it
+	Hub rest.Model
+	// the external versioned types
+	Versions []rest.Model
+}
+
+// NewConversion
+// generate the internal hub type and the conversion funcs
+// between the hub and every external version
+func NewConversion(p rest.Package, hub rest.Model, versions ...rest.Model) scaffold.Generator {
+
+	return &conversionGenerator{
+		Buffer: &bytes.Buffer{},
+		config: &conversionConfig{
+			Package:  p,
+			Hub:      hub,
+			Versions: versions,
+		},
+	}
+}
+
+func (g *conversionGenerator) Generate() error {
+
+	if err := g.generateConversion(); err != nil {
+		return errors.WithMessage(err, "generate conversion")
+	}
+	return nil
+}
+
+func (g *conversionGenerator) generateConversion() error {
+
+	const tmplt = `package {{.Package.Name}}
+
+// {{.Hub.Name}}
+// the internal hub type, all the external versions convert through it
+// TODO: Fix the struct{} ->  real model
+type {{.Hub.Name}} = struct{}
+
+{{range .Versions}}
+// Convert{{.Name}}To{{$.Hub.Name}}
+// convert the external version to the internal hub
+func Convert{{.Name}}To{{$.Hub.Name}}(in *{{.Name}}, out *{{$.Hub.Name}}) error {
+	// TODO: copy the fields
+	*out = {{$.Hub.Name}}(*in)
+	return nil
+}
+
+// Convert{{$.Hub.Name}}To{{.Name}}
+// convert the internal hub to the external version
+func Convert{{$.Hub.Name}}To{{.Name}}(in *{{$.Hub.Name}}, out *{{.Name}}) error {
+	// TODO: copy the fields
+	*out = {{.Name}}(*in)
+	return nil
+}
+{{end}}
+`
+
+	t, err := template.New("conversion-tplt").Parse(tmplt)
+	if err != nil {
+		return errors.WithMessage(err, "parse template")
+	}
+
+	if err := t.Execute(g.Buffer, g.config); err != nil {
+		return errors.WithMessage(err, "execute template")
+	}
+	return nil
+}
+
+func (g *conversionGenerator) SuggestFileName() string {
+	return conversionSuggestName
+}
@@ -2,6 +2,8 @@ package ws
 
 import (
 	"bytes"
+	"fmt"
+	"strings"
 	"text/template"
 
 	"github.com/sxllwx/vulcanus/pkg/scaffold"
@@ -168,5 +170,10 @@ func (s *{{.Service.Type}})update(request *restful.Request, response *restful.Re
 }
 
 func (g *webServiceGenerator) SuggestFileName() string {
-	return webServiceSuggestName
+
+	if len(g.config.Service.VersionID) == 0 {
+		return webServiceSuggestName
+	}
+	// every version has its own file, eg: web-service-v1.go
+	return fmt.Sprintf("%s-%s.go", strings.TrimSuffix(webServiceSuggestName, ".go"), g.config.Service.Version)
 }
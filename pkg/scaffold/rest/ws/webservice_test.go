@@ -2,6 +2,7 @@ package ws
 
 import (
 	"io/ioutil"
+	"strings"
 	"testing"
 
 	"github.com/sxllwx/vulcanus/pkg/scaffold/rest"
@@ -25,3 +26,47 @@ func TestWS(t *testing.T) {
 
 	t.Logf("%s", r)
 }
+
+func TestVersionedWS(t *testing.T) {
+
+	p := rest.NewPackage("main")
+	hub := rest.NewModel("Book")
+
+	var models []rest.Model
+	for _, s := range rest.NewVersionedServices("book", "v1", "v2") {
+		m := rest.NewVersionedModel("Book", s.Version)
+		models = append(models, m)
+
+		wsG := NewWebService(p, s, m)
+		if err := wsG.Generate(); err != nil {
+			t.Fatal(err)
+		}
+		if e, a := "web-service-"+s.Version+".go", wsG.SuggestFileName(); e != a {
+			t.Fatalf("expect file name %s, got %s", e, a)
+		}
+
+		r, err := ioutil.ReadAll(wsG)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(r), "/api/"+s.Version+"/books") {
+			t.Fatalf("the version %s not in the url prefix", s.Version)
+		}
+		t.Logf("%s", r)
+	}
+
+	cG := NewConversion(p, hub, models...)
+	if err := cG.Generate(); err != nil {
+		t.Fatal(err)
+	}
+	r, err := ioutil.ReadAll(cG)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []string{"ConvertBookV1ToBook", "ConvertBookToBookV1", "ConvertBookV2ToBook", "ConvertBookToBookV2"} {
+		if !strings.Contains(string(r), f) {
+			t.Fatalf("conversion func %s not generated", f)
+		}
+	}
+	t.Logf("%s", r)
+}